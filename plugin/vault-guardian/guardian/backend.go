@@ -2,8 +2,13 @@ package guardian
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/hashicorp/vault/helper/locksutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
@@ -19,9 +24,16 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 
 func Backend(c *logical.BackendConfig) *backend {
 	var b backend
+	b.identities = newIdentityCache(IdentityCacheTTL, IdentityCacheSize)
+	b.mfaLogins = newPendingLogins()
+	b.rateLimits = newRateLimiter()
+	b.userLocks = locksutil.CreateLocks()
 	b.Backend = &framework.Backend{
-		Help:         "",
-		PathsSpecial: &logical.Paths{Unauthenticated: []string{"login"}},
+		Help: "",
+		PathsSpecial: &logical.Paths{
+			Unauthenticated: []string{"login"},
+			SealWrapStorage: []string{"users/", "reauth/", "escrow/recoveries/"},
+		},
 		Paths: framework.PathAppend([]*framework.Path{
 			&framework.Path{
 				Pattern: "login",
@@ -32,6 +44,18 @@ func Backend(c *logical.BackendConfig) *backend {
 					"okta_password": &framework.FieldSchema{
 						Type:        framework.TypeString,
 						Description: "Password for associated Okta account."},
+					"id_token": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "ID token from the OIDC issuer, used instead of Okta credentials when provider=oidc."},
+					"passcode": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "One-time passcode from the user's Okta MFA factor."},
+					"factor": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "MFA factor to use, either push or totp.  Defaults to totp when a passcode is given."},
+					"transaction_id": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Returned while a push is pending, send it back with okta_username to poll for the result."},
 				},
 				Callbacks: map[logical.Operation]framework.OperationFunc{
 					logical.UpdateOperation: b.pathLogin,
@@ -44,17 +68,310 @@ func Backend(c *logical.BackendConfig) *backend {
 						Type:        framework.TypeString,
 						Description: "Raw hashed transaction data to sign, do not include the initial 0x.",
 					},
+					"message": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Message to hash and sign per EIP-191, in place of raw_data.",
+					},
+					"message_encoding": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "How message is encoded, utf8 for text or hex for binary data.  Defaults to utf8.",
+					},
+					"version": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "EIP-191 version for message, 0x45 for personal_sign or 0x00 for an intended validator.  Defaults to 0x45.",
+					},
+					"validator": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Address of the intended validator, required by version 0x00.",
+					},
+					"signature_format": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "How to encode the signature, one of raw, v27, split and compact.  Defaults to raw for raw_data and v27 for message.",
+					},
 					"address_index": &framework.FieldSchema{
 						Type:        framework.TypeInt,
 						Description: "Integer index of which generated address to use.",
 						Default:     0,
 					},
+					"key_name": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Which of the caller's keys to use, from guardian/keys.  Defaults to their original key.",
+					},
 				},
 				Callbacks: map[logical.Operation]framework.OperationFunc{
 					logical.CreateOperation: b.pathSign,
 					logical.UpdateOperation: b.pathSign,
 					logical.ReadOperation:   b.pathGetAddress,
 				},
+				HelpSynopsis: "Sign a 32 byte hash or a message, or read the caller's address.",
+				HelpDescription: `
+
+Signs raw_data as given, or hashes a message the way personal_sign does first.  Calls made
+with a single-use token from login get a fresh_client_token back for the next call, until
+the login's max_token_refreshes run out.  A call refused for its rate limit gets none, and
+since Vault has already spent its token, the caller has to log in again after retry_after.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "sign/transaction",
+				Fields: map[string]*framework.FieldSchema{
+					"chain_id": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Chain ID the transaction is for, used in its EIP-155 signature.",
+					},
+					"raw_tx": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Hex RLP of the unsigned transaction, in place of the individual fields.",
+					},
+					"nonce": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Transaction nonce, decimal or 0x-prefixed hex.",
+					},
+					"gas_price": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Gas price in wei, decimal or 0x-prefixed hex.",
+					},
+					"gas_limit": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Gas limit, decimal or 0x-prefixed hex.",
+					},
+					"to": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Recipient address, leave empty to deploy a contract.",
+					},
+					"value": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Value in wei, decimal or 0x-prefixed hex.",
+					},
+					"data": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Hex call data or contract bytecode.",
+					},
+					"address_index": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Integer index of which generated address to use.",
+						Default:     0,
+					},
+					"key_name": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Which of the caller's keys to use, from guardian/keys.  Defaults to their original key.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.CreateOperation: b.pathSignTransaction,
+					logical.UpdateOperation: b.pathSignTransaction,
+				},
+				HelpSynopsis: "Sign an unsigned Ethereum transaction and return it ready to broadcast.",
+				HelpDescription: `
+
+Takes either the transaction's fields or its unsigned RLP in raw_tx, along with a chain_id.
+The plugin builds the EIP-155 signing hash itself, then returns the RLP-encoded signed_tx,
+its tx_hash, and the v, r and s values of the signature.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "sign/typed",
+				Fields: map[string]*framework.FieldSchema{
+					"typed_data": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "EIP-712 typed data JSON document, as passed to eth_signTypedData_v4.",
+					},
+					"chain_id": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Optional chain ID the domain's chainId must match.",
+					},
+					"address_index": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Integer index of which generated address to use.",
+						Default:     0,
+					},
+					"key_name": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Which of the caller's keys to use, from guardian/keys.  Defaults to their original key.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.CreateOperation: b.pathSignTyped,
+					logical.UpdateOperation: b.pathSignTyped,
+				},
+				HelpSynopsis: "Sign EIP-712 typed data.",
+				HelpDescription: `
+
+Validates the typed_data document's domain, which must carry a chainId, then computes the
+EIP-712 digest in the plugin and signs it.  The response includes the digest along with the
+domain_separator and message_hash it was built from, so clients can display and verify it.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "verify",
+				Fields: map[string]*framework.FieldSchema{
+					"signature": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Hex signature to check, 65 bytes with a v of 0, 1, 27 or 28, or 64 bytes per EIP-2098.",
+					},
+					"raw_data": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Hash the signature is over, do not include the initial 0x.",
+					},
+					"message": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Message the signature is over, hashed per EIP-191 in place of raw_data.",
+					},
+					"message_encoding": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "How message is encoded, utf8 for text or hex for binary data.  Defaults to utf8.",
+					},
+					"version": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "EIP-191 version for message, 0x45 for personal_sign or 0x00 for an intended validator.  Defaults to 0x45.",
+					},
+					"validator": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Address of the intended validator, required by version 0x00.",
+					},
+					"addresses": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Addresses the signer may be, besides the caller's own address.",
+					},
+					"address_index": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Integer index of the caller's address to check against.",
+						Default:     0,
+					},
+					"key_name": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Which of the caller's keys to check against.  Defaults to their original key.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.CreateOperation: b.pathVerify,
+					logical.UpdateOperation: b.pathVerify,
+				},
+				HelpSynopsis: "Recover who made a signature, and check it against the caller or given addresses.",
+				HelpDescription: `
+
+Takes the signature with either the raw_data hash or the message it is over, hashing messages
+the same way guardian/sign does.  Returns the recovered signer and their public key, and
+whether the signer is the caller's own address or one of addresses, and which it matched.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "history",
+				Fields: map[string]*framework.FieldSchema{
+					"since": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Only return events at or after this time, RFC 3339 or seconds since the epoch.",
+					},
+					"until": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Only return events before this time, RFC 3339 or seconds since the epoch.",
+					},
+					"after": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "The next value from the previous page, to continue from it.",
+					},
+					"limit": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Most events to return, defaults to 50 and cannot exceed 500.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation: b.pathHistory,
+				},
+				HelpSynopsis: "Read the caller's sign history, oldest first.",
+				HelpDescription: `
+
+Every signature the plugin produces is recorded with its mode, digest, and the chain,
+destination and value when the plugin could decode them.  Pages hold up to limit events;
+pass the returned next as after to fetch the following page.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "rotate",
+				Fields:  rotateFields(),
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.CreateOperation: b.pathRotate,
+					logical.UpdateOperation: b.pathRotate,
+				},
+				HelpSynopsis: "Replace the caller's key with a newly generated one.",
+				HelpDescription: `
+
+Requires fresh credentials for the caller's account alongside their token.  The old key is
+retired rather than deleted, and its addresses stay listed at guardian/addresses so funds can
+be moved to the new ones.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "export",
+				Fields:  exportFields(),
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.CreateOperation: b.pathExport,
+					logical.UpdateOperation: b.pathExport,
+				},
+				HelpSynopsis: "Export the caller's key to use it outside the Guardian.",
+				HelpDescription: `
+
+Requires fresh credentials for the caller's account alongside their token.  Returns one
+address as a Web3 v3 keystore encrypted with the given passphrase, or the whole HD key as
+its mnemonic.  Every export is recorded in the caller's history, and maintainers can turn
+exports off with export_disabled on guardian/authorize.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "addresses",
+				Fields: map[string]*framework.FieldSchema{
+					"address_index": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Which generated address to list for each key version.",
+						Default:     0,
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation: b.pathAddresses,
+				},
+				HelpSynopsis: "List the address of every key the caller has held, oldest first.",
+			},
+			&framework.Path{
+				Pattern: "keys/?$",
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ListOperation: b.pathKeyList,
+				},
+				HelpSynopsis: "List the names of the caller's keys, starting with default.",
+			},
+			&framework.Path{
+				Pattern: "keys/" + framework.GenericNameRegex("key_name"),
+				Fields: map[string]*framework.FieldSchema{
+					"key_name": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Name of the key, default for the caller's original key.",
+					},
+					"address_index": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Integer index of which generated address to read.",
+						Default:     0,
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.CreateOperation: b.pathKeyCreate,
+					logical.UpdateOperation: b.pathKeyCreate,
+					logical.ReadOperation:   b.pathGetAddress,
+				},
+				HelpSynopsis: "Create a named key for the caller, or read one of its addresses.",
+				HelpDescription: `
+
+Every user starts with one key, named default.  Writing to guardian/keys/<name> generates
+another, which sign, sign/transaction and sign/typed use when given it as key_name.  Signing
+policies can limit how many keys a user holds with max_keys.  Named keys are escrowed like
+the default key, under <username>/named/<name>.
+
+`,
 			},
 			&framework.Path{
 				Pattern: "authorize",
@@ -63,6 +380,42 @@ func Backend(c *logical.BackendConfig) *backend {
 						Type:        framework.TypeString,
 						Description: "SecretID of the Guardian AppRole.",
 					},
+					"wrapped_secret_id": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Response-wrapping token around a spare SecretID, spent to reauthorize if the guardian token can no longer be renewed.",
+					},
+					"vault_addr": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Address the plugin uses to reach Vault's API, defaults to http://127.0.0.1:8200.",
+					},
+					"vault_ca_cert": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "PEM-encoded CA bundle used to verify Vault's TLS certificate.",
+					},
+					"vault_client_cert": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "PEM-encoded client certificate presented to Vault, requires vault_client_key.",
+					},
+					"vault_client_key": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "PEM-encoded private key for vault_client_cert.",
+					},
+					"vault_tls_server_name": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Name to verify Vault's TLS certificate against, when it differs from vault_addr's host.",
+					},
+					"vault_namespace": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Vault Enterprise namespace the Guardian's mounts live in.",
+					},
+					"key_storage": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Where user keys live: kv for the /keys mount, plugin for the Guardian's seal-wrapped storage.  Defaults to kv.",
+					},
+					"provider": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Identity provider endusers log in with, either okta or oidc.  Defaults to okta.",
+					},
 					"okta_url": &framework.FieldSchema{
 						Type:        framework.TypeString,
 						Description: "Organization's Okta URL.",
@@ -71,20 +424,414 @@ func Backend(c *logical.BackendConfig) *backend {
 						Type:        framework.TypeString,
 						Description: "Permissioned API token from Okta organization.",
 					},
+					"oidc_issuer": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "OIDC issuer URL when provider=oidc, defaults to Google's https://accounts.google.com.",
+					},
+					"oidc_client_id": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "OAuth client ID which ID tokens must be issued to when provider=oidc.",
+					},
+					"oidc_allowed_domains": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Email domains allowed to hold Guardian keys, required when provider=oidc.",
+					},
+					"require_mfa": &framework.FieldSchema{
+						Type:        framework.TypeBool,
+						Description: "Refuse Okta logins which do not present a passcode or push factor.",
+					},
+					"sign_token_ttl": &framework.FieldSchema{
+						Type:        framework.TypeDurationSecond,
+						Description: "Lifetime of the single-use tokens returned by login and sign, defaults to 5m.",
+					},
+					"max_token_refreshes": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "How many fresh_client_tokens one login may chain through sign calls, defaults to 10.  0 disables refreshes.",
+					},
+					"escrow_threshold": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Split new keys among the registered escrow maintainers, this many of whom can recover them.  0 disables escrow.",
+					},
+					"export_disabled": &framework.FieldSchema{
+						Type:        framework.TypeBool,
+						Description: "Refuse guardian/export, so keys never leave the Guardian.",
+					},
+					"login_rate_limit": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Logins per minute allowed for each username and remote address, defaults to 10.",
+					},
+					"sign_rate_limit": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Signatures per minute allowed for each user, entity and remote address, defaults to 60.",
+					},
+					"global_login_rate_limit": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Logins per minute allowed across all callers, 0 leaves them unlimited.",
+					},
+					"global_sign_rate_limit": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Signatures per minute allowed across all callers, 0 leaves them unlimited.",
+					},
+					"history_retention": &framework.FieldSchema{
+						Type:        framework.TypeDurationSecond,
+						Description: "How long sign events are kept in the history, 0 keeps them forever.",
+					},
+					"reconcile_interval": &framework.FieldSchema{
+						Type:        framework.TypeDurationSecond,
+						Description: "How often users are checked against Okta and suspended if deactivated, defaults to 1h.",
+					},
 				},
 				Callbacks: map[logical.Operation]framework.OperationFunc{
 					logical.CreateOperation: b.pathAuthorize,
 					logical.UpdateOperation: b.pathAuthorize,
+					logical.ReadOperation:   b.pathReadAuthorize,
+				},
+			},
+			&framework.Path{
+				Pattern: "config",
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation: b.pathConfigRead,
+				},
+				HelpSynopsis: "Read the Guardian's configuration, without its secrets.",
+				HelpDescription: `
+
+Shows every setting made through guardian/authorize.  The guardian token, Okta API token
+and Vault client key are never returned, only whether each one is set.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "admin/policies/?$",
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ListOperation: b.pathPolicyList,
+				},
+				HelpSynopsis: "List the signing policies.",
+			},
+			&framework.Path{
+				Pattern: "admin/policies/" + framework.GenericNameRegex("name"),
+				Fields: map[string]*framework.FieldSchema{
+					"name": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Name of the signing policy.",
+					},
+					"users": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Usernames the policy applies to, * for every user.",
+					},
+					"groups": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Okta groups whose members the policy applies to.",
+					},
+					"allowed_modes": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Signing modes allowed, any of raw, message, transaction and typed.  Empty allows all of them, or only transaction and typed when chain, destination or value rules are set.",
+					},
+					"chain_ids": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Chain IDs transactions and typed data may be signed for.  Empty allows any chain.",
+					},
+					"allowed_addresses": &framework.FieldSchema{
+						Type:        framework.TypeCommaStringSlice,
+						Description: "Transaction destinations and typed data verifying contracts allowed.  Empty allows any address.",
+					},
+					"max_value": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Most wei a single transaction may send.  Empty is unlimited.",
+					},
+					"daily_max_value": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Most wei a user's transactions may send in any 24 hours.  Empty is unlimited.",
+					},
+					"max_keys": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Most keys a user may hold, counting their default key.  0 is unlimited.",
+					},
 				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation:   b.pathPolicyRead,
+					logical.CreateOperation: b.pathPolicyWrite,
+					logical.UpdateOperation: b.pathPolicyWrite,
+					logical.DeleteOperation: b.pathPolicyDelete,
+				},
+				HelpSynopsis: "Manage a signing policy.",
+				HelpDescription: `
+
+Signing policies limit what the users and Okta groups they are attached to may sign.  Every
+rule left empty is unrestricted, and a user bound by several policies must satisfy all of them.
+Chain, destination and value rules apply to sign/transaction and sign/typed, which the plugin
+can inspect, so a policy with any of them forbids raw and message signing unless its
+allowed_modes lists them.  allowed_addresses refuses typed data with no verifyingContract.
+max_keys limits how many keys users may hold, counting their default key along with those
+created at guardian/keys, and the lowest limit applies.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "admin/history/" + usernameRegex("user"),
+				Fields: map[string]*framework.FieldSchema{
+					"user": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Username whose sign events to read.",
+					},
+					"since": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Only return events at or after this time, RFC 3339 or seconds since the epoch.",
+					},
+					"until": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Only return events before this time, RFC 3339 or seconds since the epoch.",
+					},
+					"after": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "The next value from the previous page, to continue from it.",
+					},
+					"limit": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Most events to return, defaults to 50 and cannot exceed 500.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation: b.pathAdminHistory,
+				},
+				HelpSynopsis: "Read a user's sign history, oldest first.",
+			},
+			&framework.Path{
+				Pattern: "admin/rotate/" + usernameRegex("user"),
+				Fields: map[string]*framework.FieldSchema{
+					"user": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Username whose key to act on.",
+					},
+					"reason": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Why the key is being rotated, kept in the address history.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.CreateOperation: b.pathAdminRotate,
+					logical.UpdateOperation: b.pathAdminRotate,
+				},
+				HelpSynopsis: "Force a user onto a newly generated key, retiring their current one.",
+			},
+			&framework.Path{
+				Pattern: "admin/addresses/" + usernameRegex("user"),
+				Fields: map[string]*framework.FieldSchema{
+					"user": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Username whose key to act on.",
+					},
+					"address_index": &framework.FieldSchema{
+						Type:        framework.TypeInt,
+						Description: "Which generated address to list for each key version.",
+						Default:     0,
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation: b.pathAdminAddresses,
+				},
+				HelpSynopsis: "List the address of every key a user has held, oldest first.",
+			},
+			&framework.Path{
+				Pattern: "admin/users/?$",
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ListOperation: b.pathUserList,
+				},
+				HelpSynopsis: "List the users who hold a Guardian key.",
+			},
+			&framework.Path{
+				Pattern: "admin/users/" + usernameRegex("user"),
+				Fields: map[string]*framework.FieldSchema{
+					"user": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Username to act on.",
+					},
+					"status": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "active to let the user sign, or disabled to block them while keeping their key.",
+					},
+					"reason": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Why the status is changing, shown alongside it.",
+					},
+					"confirm": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Must repeat the username to delete the user.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation:   b.pathUserRead,
+					logical.CreateOperation: b.pathUserWrite,
+					logical.UpdateOperation: b.pathUserWrite,
+					logical.DeleteOperation: b.pathUserDelete,
+				},
+				HelpSynopsis: "Inspect, disable, re-enable or delete a user.",
+				HelpDescription: `
+
+Reading shows the user's address, when they were created and last signed, and their status.
+A disabled user cannot sign or export their key until set back to active.  Deleting destroys
+their current and retired keys, so it requires confirm to repeat the username; their sign
+history is kept.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "admin/repair/" + usernameRegex("user"),
+				Fields: map[string]*framework.FieldSchema{
+					"user": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Username to repair.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.CreateOperation: b.pathUserRepair,
+					logical.UpdateOperation: b.pathUserRepair,
+				},
+				HelpSynopsis: "Finish or clean up a user whose creation failed part way.",
+				HelpDescription: `
+
+A user with a key is registered with the identity provider again, and escrowed if escrow is
+on and their escrow is missing or for another key.  A user without a key is unregistered and
+their account record removed, so their next login creates them from scratch.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "admin/reconcile",
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation:   b.pathReconcileRead,
+					logical.CreateOperation: b.pathReconcileRun,
+					logical.UpdateOperation: b.pathReconcileRun,
+				},
+				HelpSynopsis: "Read the last reconciliation of users against Okta, or run one now.",
+				HelpDescription: `
+
+Every reconcile_interval, each user with a key is looked up in Okta.  Users whose account is
+deprovisioned, suspended or gone are suspended from signing, and suspended users whose
+account is active again are restored.  Users a maintainer disabled stay disabled.  The report
+lists who changed, and any users who could not be checked.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "admin/escrow/maintainers/?$",
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ListOperation: b.pathEscrowMaintainerList,
+				},
+				HelpSynopsis: "List the maintainers registered to hold escrow shares.",
+			},
+			&framework.Path{
+				Pattern: "admin/escrow/maintainers/" + framework.GenericNameRegex("name"),
+				Fields: map[string]*framework.FieldSchema{
+					"name": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Name of the maintainer.",
+					},
+					"pgp_key": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "The maintainer's PGP public key, ASCII-armored or base64 encoded.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation:   b.pathEscrowMaintainerRead,
+					logical.CreateOperation: b.pathEscrowMaintainerWrite,
+					logical.UpdateOperation: b.pathEscrowMaintainerWrite,
+					logical.DeleteOperation: b.pathEscrowMaintainerDelete,
+				},
+				HelpSynopsis: "Register a maintainer's PGP key to receive escrow shares.",
+				HelpDescription: `
+
+Keys created while escrow_threshold is set are split among every maintainer registered at
+the time, each share encrypted to their PGP key.  Changing the maintainers does not re-split
+existing keys; that happens when a key is next rotated.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "admin/escrow/shares/" + escrowNameRegex("user"),
+				Fields: map[string]*framework.FieldSchema{
+					"user": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Username whose escrowed key to act on.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.ReadOperation: b.pathEscrowShares,
+				},
+				HelpSynopsis: "Read the encrypted escrow shares of a user's key.",
+			},
+			&framework.Path{
+				Pattern: "admin/escrow/recover/" + escrowNameRegex("user"),
+				Fields: map[string]*framework.FieldSchema{
+					"user": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Username whose escrowed key to act on.",
+					},
+					"maintainer": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "Name of the maintainer submitting their share.",
+					},
+					"share": &framework.FieldSchema{
+						Type:        framework.TypeString,
+						Description: "The maintainer's share, as it reads once decrypted with their PGP key.",
+					},
+				},
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.CreateOperation: b.pathEscrowRecover,
+					logical.UpdateOperation: b.pathEscrowRecover,
+					logical.DeleteOperation: b.pathEscrowRecoverCancel,
+				},
+				HelpSynopsis: "Submit a decrypted share towards recovering a user's escrowed key.",
+				HelpDescription: `
+
+Each maintainer submits their own share.  Once threshold of them are in, the key is rebuilt,
+checked against the escrowed address, and written back to the user's key storage.  Deleting
+discards the shares submitted so far.
+
+`,
+			},
+			&framework.Path{
+				Pattern: "admin/migrate-keys",
+				Callbacks: map[logical.Operation]framework.OperationFunc{
+					logical.CreateOperation: b.pathMigrateKeys,
+					logical.UpdateOperation: b.pathMigrateKeys,
+				},
+				HelpSynopsis: "Move user keys from the /keys KV mount into plugin storage.",
+				HelpDescription: `
+
+Moves every keys/<username> entry into the Guardian's seal-wrapped storage, deleting each
+one from the KV mount once its copy reads back the same, then switches key_storage to
+plugin.  Users whose plugin storage already holds a different key are skipped, and their
+KV entries left in place.
+
+`,
 			},
 		}),
-		BackendType: logical.TypeLogical,
+		PeriodicFunc: b.periodicFunc,
+		Invalidate:   b.invalidate,
+		BackendType:  logical.TypeLogical,
 	}
 	return &b
 }
 
 type backend struct {
 	*framework.Backend
+
+	clientLock sync.RWMutex
+	cfg        *Config
+	client     *Client
+	identities *identityCache
+	mfaLogins  *pendingLogins
+	rateLimits *rateLimiter
+	spendLock  sync.Mutex
+	rotateLock sync.Mutex
+	escrowLock sync.Mutex
+	userLocks  []*locksutil.LockEntry
+
+	reconcileLock sync.Mutex
+	lastReconcile time.Time
+
+	historyLock      sync.Mutex
+	lastHistoryPrune time.Time
 }
 
 func (b *backend) Config(ctx context.Context, s logical.Storage) (*Config, error) {
@@ -98,11 +845,38 @@ func (b *backend) Config(ctx context.Context, s logical.Storage) (*Config, error
 			return nil, err
 		}
 	} else {
-		result = Config{"", "", ""}
+		result = Config{}
 	}
 	return &result, nil
 }
 
+// periodicFunc : Housekeeping Vault runs about once a minute.  Every step runs even when an
+// earlier one fails, renewal first since a lapsed guardian token stops everything else, and
+// their failures are returned together.
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	b.mfaLogins.tidy()
+	b.rateLimits.tidy()
+	steps := []struct {
+		name string
+		run  func(context.Context, logical.Storage) error
+	}{
+		{"renewing guardian token", b.renewGuardianToken},
+		{"tidying sign tokens", b.tidySignTokens},
+		{"pruning history", b.pruneHistory},
+		{"reconciling users", b.reconcileIfDue},
+	}
+	failures := []string{}
+	for _, step := range steps {
+		if err := step.run(ctx, req.Storage); err != nil {
+			failures = append(failures, step.name+": "+err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
 func (b *backend) pathExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
 	out, err := req.Storage.Get(ctx, req.Path)
 	if err != nil {
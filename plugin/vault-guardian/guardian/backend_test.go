@@ -0,0 +1,31 @@
+package guardian
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_impl(t *testing.T) {
+	var _ logical.Backend = new(backend)
+}
+
+// newTestBackend : A backend with cfg already saved, as if authorize had been called.
+func newTestBackend(t testing.TB, cfg *Config) (*backend, logical.Storage) {
+	ctx := context.Background()
+	conf := logical.TestBackendConfig()
+	conf.StorageView = &logical.InmemStorage{}
+	raw, err := Factory(ctx, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := logical.StorageEntryJSON("config", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.StorageView.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	return raw.(*backend), conf.StorageView
+}
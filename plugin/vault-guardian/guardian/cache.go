@@ -0,0 +1,236 @@
+package guardian
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	// IdentityCacheTTL : How long a resolved username or address is trusted before re-reading it.
+	IdentityCacheTTL = 5 * time.Minute
+	// IdentityCacheSize : Upper bound on entries in each of the identity cache's maps.
+	IdentityCacheSize = 10000
+)
+
+//-----------------------------------------
+//  Client Cache
+//-----------------------------------------
+
+// configAndClient : Returns the stored Config and a Client built from it.  Both are kept
+// until invalidateClient is called, which happens whenever the config is written.
+func (b *backend) configAndClient(ctx context.Context, s logical.Storage) (*Config, *Client, error) {
+	b.clientLock.RLock()
+	if b.client != nil {
+		cfg, client := b.cfg, b.client
+		b.clientLock.RUnlock()
+		return cfg, client, nil
+	}
+	b.clientLock.RUnlock()
+
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+	if b.client != nil {
+		return b.cfg, b.client, nil
+	}
+	cfg, err := b.Config(ctx, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := cfg.Client(s)
+	if err != nil {
+		return cfg, nil, err
+	}
+	b.cfg, b.client = cfg, client
+	return cfg, client, nil
+}
+
+// invalidateClient : Drops the cached Config and Client, and everything resolved through them.
+func (b *backend) invalidateClient() {
+	b.clientLock.Lock()
+	b.cfg, b.client = nil, nil
+	b.clientLock.Unlock()
+	b.identities.purge()
+}
+
+// invalidate : Called by Vault when another node changes our storage.
+func (b *backend) invalidate(ctx context.Context, key string) {
+	switch key {
+	case "config":
+		b.invalidateClient()
+	}
+}
+
+//-----------------------------------------
+//  Identity Cache
+//-----------------------------------------
+
+type cachedUsername struct {
+	username string
+	expires  time.Time
+}
+
+type cachedGroups struct {
+	groups  []string
+	expires time.Time
+}
+
+type cachedAddress struct {
+	address   string
+	publicKey string
+	legacy    bool
+	expires   time.Time
+}
+
+// identityCache : Bounded TTL cache from entity ID to username, from username and
+// address_index to address and public key, and from username to groups, so repeat callers skip the
+// identity and key lookups.
+type identityCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	usernames  map[string]cachedUsername
+	addresses  map[string]cachedAddress
+	userGroups map[string]cachedGroups
+}
+
+func newIdentityCache(ttl time.Duration, maxEntries int) *identityCache {
+	return &identityCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		usernames:  map[string]cachedUsername{},
+		addresses:  map[string]cachedAddress{},
+		userGroups: map[string]cachedGroups{}}
+}
+
+func addressCacheKey(username string, index int) string {
+	return fmt.Sprintf("%s/%d", username, index)
+}
+
+func (c *identityCache) username(entityID string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.usernames[entityID]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.usernames, entityID)
+		return "", false
+	}
+	return entry.username, true
+}
+
+func (c *identityCache) setUsername(entityID, username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.usernames[entityID]; !exists && len(c.usernames) >= c.maxEntries {
+		c.evictUsername()
+	}
+	c.usernames[entityID] = cachedUsername{username: username, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *identityCache) address(username string, index int) (address, publicKey string, legacy bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := addressCacheKey(username, index)
+	entry, ok := c.addresses[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.addresses, key)
+		return "", "", false, false
+	}
+	return entry.address, entry.publicKey, entry.legacy, true
+}
+
+func (c *identityCache) setAddress(username string, index int, address, publicKey string, legacy bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := addressCacheKey(username, index)
+	if _, exists := c.addresses[key]; !exists && len(c.addresses) >= c.maxEntries {
+		c.evictAddress()
+	}
+	c.addresses[key] = cachedAddress{address: address, publicKey: publicKey, legacy: legacy, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *identityCache) groups(username string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.userGroups[username]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.userGroups, username)
+		return nil, false
+	}
+	return entry.groups, true
+}
+
+func (c *identityCache) setGroups(username string, groups []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.userGroups[username]; !exists && len(c.userGroups) >= c.maxEntries {
+		c.evictGroups()
+	}
+	c.userGroups[username] = cachedGroups{groups: groups, expires: time.Now().Add(c.ttl)}
+}
+
+// invalidateUser : Forgets everything cached about username, call whenever their key changes.
+func (c *identityCache) invalidateUser(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for entityID, entry := range c.usernames {
+		if entry.username == username {
+			delete(c.usernames, entityID)
+		}
+	}
+	prefix := username + "/"
+	for key := range c.addresses {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.addresses, key)
+		}
+	}
+	delete(c.userGroups, username)
+}
+
+func (c *identityCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usernames = map[string]cachedUsername{}
+	c.addresses = map[string]cachedAddress{}
+	c.userGroups = map[string]cachedGroups{}
+}
+
+// evictUsername : Makes room by dropping the entry closest to expiring.  Caller holds mu.
+func (c *identityCache) evictUsername() {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range c.usernames {
+		if oldestKey == "" || entry.expires.Before(oldest) {
+			oldestKey, oldest = key, entry.expires
+		}
+	}
+	delete(c.usernames, oldestKey)
+}
+
+// evictAddress : Makes room by dropping the entry closest to expiring.  Caller holds mu.
+func (c *identityCache) evictAddress() {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range c.addresses {
+		if oldestKey == "" || entry.expires.Before(oldest) {
+			oldestKey, oldest = key, entry.expires
+		}
+	}
+	delete(c.addresses, oldestKey)
+}
+
+// evictGroups : Makes room by dropping the entry closest to expiring.  Caller holds mu.
+func (c *identityCache) evictGroups() {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range c.userGroups {
+		if oldestKey == "" || entry.expires.Before(oldest) {
+			oldestKey, oldest = key, entry.expires
+		}
+	}
+	delete(c.userGroups, oldestKey)
+}
@@ -0,0 +1,162 @@
+package guardian
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+const testHash = "397ed6e91ab1a5f3274256aa514495d712f06db38de036ca24c5e5e5f999868d"
+
+func TestIdentityCache(t *testing.T) {
+	c := newIdentityCache(time.Minute, 2)
+	c.setUsername("entity-a", "alice")
+	time.Sleep(time.Millisecond)
+	c.setUsername("entity-b", "bob")
+	time.Sleep(time.Millisecond)
+	c.setUsername("entity-c", "carol")
+	if len(c.usernames) != 2 {
+		t.Fatalf("expected cache to stay bounded at 2, has %d", len(c.usernames))
+	}
+	if _, ok := c.username("entity-a"); ok {
+		t.Error("expected the oldest entry to be evicted")
+	}
+	if username, ok := c.username("entity-c"); !ok || username != "carol" {
+		t.Errorf("expected carol, got %q", username)
+	}
+
+	c.setAddress("carol", 0, "0xc0", "0x04c0", false)
+	c.setAddress("carol", 1, "0xc1", "0x04c1", false)
+	c.invalidateUser("carol")
+	if _, ok := c.username("entity-c"); ok {
+		t.Error("expected invalidateUser to drop the entity mapping")
+	}
+	if _, _, _, ok := c.address("carol", 1); ok {
+		t.Error("expected invalidateUser to drop cached addresses")
+	}
+
+	expiring := newIdentityCache(-time.Second, 10)
+	expiring.setUsername("entity-a", "alice")
+	if _, ok := expiring.username("entity-a"); ok {
+		t.Error("expected expired entries to miss")
+	}
+}
+
+// newSigningBackend : A backend whose Vault is a fakeVault holding one HD user, alice.
+func newSigningBackend(t testing.TB) (*backend, logical.Storage, *fakeVault) {
+	fv := newFakeVault(t)
+	key, err := NewUserKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&kvKeyStore{vault: fv.client(t)}).writeKey(context.Background(), "alice", key); err != nil {
+		t.Fatal(err)
+	}
+	fv.entities["entity-alice"] = "alice"
+	b, storage := newTestBackend(t, &Config{
+		GuardianToken:      "guardian-token",
+		VaultAddr:          fv.server.URL,
+		Provider:           ProviderOIDC,
+		OIDCClientID:       testOIDCClientID,
+		OIDCAllowedDomains: []string{"eximchain.com"}})
+	return b, storage, fv
+}
+
+func signRequest(storage logical.Storage) *logical.Request {
+	return &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "sign",
+		Storage:   storage,
+		EntityID:  "entity-alice",
+		Data:      map[string]interface{}{"raw_data": testHash},
+	}
+}
+
+func TestBackend_ClientCachedUntilAuthorize(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+
+	cfg, first, err := b.configAndClient(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TokenRefreshes() != DefaultMaxTokenRefreshes {
+		t.Fatalf("expected refreshes to default to %d, got %d", DefaultMaxTokenRefreshes, cfg.TokenRefreshes())
+	}
+	_, second, err := b.configAndClient(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("expected the Client to be reused between requests")
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "authorize",
+		Storage:   storage,
+		Data:      map[string]interface{}{"max_token_refreshes": 3},
+	})
+	if err != nil || isError(resp) {
+		t.Fatalf("authorize failed: %v %#v", err, resp)
+	}
+	cfg, third, err := b.configAndClient(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first {
+		t.Fatal("expected authorize to invalidate the cached Client")
+	}
+	if cfg.TokenRefreshes() != 3 {
+		t.Fatalf("expected the rebuilt Config to carry the new settings, got %d", cfg.TokenRefreshes())
+	}
+}
+
+func TestBackend_SignSkipsEntityLookupWhenCached(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+
+	start := fv.requestCount()
+	for i := 0; i < 2; i++ {
+		resp, err := b.HandleRequest(ctx, signRequest(storage))
+		if err != nil || isError(resp) {
+			t.Fatalf("sign failed: %v %#v", err, resp)
+		}
+	}
+	// First sign: entity lookup + key read.  Second sign: key read only.
+	if count := fv.requestCount() - start; count != 3 {
+		t.Fatalf("expected 3 Vault calls across two signs, got %d", count)
+	}
+}
+
+func benchmarkSign(bench *testing.B, cached bool) {
+	b, storage, fv := newSigningBackend(bench)
+	defer fv.server.Close()
+	ctx := context.Background()
+	bench.ResetTimer()
+	start := fv.requestCount()
+	for i := 0; i < bench.N; i++ {
+		if !cached {
+			b.invalidateClient()
+		}
+		resp, err := b.HandleRequest(ctx, signRequest(storage))
+		if err != nil || isError(resp) {
+			bench.Fatalf("sign failed: %v %#v", err, resp)
+		}
+	}
+	bench.ReportMetric(float64(fv.requestCount()-start)/float64(bench.N), "vault-calls/op")
+}
+
+// BenchmarkSign_Uncached : Per-sign overhead when Config, Client and identity are rebuilt every call.
+func BenchmarkSign_Uncached(bench *testing.B) {
+	benchmarkSign(bench, false)
+}
+
+// BenchmarkSign_Cached : Per-sign overhead with the long-lived Client and identity cache.
+func BenchmarkSign_Cached(bench *testing.B) {
+	benchmarkSign(bench, true)
+}
@@ -1,10 +1,17 @@
 package guardian
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/api"
-	"github.com/okta/okta-sdk-golang/okta"
+	"github.com/hashicorp/vault/logical"
 )
 
 //-----------------------------------------
@@ -13,41 +20,232 @@ import (
 
 //
 type Client struct {
-	vault *api.Client
-	okta  *okta.Client
+	vault    *api.Client
+	identity IdentityProvider
+	keys     keyStore
 }
 
-// ClientFromConfig : Constructor which takes a Config to produce a Client.
-func ClientFromConfig(cfg *Config) (*Client, error) {
+// ClientFromConfig : Constructor which takes a Config to produce a Client.  Storage is the
+// plugin's own storage, which holds user keys when key_storage is plugin.
+func ClientFromConfig(cfg *Config, s logical.Storage) (*Client, error) {
 	var gc Client
 
 	// Set up Vault client with default token
-	conf := api.DefaultConfig()
-	conf.Address = "http://127.0.0.1:8200"
-	client, err := api.NewClient(conf)
+	client, err := vaultClientFromConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
-	client.SetToken(cfg.GuardianToken)
 	gc.vault = client
 
-	// Set up Okta client
-	oktaConfig := okta.NewConfig().WithOrgUrl(fmt.Sprintf("https://%s.okta.com", cfg.OktaURL)).WithToken(cfg.OktaToken)
-	oktaClient := okta.NewClient(oktaConfig, nil, nil)
-	gc.okta = oktaClient
+	// Set up the configured identity provider
+	identity, err := NewIdentityProvider(cfg, client)
+	if err != nil {
+		return nil, err
+	}
+	gc.identity = identity
+
+	// Set up the configured key store
+	switch cfg.KeyStorageMode() {
+	case KeyStorageKV:
+		gc.keys = &kvKeyStore{vault: client}
+	case KeyStoragePlugin:
+		gc.keys = &pluginKeyStore{storage: s}
+	default:
+		return nil, fmt.Errorf("unknown key_storage %q", cfg.KeyStorage)
+	}
 	return &gc, nil
 }
 
+// vaultClientFromConfig : Builds the API client the plugin uses to call back into Vault.
+func vaultClientFromConfig(cfg *Config) (*api.Client, error) {
+	conf := api.DefaultConfig()
+	conf.Address = cfg.VaultAddress()
+	tlsConfig, err := cfg.vaultTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport, ok := conf.HttpClient.Transport.(*http.Transport)
+		if !ok {
+			return nil, fmt.Errorf("unable to configure TLS on Vault client transport")
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	client, err := api.NewClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(cfg.GuardianToken)
+	if cfg.VaultNamespace != "" {
+		client.SetNamespace(cfg.VaultNamespace)
+	}
+	return client, nil
+}
+
+// DefaultVaultAddr : Where the plugin reaches Vault when vault_addr is not configured.
+const DefaultVaultAddr = "http://127.0.0.1:8200"
+
+// DefaultSignTokenTTL : Lifetime of single-use sign tokens when sign_token_ttl is not configured.
+const DefaultSignTokenTTL = 5 * time.Minute
+
+// DefaultMaxTokenRefreshes : fresh_client_tokens one login may chain when max_token_refreshes is not configured.
+const DefaultMaxTokenRefreshes = 10
+
 // Config : Required constants for running Guardian.  guardianToken must hold guardian policy.
+// MaxTokenRefreshes is how many fresh_client_tokens a single login can chain through sign calls,
+// nil when it was never set so the default applies, and 0 when refreshes are turned off.
+// Provider selects the IdentityProvider; the Okta fields apply to okta, the OIDC fields to oidc.
 type Config struct {
-	GuardianToken string `json:"guardian_token"`
-	OktaURL       string `json:"okta_url"`
-	OktaToken     string `json:"okta_token"`
+	GuardianToken        string   `json:"guardian_token"`
+	VaultAddr            string   `json:"vault_addr"`
+	VaultCACert          string   `json:"vault_ca_cert"`
+	VaultClientCert      string   `json:"vault_client_cert"`
+	VaultClientKey       string   `json:"vault_client_key"`
+	VaultTLSServerName   string   `json:"vault_tls_server_name"`
+	VaultNamespace       string   `json:"vault_namespace"`
+	KeyStorage           string   `json:"key_storage"`
+	Provider             string   `json:"provider"`
+	OktaURL              string   `json:"okta_url"`
+	OktaToken            string   `json:"okta_token"`
+	OIDCIssuer           string   `json:"oidc_issuer"`
+	OIDCClientID         string   `json:"oidc_client_id"`
+	OIDCAllowedDomains   []string `json:"oidc_allowed_domains"`
+	RequireMFA           bool     `json:"require_mfa"`
+	SignTokenTTL         int      `json:"sign_token_ttl"`
+	MaxTokenRefreshes    *int     `json:"max_token_refreshes,omitempty"`
+	HistoryRetention     int      `json:"history_retention"`
+	LoginRateLimit       int      `json:"login_rate_limit"`
+	SignRateLimit        int      `json:"sign_rate_limit"`
+	GlobalLoginRateLimit int      `json:"global_login_rate_limit"`
+	GlobalSignRateLimit  int      `json:"global_sign_rate_limit"`
+	ExportDisabled       bool     `json:"export_disabled"`
+	EscrowThreshold      int      `json:"escrow_threshold"`
+	ReconcileInterval    int      `json:"reconcile_interval"`
+}
+
+// VaultAddress : The configured Vault address, configs saved before it was configurable use the local listener.
+func (cfg *Config) VaultAddress() string {
+	if cfg.VaultAddr == "" {
+		return DefaultVaultAddr
+	}
+	return cfg.VaultAddr
+}
+
+// validateVaultConnection : Checks the Vault connection settings before they are saved.
+func (cfg *Config) validateVaultConnection() error {
+	addr, err := url.Parse(cfg.VaultAddress())
+	if err != nil {
+		return fmt.Errorf("vault_addr is not a valid URL: %v", err)
+	}
+	if addr.Scheme != "http" && addr.Scheme != "https" {
+		return fmt.Errorf("vault_addr must use http or https, not %q", addr.Scheme)
+	}
+	if addr.Host == "" {
+		return fmt.Errorf("vault_addr must include a host")
+	}
+	usesTLS := cfg.VaultCACert != "" || cfg.VaultClientCert != "" || cfg.VaultClientKey != "" || cfg.VaultTLSServerName != ""
+	if usesTLS && addr.Scheme != "https" {
+		return fmt.Errorf("TLS settings require an https vault_addr")
+	}
+	if strings.Trim(cfg.VaultNamespace, "/") != cfg.VaultNamespace {
+		return fmt.Errorf("vault_namespace must not begin or end with a slash")
+	}
+	_, err = cfg.vaultTLSConfig()
+	return err
+}
+
+// vaultTLSConfig : TLS settings for the Vault client, or nil when none are configured.
+func (cfg *Config) vaultTLSConfig() (*tls.Config, error) {
+	if cfg.VaultCACert == "" && cfg.VaultClientCert == "" && cfg.VaultClientKey == "" && cfg.VaultTLSServerName == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: cfg.VaultTLSServerName}
+	if cfg.VaultCACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(cfg.VaultCACert)) {
+			return nil, fmt.Errorf("vault_ca_cert does not contain any PEM certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (cfg.VaultClientCert == "") != (cfg.VaultClientKey == "") {
+		return nil, fmt.Errorf("vault_client_cert and vault_client_key must be provided together")
+	}
+	if cfg.VaultClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(cfg.VaultClientCert), []byte(cfg.VaultClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid vault_client_cert/vault_client_key: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// KeyStorageMode : Where user keys live, configs saved before plugin storage existed use the KV mount.
+func (cfg *Config) KeyStorageMode() string {
+	if cfg.KeyStorage == "" {
+		return KeyStorageKV
+	}
+	return cfg.KeyStorage
+}
+
+// ProviderName : The configured identity provider, configs saved before providers existed are Okta.
+func (cfg *Config) ProviderName() string {
+	if cfg.Provider == "" {
+		return ProviderOkta
+	}
+	return cfg.Provider
+}
+
+// TokenTTL : Lifetime of the single-use tokens handed out by login and sign.
+func (cfg *Config) TokenTTL() time.Duration {
+	if cfg.SignTokenTTL <= 0 {
+		return DefaultSignTokenTTL
+	}
+	return time.Duration(cfg.SignTokenTTL) * time.Second
+}
+
+// TokenRefreshes : How many fresh_client_tokens one login may chain, 0 when refreshes are off.
+func (cfg *Config) TokenRefreshes() int {
+	if cfg.MaxTokenRefreshes == nil {
+		return DefaultMaxTokenRefreshes
+	}
+	return *cfg.MaxTokenRefreshes
+}
+
+// HistoryRetentionPeriod : How long sign events are kept, zero keeps them forever.
+func (cfg *Config) HistoryRetentionPeriod() time.Duration {
+	return time.Duration(cfg.HistoryRetention) * time.Second
+}
+
+// ReconcilePeriod : How often users are checked against the identity provider's directory.
+func (cfg *Config) ReconcilePeriod() time.Duration {
+	if cfg.ReconcileInterval <= 0 {
+		return DefaultReconcileInterval
+	}
+	return time.Duration(cfg.ReconcileInterval) * time.Second
+}
+
+// LoginRateLimitPerMinute : Logins allowed per minute for each username and remote address.
+func (cfg *Config) LoginRateLimitPerMinute() int {
+	if cfg.LoginRateLimit <= 0 {
+		return DefaultLoginRateLimit
+	}
+	return cfg.LoginRateLimit
+}
+
+// SignRateLimitPerMinute : Signatures allowed per minute for each user, entity and remote address.
+func (cfg *Config) SignRateLimitPerMinute() int {
+	if cfg.SignRateLimit <= 0 {
+		return DefaultSignRateLimit
+	}
+	return cfg.SignRateLimit
 }
 
 // Client : Call on a Config to get a configured Client.
-func (cfg *Config) Client() (*Client, error) {
-	return ClientFromConfig(cfg)
+func (cfg *Config) Client(s logical.Storage) (*Client, error) {
+	return ClientFromConfig(cfg, s)
 }
 
 func (gc *Client) pluginAuthorized() (isAuthorized bool) {
@@ -58,44 +256,31 @@ func (gc *Client) pluginAuthorized() (isAuthorized bool) {
 //  User Management
 //-----------------------------------------
 
-func (gc *Client) loginEnduser(username string, password string) (clientToken string, err error) {
-	loginResp, loginErr := gc.vault.Logical().Write(fmt.Sprintf("/auth/okta/login/%s", username), map[string]interface{}{
-		"password": password,
-	})
-	if loginErr != nil {
-		return "", loginErr
-	}
-	return loginResp.Auth.ClientToken, nil
-}
-
-func (gc *Client) isNewUser(username string) (exists bool, err error) {
-	resp, err := gc.vault.Logical().Read(fmt.Sprintf("/auth/okta/users/%s", username))
+func (gc *Client) isNewUser(ctx context.Context, username string) (exists bool, err error) {
+	userKey, err := gc.keys.readKey(ctx, username)
 	if err != nil {
 		return false, err
 	}
-	// Determine what above looks like when no account is registered
-	return resp == nil, nil
+	return userKey == nil, nil
 }
 
-func (gc *Client) createEnduser(username string) (publicAddressHex string, err error) {
-	createData := map[string]interface{}{
-		"groups": []string{"vault-guardian-endusers"}}
-	_, userErr := gc.vault.Logical().Write(fmt.Sprintf("/auth/okta/users/%s", username), createData)
-	if userErr != nil {
-		return "", userErr
-	}
-	privKeyHex, publicAddressHex, createKeyErr := CreateKey()
-	if createKeyErr != nil {
-		return "", createKeyErr
-	}
-	secretData := map[string]interface{}{
-		"privKeyHex":       privKeyHex,
-		"publicAddressHex": publicAddressHex}
-	_, keyErr := gc.vault.Logical().Write(fmt.Sprintf("/keys/%s", username), secretData)
-	if keyErr != nil {
-		return "", keyErr
+// authenticate : Checks login credentials with the configured identity provider.
+func (gc *Client) authenticate(ctx context.Context, creds Credentials) (username string, err error) {
+	return gc.identity.Authenticate(ctx, creds)
+}
+
+// accountExists : Whether the identity provider recognizes username as part of the organization.
+func (gc *Client) accountExists(ctx context.Context, username string) (exists bool, err error) {
+	return gc.identity.UserExists(ctx, username)
+}
+
+// groupsForUser : The user's groups, or none if the identity provider has no notion of groups.
+func (gc *Client) groupsForUser(ctx context.Context, username string) ([]string, error) {
+	groupProvider, ok := gc.identity.(GroupProvider)
+	if !ok {
+		return nil, nil
 	}
-	return publicAddressHex, nil
+	return groupProvider.Groups(ctx, username)
 }
 
 //-----------------------------------------
@@ -114,16 +299,15 @@ func (gc *Client) usernameFromEntityID(EntityID string) (username string, err er
 	return alias["name"].(string), nil
 }
 
-func (gc *Client) readKeyHexByEntityID(EntityID string) (privKeyHex string, err error) {
-	username, usernameErr := gc.usernameFromEntityID(EntityID)
-	if usernameErr != nil {
-		return "", usernameErr
-	}
-	resp, err := gc.vault.Logical().Read(fmt.Sprintf("/keys/%s", username))
+func (gc *Client) readKeyByUsername(ctx context.Context, username string) (userKey *UserKey, err error) {
+	userKey, err = gc.keys.readKey(ctx, username)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if userKey == nil {
+		return nil, ErrNoKey
 	}
-	return resp.Data["privKeyHex"].(string), nil
+	return userKey, nil
 }
 
 //-----------------------------------------
@@ -145,27 +329,18 @@ func (gc *Client) tokenFromSecretID(secretID string) (clientToken string, err er
 	return resp.Auth.ClientToken, nil
 }
 
-func (gc *Client) makeSingleSignToken(username string) (clientToken string, err error) {
+func (gc *Client) makeSingleSignToken(username string, ttl time.Duration) (clientToken string, accessor string, err error) {
 	tokenArg := map[string]interface{}{
 		"policies": []string{"enduser"},
 		"num_uses": 1,
+		"ttl":      ttl.String(),
 		"metadata": map[string]string{"username": username}}
 	tokenResp, err := gc.vault.Logical().Write("/auth/token/create/guardian-enduser", tokenArg)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	return tokenResp.Auth.ClientToken, nil
-}
-
-//-----------------------------------------
-//  Okta Calls
-//-----------------------------------------
-
-func (gc *Client) oktaAccountExists(username string) (exists bool, err error) {
-	// Determine what the response looks like for non-existent users
-	user, _, err := gc.okta.User.GetUser(username, nil)
-	if err != nil {
-		return false, err
+	if tokenResp == nil || tokenResp.Auth == nil {
+		return "", "", fmt.Errorf("no auth info returned")
 	}
-	return user != nil, nil
+	return tokenResp.Auth.ClientToken, tokenResp.Auth.Accessor, nil
 }
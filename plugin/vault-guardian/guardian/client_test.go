@@ -0,0 +1,87 @@
+package guardian
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestConfig_ValidateVaultConnection(t *testing.T) {
+	valid := []*Config{
+		&Config{},
+		&Config{VaultAddr: "https://vault.eximchain.com:8200", VaultNamespace: "guardian/prod"},
+		&Config{VaultAddr: "https://10.0.0.5:8200", VaultTLSServerName: "vault.eximchain.com"},
+	}
+	for _, cfg := range valid {
+		if err := cfg.validateVaultConnection(); err != nil {
+			t.Errorf("expected %#v to be valid: %v", cfg, err)
+		}
+	}
+
+	invalid := map[string]*Config{
+		"bad scheme":         &Config{VaultAddr: "tcp://127.0.0.1:8200"},
+		"no host":            &Config{VaultAddr: "https://"},
+		"tls over http":      &Config{VaultAddr: "http://127.0.0.1:8200", VaultCACert: "not checked"},
+		"garbage ca":         &Config{VaultAddr: "https://127.0.0.1:8200", VaultCACert: "not a certificate"},
+		"cert without key":   &Config{VaultAddr: "https://127.0.0.1:8200", VaultClientCert: "cert"},
+		"slashed namespace":  &Config{VaultNamespace: "/guardian/"},
+		"unparseable client": &Config{VaultAddr: "https://127.0.0.1:8200", VaultClientCert: "cert", VaultClientKey: "key"},
+	}
+	for name, cfg := range invalid {
+		if err := cfg.validateVaultConnection(); err == nil {
+			t.Errorf("%s: expected validation to fail", name)
+		}
+	}
+}
+
+func TestClientFromConfig_TLSAndNamespace(t *testing.T) {
+	var gotToken, gotNamespace string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotToken = r.Header.Get("X-Vault-Token")
+		gotNamespace = r.Header.Get("X-Vault-Namespace")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"publicAddressHex": "0x0"},
+		})
+	}))
+	defer server.Close()
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	cfg := &Config{
+		Provider:       ProviderOIDC,
+		GuardianToken:  "guardian-token",
+		VaultAddr:      server.URL,
+		VaultCACert:    string(caPEM),
+		VaultNamespace: "guardian"}
+	if err := cfg.validateVaultConnection(); err != nil {
+		t.Fatal(err)
+	}
+	client, err := cfg.Client(&logical.InmemStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.vault.Address() != server.URL {
+		t.Fatalf("expected address %s, got %s", server.URL, client.vault.Address())
+	}
+	if _, err := client.vault.Logical().Read("keys/alice"); err != nil {
+		t.Fatalf("expected TLS request verified by vault_ca_cert to succeed: %v", err)
+	}
+	if gotToken != "guardian-token" {
+		t.Errorf("expected guardian token to be sent, got %q", gotToken)
+	}
+	if gotNamespace != "guardian" {
+		t.Errorf("expected namespace header guardian, got %q", gotNamespace)
+	}
+
+	untrusted := &Config{Provider: ProviderOIDC, GuardianToken: "guardian-token", VaultAddr: server.URL}
+	untrustedClient, err := untrusted.Client(&logical.InmemStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := untrustedClient.vault.Logical().Read("keys/alice"); err == nil {
+		t.Fatal("expected request without vault_ca_cert to fail certificate verification")
+	}
+}
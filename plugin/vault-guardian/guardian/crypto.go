@@ -2,10 +2,21 @@ package guardian
 
 import (
 	"encoding/hex"
+	"fmt"
 
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/common/hexutil"
 	"github.com/eximchain/go-ethereum/crypto"
+	bip32 "github.com/tyler-smith/go-bip32"
+	bip39 "github.com/tyler-smith/go-bip39"
 )
 
+// HDPathPrefix : BIP-44 path for Ethereum addresses, address_index is appended as the final child.
+const HDPathPrefix = "m/44'/60'/0'/0"
+
+// MnemonicEntropyBits : Entropy used for new mnemonics, produces a 24 word phrase.
+const MnemonicEntropyBits = 256
+
 // CreateKey : Generates a secp256k1 key, returns its hex representation & corresponding address
 func CreateKey() (privKeyHex, pubAddress string, err error) {
 	privKey, err := crypto.GenerateKey()
@@ -18,7 +29,57 @@ func CreateKey() (privKeyHex, pubAddress string, err error) {
 	return
 }
 
-// SignWithHexKey : Given bytes to sign and the hex representation of a private key, loads the key and returns the signature
+// CreateHDKey : Generates a BIP-39 mnemonic, returns it along with the address at index 0 of HDPathPrefix
+func CreateHDKey() (mnemonic, pubAddress string, err error) {
+	entropy, err := bip39.NewEntropy(MnemonicEntropyBits)
+	if err != nil {
+		return "", "", err
+	}
+	mnemonic, err = bip39.NewMnemonic(entropy)
+	if err != nil {
+		return "", "", err
+	}
+	privKeyHex, err := DeriveHexKey(mnemonic, 0)
+	if err != nil {
+		return "", "", err
+	}
+	pubAddress, err = AddressFromHexKey(privKeyHex)
+	if err != nil {
+		return "", "", err
+	}
+	return mnemonic, pubAddress, nil
+}
+
+// DeriveHexKey : Given a BIP-39 mnemonic, returns the hex private key at HDPathPrefix/index
+func DeriveHexKey(mnemonic string, index int) (privKeyHex string, err error) {
+	if index < 0 || int64(index) >= int64(bip32.FirstHardenedChild) {
+		return "", fmt.Errorf("address_index %d is out of range", index)
+	}
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, "")
+	if err != nil {
+		return "", err
+	}
+	key, err := bip32.NewMasterKey(seed)
+	if err != nil {
+		return "", err
+	}
+	path := []uint32{
+		bip32.FirstHardenedChild + 44,
+		bip32.FirstHardenedChild + 60,
+		bip32.FirstHardenedChild + 0,
+		0,
+		uint32(index)}
+	for _, childIdx := range path {
+		key, err = key.NewChildKey(childIdx)
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(common.LeftPadBytes(key.Key, 32)), nil
+}
+
+// SignWithHexKey : Given bytes to sign and the hex representation of a private key, loads the key and returns the
+// 65 byte signature, with v of 0 or 1 and a low s
 func SignWithHexKey(hash []byte, privKeyHex string) (sig []byte, err error) {
 	privKey, loadErr := crypto.HexToECDSA(privKeyHex)
 	if loadErr != nil {
@@ -28,6 +89,7 @@ func SignWithHexKey(hash []byte, privKeyHex string) (sig []byte, err error) {
 	if signErr != nil {
 		return nil, signErr
 	}
+	normalizeLowS(sig)
 	return sig, nil
 }
 
@@ -40,3 +102,51 @@ func AddressFromHexKey(privKeyHex string) (pubAddressHex string, err error) {
 	pubAddressHex = crypto.PubkeyToAddress(privKey.PublicKey).Hex()
 	return
 }
+
+// PublicKeyFromHexKey : Given a private key as a hex string, return its uncompressed 65 byte public key as 0x hex
+func PublicKeyFromHexKey(privKeyHex string) (publicKeyHex string, err error) {
+	privKey, err := crypto.HexToECDSA(privKeyHex)
+	if err != nil {
+		return "", err
+	}
+	return hexutil.Encode(crypto.FromECDSAPub(&privKey.PublicKey)), nil
+}
+
+// CompressPublicKey : Given an uncompressed public key as 0x hex, return its 33 byte compressed form as 0x hex
+func CompressPublicKey(publicKeyHex string) (compressedHex string, err error) {
+	publicKeyBytes, err := hexutil.Decode(publicKeyHex)
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := crypto.UnmarshalPubkey(publicKeyBytes)
+	if err != nil {
+		return "", err
+	}
+	return hexutil.Encode(crypto.CompressPubkey(publicKey)), nil
+}
+
+// RecoverSigner : Given a hash and its 65 byte signature, with a v of 0, 1, 27 or 28, or its 64 byte EIP-2098 signature,
+// return the signer's public key & address
+func RecoverSigner(hash []byte, sig []byte) (publicKeyHex, pubAddressHex string, err error) {
+	if len(hash) != 32 {
+		return "", "", fmt.Errorf("hash must be 32 bytes, got %d", len(hash))
+	}
+	if len(sig) == 64 {
+		sig = expandCompactSignature(sig)
+	}
+	if len(sig) != 65 {
+		return "", "", fmt.Errorf("signature must be 65 bytes, or 64 for EIP-2098, got %d", len(sig))
+	}
+	normalized := append([]byte{}, sig...)
+	if normalized[64] >= 27 {
+		normalized[64] -= 27
+	}
+	if normalized[64] > 1 {
+		return "", "", fmt.Errorf("signature v must be 0, 1, 27 or 28")
+	}
+	publicKey, err := crypto.SigToPub(hash, normalized)
+	if err != nil {
+		return "", "", err
+	}
+	return hexutil.Encode(crypto.FromECDSAPub(publicKey)), crypto.PubkeyToAddress(*publicKey).Hex(), nil
+}
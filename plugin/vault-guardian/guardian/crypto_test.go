@@ -0,0 +1,124 @@
+package guardian
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Standard BIP-39 test mnemonic, its m/44'/60'/0'/0/i addresses are widely published.
+const testMnemonic = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+func TestDeriveHexKey(t *testing.T) {
+	expected := map[int]string{
+		0: "0x9858EfFD232B4033E47d90003D41EC34EcaEda94",
+		1: "0x6Fac4D18c912343BF86fa7049364Dd4E424Ab9C0",
+	}
+	for index, address := range expected {
+		privKeyHex, err := DeriveHexKey(testMnemonic, index)
+		if err != nil {
+			t.Fatalf("deriving index %d: %v", index, err)
+		}
+		derived, err := AddressFromHexKey(privKeyHex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if derived != address {
+			t.Errorf("index %d: expected %s, got %s", index, address, derived)
+		}
+	}
+	if _, err := DeriveHexKey(testMnemonic, -1); err == nil {
+		t.Error("expected negative address_index to fail")
+	}
+}
+
+func TestUserKey_Legacy(t *testing.T) {
+	privKeyHex, address, err := CreateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := userKeyFromData(map[string]interface{}{
+		"privKeyHex":       privKeyHex,
+		"publicAddressHex": address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !legacy.IsLegacy() {
+		t.Fatal("expected key without mnemonic to be legacy")
+	}
+	if derived, err := legacy.Address(0); err != nil || derived != address {
+		t.Fatalf("expected legacy index 0 to be %s, got %s (%v)", address, derived, err)
+	}
+	if _, err := legacy.Address(1); err == nil {
+		t.Fatal("expected legacy key to reject address_index 1")
+	}
+}
+
+func TestUserKey_HD(t *testing.T) {
+	key, err := NewUserKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.IsLegacy() {
+		t.Fatal("expected new key to be HD")
+	}
+	first, err := key.Address(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != key.PublicAddressHex {
+		t.Fatalf("expected index 0 to match stored address %s, got %s", key.PublicAddressHex, first)
+	}
+	second, err := key.Address(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("expected distinct addresses per address_index")
+	}
+}
+
+func TestRecoverSigner(t *testing.T) {
+	privKeyHex, address, err := CreateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := PublicKeyFromHexKey(privKeyHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := CompressPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(publicKey) != 2+65*2 || !strings.HasPrefix(publicKey, "0x04") {
+		t.Fatalf("expected a 65 byte uncompressed key, got %s", publicKey)
+	}
+	if len(compressed) != 2+33*2 || (!strings.HasPrefix(compressed, "0x02") && !strings.HasPrefix(compressed, "0x03")) {
+		t.Fatalf("expected a 33 byte compressed key, got %s", compressed)
+	}
+
+	hash, _ := hex.DecodeString(testHash)
+	sig, err := SignWithHexKey(hash, privKeyHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []byte{0, 27} {
+		withV := append([]byte{}, sig...)
+		withV[64] += offset
+		recoveredKey, signer, err := RecoverSigner(hash, withV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signer != address || recoveredKey != publicKey {
+			t.Fatalf("expected %s with v offset %d, recovered %s", address, offset, signer)
+		}
+	}
+	sig[64] = 5
+	if _, _, err := RecoverSigner(hash, sig); err == nil {
+		t.Fatal("expected a v of 5 to be refused")
+	}
+	if _, _, err := RecoverSigner(hash, sig[:64]); err == nil {
+		t.Fatal("expected a short signature to be refused")
+	}
+}
@@ -0,0 +1,164 @@
+package guardian
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// Error codes : Every failed request carries one of these as error_code, so clients can tell
+// failures apart without reading the message.  They are part of the API and do not change.
+const (
+	// ErrCodeInvalidRequest : A field is missing, malformed or out of range.
+	ErrCodeInvalidRequest = "invalid_request"
+	// ErrCodeNotConfigured : The Guardian has not been authorized, or its config is unusable.
+	ErrCodeNotConfigured = "not_configured"
+	// ErrCodeLoginFailed : The identity provider rejected the credentials.
+	ErrCodeLoginFailed = "login_failed"
+	// ErrCodeMFARequired : An MFA factor has to accompany the credentials.
+	ErrCodeMFARequired = "mfa_required"
+	// ErrCodeMFAPending : The push has not been answered yet, poll with the transaction_id.
+	ErrCodeMFAPending = "mfa_pending"
+	// ErrCodeMFARejected : The push was declined.
+	ErrCodeMFARejected = "mfa_rejected"
+	// ErrCodeMFATimedOut : The push was not answered in time.
+	ErrCodeMFATimedOut = "mfa_timed_out"
+	// ErrCodeUnknownTransaction : The transaction_id is unknown to this node, or has expired.
+	ErrCodeUnknownTransaction = "unknown_transaction"
+	// ErrCodeReauthRequired : The operation needs fresh credentials for the caller's account.
+	ErrCodeReauthRequired = "reauth_required"
+	// ErrCodeNotInOrganization : The user does not belong to the organization, so gets no key.
+	ErrCodeNotInOrganization = "not_in_organization"
+	// ErrCodeUserNotFound : The user has no Guardian key.
+	ErrCodeUserNotFound = "user_not_found"
+	// ErrCodeNotFound : The policy, maintainer or other record named does not exist.
+	ErrCodeNotFound = "not_found"
+	// ErrCodeKeyExists : The caller already holds a key with the name they asked to create.
+	ErrCodeKeyExists = "key_exists"
+	// ErrCodeKeyInEscrow : The user's key is missing but escrowed, so maintainers must recover it.
+	ErrCodeKeyInEscrow = "key_in_escrow"
+	// ErrCodeAccountDisabled : The user has been disabled or suspended.
+	ErrCodeAccountDisabled = "account_disabled"
+	// ErrCodePolicyDenied : A signing policy refused the request, see denial_reason.
+	ErrCodePolicyDenied = "policy_denied"
+	// ErrCodeRateLimited : Over a rate limit, see retry_after.
+	ErrCodeRateLimited = "rate_limited"
+	// ErrCodeExportDisabled : Maintainers have turned off key export.
+	ErrCodeExportDisabled = "export_disabled"
+	// ErrCodeKeyCreationFailed : The user was authenticated, but their key could not be made.
+	ErrCodeKeyCreationFailed = "key_creation_failed"
+	// ErrCodeSignFailed : The request was allowed, but signing it failed.
+	ErrCodeSignFailed = "sign_failed"
+	// ErrCodeUpstreamFailed : Vault or the identity provider could not be reached or errored.
+	ErrCodeUpstreamFailed = "upstream_failed"
+	// ErrCodeStorageFailed : Reading or writing the Guardian's storage or key store failed.
+	ErrCodeStorageFailed = "storage_failed"
+	// ErrCodeInternal : Anything else which went wrong inside the Guardian.
+	ErrCodeInternal = "internal_error"
+)
+
+// errorStatuses : The HTTP status each error code is sent with.
+var errorStatuses = map[string]int{
+	ErrCodeInvalidRequest:     http.StatusBadRequest,
+	ErrCodeNotConfigured:      http.StatusServiceUnavailable,
+	ErrCodeLoginFailed:        http.StatusUnauthorized,
+	ErrCodeMFARequired:        http.StatusUnauthorized,
+	ErrCodeMFAPending:         http.StatusAccepted,
+	ErrCodeMFARejected:        http.StatusUnauthorized,
+	ErrCodeMFATimedOut:        http.StatusUnauthorized,
+	ErrCodeUnknownTransaction: http.StatusBadRequest,
+	ErrCodeReauthRequired:     http.StatusUnauthorized,
+	ErrCodeNotInOrganization:  http.StatusForbidden,
+	ErrCodeUserNotFound:       http.StatusNotFound,
+	ErrCodeNotFound:           http.StatusNotFound,
+	ErrCodeKeyExists:          http.StatusConflict,
+	ErrCodeKeyInEscrow:        http.StatusConflict,
+	ErrCodeAccountDisabled:    http.StatusForbidden,
+	ErrCodePolicyDenied:       http.StatusForbidden,
+	ErrCodeRateLimited:        http.StatusTooManyRequests,
+	ErrCodeExportDisabled:     http.StatusForbidden,
+	ErrCodeKeyCreationFailed:  http.StatusInternalServerError,
+	ErrCodeSignFailed:         http.StatusInternalServerError,
+	ErrCodeUpstreamFailed:     http.StatusBadGateway,
+	ErrCodeStorageFailed:      http.StatusInternalServerError,
+	ErrCodeInternal:           http.StatusInternalServerError,
+}
+
+// ErrNoKey : Returned when the user asked for has no key in the key store.
+var ErrNoKey = errors.New("no key is stored for this user")
+
+// ErrNoNamedKey : Returned when the user has no key by the key_name asked for.
+var ErrNoNamedKey = errors.New("no key by that name is stored for this user")
+
+// ErrKeyInEscrow : Returned by createUser when a user without a key still has one escrowed,
+// which a new key would overwrite before maintainers could recover it.
+var ErrKeyInEscrow = errors.New("the user's key is missing but escrowed, recover it instead")
+
+// ErrNoEscrow : Returned when the user asked for has no escrowed key to recover.
+var ErrNoEscrow = errors.New("no key is escrowed for this user")
+
+//-----------------------------------------
+//  Error Responses
+//-----------------------------------------
+
+func errorStatus(code string) int {
+	if status, ok := errorStatuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// errorResp : A failure the caller can act on.  The body carries error, error_code and any
+// extra fields, and goes out with the code's HTTP status, so handlers return it with a nil
+// error.  msg is shown to the caller as it is, so must not hold internal detail.
+func errorResp(req *logical.Request, code, msg string, extra map[string]interface{}) *logical.Response {
+	respData := map[string]interface{}{
+		"error":      msg,
+		"error_code": code}
+	for field, value := range extra {
+		respData[field] = value
+	}
+	resp, err := logical.RespondWithStatusCode(&logical.Response{Data: respData}, req, errorStatus(code))
+	if err != nil {
+		return logical.ErrorResponse(msg)
+	}
+	return resp
+}
+
+// invalidRequestResp : The caller sent something the Guardian cannot use, msg says what.
+func invalidRequestResp(req *logical.Request, msg string) *logical.Response {
+	return errorResp(req, ErrCodeInvalidRequest, msg, nil)
+}
+
+// internalErrResp : A failure inside the Guardian or a service it relies on.  The caller gets
+// msg, and the request_id which ties it to err in the server log; err itself may hold
+// storage paths, Vault responses or configuration, so it is never sent back.
+func (b *backend) internalErrResp(req *logical.Request, code, msg string, err error) *logical.Response {
+	b.Logger().Error(msg, "request_id", req.ID, "error_code", code, "error", err)
+	return errorResp(req, code, msg, nil)
+}
+
+// configAndClientErrResp : For when configAndClient fails, a nil cfg meaning storage did.
+func (b *backend) configAndClientErrResp(req *logical.Request, cfg *Config, err error) *logical.Response {
+	if cfg == nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to read the Guardian's config", err)
+	}
+	return b.internalErrResp(req, ErrCodeNotConfigured, "The Guardian is not configured, a maintainer needs to run guardian/authorize", err)
+}
+
+// callerErrResp : For when callerForRequest cannot tell who is calling.
+func (b *backend) callerErrResp(req *logical.Request, err error) *logical.Response {
+	return b.internalErrResp(req, ErrCodeUpstreamFailed, "Unable to identify the caller from their token", err)
+}
+
+// keyErrResp : For when the key a request needs cannot be read.
+func (b *backend) keyErrResp(req *logical.Request, err error) *logical.Response {
+	if err == ErrNoKey {
+		return errorResp(req, ErrCodeUserNotFound, "No key is stored for this user, log in to create one", nil)
+	}
+	if err == ErrNoNamedKey {
+		return errorResp(req, ErrCodeNotFound, "No key by that key_name is stored for this user, create it at guardian/keys", nil)
+	}
+	return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to read the user's key", err)
+}
@@ -0,0 +1,107 @@
+package guardian
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// errorData : The body of an error response, whether a plain logical.ErrorResponse or one
+// sent with its own HTTP status.  nil for anything which is not an error.
+func errorData(resp *logical.Response) map[string]interface{} {
+	if resp == nil {
+		return nil
+	}
+	if resp.IsError() {
+		return resp.Data
+	}
+	var raw []byte
+	switch body := resp.Data[logical.HTTPRawBody].(type) {
+	case string:
+		raw = []byte(body)
+	case []byte:
+		raw = body
+	default:
+		return nil
+	}
+	var httpResp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &httpResp); err != nil || httpResp.Data["error_code"] == nil {
+		return nil
+	}
+	return httpResp.Data
+}
+
+func isError(resp *logical.Response) bool {
+	return errorData(resp) != nil
+}
+
+func errorCode(resp *logical.Response) string {
+	code, _ := errorData(resp)["error_code"].(string)
+	return code
+}
+
+func TestBackend_ErrorCodes(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+	cfg, _, _ := b.configAndClient(ctx, storage)
+
+	badHex := signRequest(storage)
+	badHex.Data["raw_data"] = "not hex"
+	shortHash := signRequest(storage)
+	shortHash.Data["raw_data"] = testHash[:62]
+	missingUser := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "admin/users/nobody",
+		Storage:   storage,
+		Data:      map[string]interface{}{"status": UserStatusDisabled}}
+	export := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "export",
+		Storage:   storage,
+		EntityID:  "entity-alice",
+		Data:      map[string]interface{}{"format": ExportFormatMnemonic}}
+	cfg.ExportDisabled = true
+
+	cases := []struct {
+		req    *logical.Request
+		code   string
+		status int
+	}{
+		{badHex, ErrCodeInvalidRequest, http.StatusBadRequest},
+		{shortHash, ErrCodeInvalidRequest, http.StatusBadRequest},
+		{missingUser, ErrCodeUserNotFound, http.StatusNotFound},
+		{export, ErrCodeExportDisabled, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		resp, err := b.HandleRequest(ctx, c.req)
+		if err != nil {
+			t.Fatalf("%s: expected the error in the response, got %v", c.req.Path, err)
+		}
+		if code := errorCode(resp); code != c.code {
+			t.Errorf("%s: expected %s, got %q from %#v", c.req.Path, c.code, code, resp)
+		}
+		if status := resp.Data[logical.HTTPStatusCode]; status != c.status {
+			t.Errorf("%s: expected status %d, got %v", c.req.Path, c.status, status)
+		}
+	}
+
+	// Whatever went wrong internally stays in the log
+	req := &logical.Request{ID: "req-1"}
+	resp := b.internalErrResp(req, ErrCodeStorageFailed, "Unable to read the user's key", errors.New("keys/alice: permission denied"))
+	body := fmt.Sprintf("%s", resp.Data[logical.HTTPRawBody])
+	if errorCode(resp) != ErrCodeStorageFailed || strings.Contains(body, "keys/alice") {
+		t.Fatalf("expected only the code and message to be returned, got %v", body)
+	}
+	if !strings.Contains(body, "req-1") {
+		t.Fatalf("expected the request_id to tie the response to the log, got %v", body)
+	}
+}
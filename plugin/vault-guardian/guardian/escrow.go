@@ -0,0 +1,297 @@
+package guardian
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/shamir"
+	"golang.org/x/crypto/openpgp"
+	// Keys without hash preferences fall back to RIPEMD-160 for the encrypted message
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+//-----------------------------------------
+//  Key Escrow
+//-----------------------------------------
+
+// EscrowMaintainer : A maintainer registered to hold escrow shares, by their PGP public key.
+type EscrowMaintainer struct {
+	Name        string `json:"name"`
+	PGPKey      string `json:"pgp_key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// escrowShare : One maintainer's share of a user's key, encrypted to their PGP key.  The
+// hash lets a submitted share be checked before it is combined with the others.
+type escrowShare struct {
+	Maintainer     string `json:"maintainer"`
+	Fingerprint    string `json:"fingerprint"`
+	EncryptedShare string `json:"encrypted_share"`
+	ShareHash      string `json:"share_hash"`
+}
+
+// escrowRecord : The shares of a user's current key.  The secret split is the UserKey's
+// JSON, so mnemonics and legacy privKeyHex keys escrow alike.
+type escrowRecord struct {
+	Address   string        `json:"address"`
+	Threshold int           `json:"threshold"`
+	Shares    []escrowShare `json:"shares"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// recoveryRecord : Decrypted shares submitted so far towards recovering a user's key, by
+// maintainer.  Kept under escrow/recoveries/, which is seal-wrapped.
+type recoveryRecord struct {
+	Shares map[string]string `json:"shares"`
+}
+
+func escrowMaintainerPath(name string) string {
+	return "escrow/maintainers/" + name
+}
+
+func escrowRecordPath(username string) string {
+	return "escrow/users/" + username
+}
+
+func recoveryRecordPath(username string) string {
+	return "escrow/recoveries/" + username
+}
+
+// parsePGPKey : Reads a public key given either ASCII-armored or as base64, the way Vault
+// takes pgp_keys.
+func parsePGPKey(pgpKey string) (*openpgp.Entity, error) {
+	var entities openpgp.EntityList
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(pgpKey), "-----BEGIN") {
+		entities, err = openpgp.ReadArmoredKeyRing(strings.NewReader(pgpKey))
+	} else {
+		var raw []byte
+		if raw, err = base64.StdEncoding.DecodeString(pgpKey); err != nil {
+			return nil, fmt.Errorf("pgp_key must be ASCII-armored or base64: %v", err)
+		}
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(raw))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) != 1 {
+		return nil, fmt.Errorf("pgp_key must hold exactly one key, found %d", len(entities))
+	}
+	return entities[0], nil
+}
+
+func pgpFingerprint(entity *openpgp.Entity) string {
+	return hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])
+}
+
+// encryptShare : Encrypts the base64 of share to entity, and returns the base64 of the
+// result.  Decrypting it gives the text a maintainer submits back for recovery.
+func encryptShare(entity *openpgp.Entity, share []byte) (string, error) {
+	var encrypted bytes.Buffer
+	w, err := openpgp.Encrypt(&encrypted, []*openpgp.Entity{entity}, nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write([]byte(base64.StdEncoding.EncodeToString(share))); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(encrypted.Bytes()), nil
+}
+
+func shareHash(share []byte) string {
+	hash := sha256.Sum256(share)
+	return hex.EncodeToString(hash[:])
+}
+
+// escrowMaintainers : Every registered maintainer, sorted by name.
+func (b *backend) escrowMaintainers(ctx context.Context, s logical.Storage) ([]*EscrowMaintainer, error) {
+	names, err := s.List(ctx, "escrow/maintainers/")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	maintainers := []*EscrowMaintainer{}
+	for _, name := range names {
+		maintainer, err := b.readEscrowMaintainer(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+		if maintainer != nil {
+			maintainers = append(maintainers, maintainer)
+		}
+	}
+	return maintainers, nil
+}
+
+func (b *backend) readEscrowMaintainer(ctx context.Context, s logical.Storage, name string) (*EscrowMaintainer, error) {
+	entry, err := s.Get(ctx, escrowMaintainerPath(name))
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var maintainer EscrowMaintainer
+	if err := entry.DecodeJSON(&maintainer); err != nil {
+		return nil, err
+	}
+	return &maintainer, nil
+}
+
+// escrowKey : When escrow_threshold is set, splits key among every registered maintainer
+// and saves the encrypted shares, replacing any from the user's previous key.  Called
+// before a new key is written, so no key exists without its escrow.
+func (b *backend) escrowKey(ctx context.Context, s logical.Storage, cfg *Config, username string, key *UserKey) error {
+	if cfg.EscrowThreshold == 0 {
+		return nil
+	}
+	maintainers, err := b.escrowMaintainers(ctx, s)
+	if err != nil {
+		return err
+	}
+	if len(maintainers) < cfg.EscrowThreshold {
+		return fmt.Errorf("escrow_threshold is %d but only %d maintainers are registered", cfg.EscrowThreshold, len(maintainers))
+	}
+	secret, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	shares, err := shamir.Split(secret, len(maintainers), cfg.EscrowThreshold)
+	if err != nil {
+		return err
+	}
+	record := &escrowRecord{
+		Address:   key.PublicAddressHex,
+		Threshold: cfg.EscrowThreshold,
+		CreatedAt: time.Now().UTC()}
+	for i, maintainer := range maintainers {
+		entity, err := parsePGPKey(maintainer.PGPKey)
+		if err != nil {
+			return fmt.Errorf("maintainer %s: %v", maintainer.Name, err)
+		}
+		encrypted, err := encryptShare(entity, shares[i])
+		if err != nil {
+			return fmt.Errorf("encrypting share for %s: %v", maintainer.Name, err)
+		}
+		record.Shares = append(record.Shares, escrowShare{
+			Maintainer:     maintainer.Name,
+			Fingerprint:    maintainer.Fingerprint,
+			EncryptedShare: encrypted,
+			ShareHash:      shareHash(shares[i])})
+	}
+	entry, err := logical.StorageEntryJSON(escrowRecordPath(username), record)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// restoreEscrowRecord : Puts back the record a key change replaced when the new key could not
+// be stored, or removes the new one if there was none before.  Keys are escrowed before they
+// are stored, so no stored key is ever without escrow, and this undoes that on failure.
+func (b *backend) restoreEscrowRecord(ctx context.Context, s logical.Storage, username string, previous *escrowRecord) {
+	var err error
+	if previous == nil {
+		err = s.Delete(ctx, escrowRecordPath(username))
+	} else {
+		var entry *logical.StorageEntry
+		if entry, err = logical.StorageEntryJSON(escrowRecordPath(username), previous); err == nil {
+			err = s.Put(ctx, entry)
+		}
+	}
+	if err != nil {
+		b.Logger().Error("unable to restore the escrow record after a failed key change", "username", username, "error", err)
+	}
+}
+
+func (b *backend) readEscrowRecord(ctx context.Context, s logical.Storage, username string) (*escrowRecord, error) {
+	entry, err := s.Get(ctx, escrowRecordPath(username))
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var record escrowRecord
+	if err := entry.DecodeJSON(&record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// submitRecoveryShare : Adds one maintainer's decrypted share towards recovering username's
+// key.  Once threshold shares are in, the key is rebuilt, checked against the escrowed
+// address and returned, and the submissions are cleared.  Until then the key is nil.
+func (b *backend) submitRecoveryShare(ctx context.Context, s logical.Storage, username, maintainer, encodedShare string) (submitted int, threshold int, key *UserKey, err error) {
+	b.escrowLock.Lock()
+	defer b.escrowLock.Unlock()
+	record, err := b.readEscrowRecord(ctx, s, username)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if record == nil {
+		return 0, 0, nil, ErrNoEscrow
+	}
+	share, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedShare))
+	if err != nil {
+		return 0, record.Threshold, nil, fmt.Errorf("share must be base64: %v", err)
+	}
+	var expected *escrowShare
+	for i := range record.Shares {
+		if record.Shares[i].Maintainer == maintainer {
+			expected = &record.Shares[i]
+		}
+	}
+	if expected == nil {
+		return 0, record.Threshold, nil, fmt.Errorf("%s holds no share of %s's key", maintainer, username)
+	}
+	if shareHash(share) != expected.ShareHash {
+		return 0, record.Threshold, nil, fmt.Errorf("share does not match the one escrowed for %s", maintainer)
+	}
+
+	recovery := &recoveryRecord{Shares: map[string]string{}}
+	entry, err := s.Get(ctx, recoveryRecordPath(username))
+	if err != nil {
+		return 0, record.Threshold, nil, err
+	}
+	if entry != nil {
+		if err := entry.DecodeJSON(recovery); err != nil {
+			return 0, record.Threshold, nil, err
+		}
+	}
+	recovery.Shares[maintainer] = base64.StdEncoding.EncodeToString(share)
+	if len(recovery.Shares) < record.Threshold {
+		entry, err := logical.StorageEntryJSON(recoveryRecordPath(username), recovery)
+		if err != nil {
+			return 0, record.Threshold, nil, err
+		}
+		return len(recovery.Shares), record.Threshold, nil, s.Put(ctx, entry)
+	}
+
+	parts := [][]byte{}
+	for _, encoded := range recovery.Shares {
+		part, _ := base64.StdEncoding.DecodeString(encoded)
+		parts = append(parts, part)
+	}
+	secret, err := shamir.Combine(parts)
+	if err != nil {
+		return len(parts), record.Threshold, nil, err
+	}
+	var recovered UserKey
+	if err := json.Unmarshal(secret, &recovered); err != nil {
+		return len(parts), record.Threshold, nil, fmt.Errorf("combined shares are not a key: %v", err)
+	}
+	if address, err := recovered.Address(0); err != nil || address != record.Address {
+		return len(parts), record.Threshold, nil, fmt.Errorf("combined shares do not rebuild the escrowed key for %s", record.Address)
+	}
+	if err := s.Delete(ctx, recoveryRecordPath(username)); err != nil {
+		return len(parts), record.Threshold, nil, err
+	}
+	return len(parts), record.Threshold, &recovered, nil
+}
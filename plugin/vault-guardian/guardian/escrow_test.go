@@ -0,0 +1,151 @@
+package guardian
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	"golang.org/x/crypto/openpgp"
+)
+
+// newMaintainerKey : A locally generated PGP key standing in for a maintainer's, along with
+// its public half as base64.
+func newMaintainerKey(t *testing.T, name string) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var public bytes.Buffer
+	if err := entity.Serialize(&public); err != nil {
+		t.Fatal(err)
+	}
+	return entity, base64.StdEncoding.EncodeToString(public.Bytes())
+}
+
+// decryptShare : What a maintainer does offline with their encrypted_share.
+func decryptShare(t *testing.T, entity *openpgp.Entity, encryptedShare string) string {
+	raw, err := base64.StdEncoding.DecodeString(encryptedShare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := openpgp.ReadMessage(bytes.NewReader(raw), openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := ioutil.ReadAll(message.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(share)
+}
+
+func recoverRequest(storage logical.Storage, maintainer, share string) *logical.Request {
+	return &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "admin/escrow/recover/bob",
+		Storage:   storage,
+		Data:      map[string]interface{}{"maintainer": maintainer, "share": share},
+	}
+}
+
+func TestBackend_EscrowRecovery(t *testing.T) {
+	b, storage, _, closeServer := newPushBackend(t, false)
+	defer closeServer()
+	ctx := context.Background()
+	cfg, client, _ := b.configAndClient(ctx, storage)
+	cfg.EscrowThreshold = 2
+
+	entities := map[string]*openpgp.Entity{}
+	for _, name := range []string{"ann", "ben"} {
+		entity, publicKey := newMaintainerKey(t, name)
+		entities[name] = entity
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "admin/escrow/maintainers/" + name,
+			Storage:   storage,
+			Data:      map[string]interface{}{"pgp_key": publicKey}})
+		if err != nil || isError(resp) || resp.Data["fingerprint"] == "" {
+			t.Fatalf("registering %s failed: %v %#v", name, err, resp)
+		}
+	}
+
+	// Two maintainers cannot hold a quorum of three
+	cfg.EscrowThreshold = 3
+	login := loginRequest(storage, map[string]interface{}{})
+	login.Data["okta_username"] = "bob"
+	if resp, _ := b.HandleRequest(ctx, login); resp == nil || !isError(resp) {
+		t.Fatalf("expected key creation to fail without enough maintainers, got %#v", resp)
+	}
+
+	entity, publicKey := newMaintainerKey(t, "cat")
+	entities["cat"] = entity
+	if _, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "admin/escrow/maintainers/cat",
+		Storage:   storage,
+		Data:      map[string]interface{}{"pgp_key": publicKey}}); err != nil {
+		t.Fatal(err)
+	}
+	cfg.EscrowThreshold = 2
+	resp, err := b.HandleRequest(ctx, login)
+	if err != nil || isError(resp) {
+		t.Fatalf("first login failed: %v %#v", err, resp)
+	}
+	address := resp.Data["address"]
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{Operation: logical.ReadOperation, Path: "admin/escrow/shares/bob", Storage: storage})
+	if err != nil || isError(resp) || resp.Data["address"] != address || resp.Data["threshold"] != 2 {
+		t.Fatalf("reading shares failed: %v %#v", err, resp)
+	}
+	shares := map[string]string{}
+	for _, share := range resp.Data["shares"].([]map[string]interface{}) {
+		maintainer := share["maintainer"].(string)
+		shares[maintainer] = decryptShare(t, entities[maintainer], share["encrypted_share"].(string))
+	}
+	if len(shares) != 3 {
+		t.Fatalf("expected a share for each maintainer, got %d", len(shares))
+	}
+
+	// Bob's key is lost, and logging in again must not replace it or its escrow
+	if err := client.keys.deleteKey(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := b.HandleRequest(ctx, login); errorCode(resp) != ErrCodeKeyInEscrow {
+		t.Fatalf("expected login without a key to point at the escrow, got %#v", resp)
+	}
+	if record, err := b.readEscrowRecord(ctx, storage, "bob"); err != nil || record == nil || record.Address != address {
+		t.Fatalf("expected bob's escrow to be left alone, got %v %#v", err, record)
+	}
+	if lost, err := client.keys.readKey(ctx, "bob"); err != nil || lost != nil {
+		t.Fatalf("expected no key to be made for bob, got %v %#v", err, lost)
+	}
+
+	resp, err = b.HandleRequest(ctx, recoverRequest(storage, "ann", shares["ann"]))
+	if err != nil || isError(resp) || resp.Data["recovered"] != false || resp.Data["submitted"] != 1 {
+		t.Fatalf("expected ann's share to be accepted and wait for another, got %v %#v", err, resp)
+	}
+	resp, _ = b.HandleRequest(ctx, recoverRequest(storage, "cat", shares["ben"]))
+	if resp == nil || !isError(resp) {
+		t.Fatalf("expected ben's share to be refused as cat's, got %#v", resp)
+	}
+	resp, err = b.HandleRequest(ctx, recoverRequest(storage, "cat", shares["cat"]))
+	if err != nil || isError(resp) || resp.Data["recovered"] != true || resp.Data["address"] != address {
+		t.Fatalf("expected the second share to recover bob's key, got %v %#v", err, resp)
+	}
+	restored, err := client.readKeyByUsername(ctx, "bob")
+	if err != nil || restored.PublicAddressHex != address {
+		t.Fatalf("expected bob's key to be restored, got %v %#v", err, restored)
+	}
+
+	// A rotation which fails part way leaves the escrow with the key bob still holds
+	if _, _, err := b.rotateKey(ctx, &failingStorage{Storage: storage, prefix: "key-history/"}, cfg, client, "bob", RotatedByMaintainer, ""); err == nil {
+		t.Fatal("expected the rotation to fail")
+	}
+	record, err := b.readEscrowRecord(ctx, storage, "bob")
+	if err != nil || record == nil || record.Address != address {
+		t.Fatalf("expected the escrow to still be for %s, got %v %#v", address, err, record)
+	}
+}
@@ -0,0 +1,225 @@
+package guardian
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	// EventModeExport : Mode of the history events recording key exports.
+	EventModeExport = "export"
+
+	// DefaultHistoryLimit : Events returned per page when no limit is given.
+	DefaultHistoryLimit = 50
+	// MaxHistoryLimit : Most events one history read may return.
+	MaxHistoryLimit = 500
+	// HistoryPruneInterval : How often the PeriodicFunc applies history_retention.
+	HistoryPruneInterval = time.Hour
+)
+
+//-----------------------------------------
+//  Sign History
+//-----------------------------------------
+
+// SignEvent : One signature the plugin produced, or one key export.  Destination, value and
+// chain are only known for the structured modes, format only for exports, and key_name only
+// for named keys.
+type SignEvent struct {
+	Timestamp    time.Time `json:"timestamp"`
+	RequestID    string    `json:"request_id"`
+	EntityID     string    `json:"entity_id"`
+	Username     string    `json:"username"`
+	Mode         string    `json:"mode"`
+	Digest       string    `json:"digest"`
+	AddressIndex int       `json:"address_index"`
+	KeyName      string    `json:"key_name,omitempty"`
+	ChainID      string    `json:"chain_id,omitempty"`
+	Destination  string    `json:"destination,omitempty"`
+	Value        string    `json:"value,omitempty"`
+	Format       string    `json:"format,omitempty"`
+}
+
+// historyKey : Events are keyed by zero-padded nanoseconds, so a listing is in time order
+// and a time range is a range of keys.
+func historyKey(at time.Time) string {
+	return fmt.Sprintf("%020d", at.UnixNano())
+}
+
+func historyPrefix(username string) string {
+	return "history/" + username + "/"
+}
+
+// newSignEvent : The event for a signature over digest, filling in what intent knows.
+func newSignEvent(req *logical.Request, username, keyName string, addressIndex int, digest []byte, intent signIntent) *SignEvent {
+	event := &SignEvent{
+		Timestamp:    time.Now().UTC(),
+		RequestID:    req.ID,
+		EntityID:     req.EntityID,
+		Username:     username,
+		Mode:         intent.Mode,
+		Digest:       fmt.Sprintf("0x%x", digest),
+		AddressIndex: addressIndex}
+	if !isDefaultKey(keyName) {
+		event.KeyName = keyName
+	}
+	if intent.ChainID != nil {
+		event.ChainID = intent.ChainID.String()
+	}
+	if intent.Destination != nil {
+		event.Destination = intent.Destination.Hex()
+	}
+	if intent.Value != nil {
+		event.Value = intent.Value.String()
+	}
+	return event
+}
+
+// newExportEvent : The event for username exporting their key in format.
+func newExportEvent(req *logical.Request, username string, addressIndex int, format string) *SignEvent {
+	return &SignEvent{
+		Timestamp:    time.Now().UTC(),
+		RequestID:    req.ID,
+		EntityID:     req.EntityID,
+		Username:     username,
+		Mode:         EventModeExport,
+		AddressIndex: addressIndex,
+		Format:       format}
+}
+
+// recordSignEvent : Saves event under its user.  The request ID keeps two signatures in
+// the same nanosecond apart.
+func (b *backend) recordSignEvent(ctx context.Context, s logical.Storage, event *SignEvent) error {
+	key := historyPrefix(event.Username) + historyKey(event.Timestamp) + "-" + event.RequestID
+	entry, err := logical.StorageEntryJSON(key, event)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// historyQuery : Filters for a history read.  After is the key a previous page ended on.
+type historyQuery struct {
+	Since time.Time
+	Until time.Time
+	After string
+	Limit int
+}
+
+// readHistory : username's events matching query, oldest first, along with the key to pass
+// as after for the next page, which is empty on the last one.
+func (b *backend) readHistory(ctx context.Context, s logical.Storage, username string, query historyQuery) ([]*SignEvent, string, error) {
+	keys, err := s.List(ctx, historyPrefix(username))
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(keys)
+	events := []*SignEvent{}
+	for i, key := range keys {
+		if query.After != "" && key <= query.After {
+			continue
+		}
+		if !query.Since.IsZero() && key < historyKey(query.Since) {
+			continue
+		}
+		if !query.Until.IsZero() && key >= historyKey(query.Until) {
+			break
+		}
+		if len(events) == query.Limit {
+			return events, keys[i-1], nil
+		}
+		entry, err := s.Get(ctx, historyPrefix(username)+key)
+		if err != nil {
+			return nil, "", err
+		}
+		if entry == nil {
+			continue
+		}
+		var event SignEvent
+		if err := entry.DecodeJSON(&event); err != nil {
+			return nil, "", err
+		}
+		events = append(events, &event)
+	}
+	return events, "", nil
+}
+
+// pruneHistory : Deletes events older than retention, at most once per HistoryPruneInterval.
+func (b *backend) pruneHistory(ctx context.Context, s logical.Storage) error {
+	cfg, err := b.Config(ctx, s)
+	if err != nil {
+		return err
+	}
+	retention := cfg.HistoryRetentionPeriod()
+	if retention == 0 {
+		return nil
+	}
+	b.historyLock.Lock()
+	if time.Since(b.lastHistoryPrune) < HistoryPruneInterval {
+		b.historyLock.Unlock()
+		return nil
+	}
+	b.lastHistoryPrune = time.Now()
+	b.historyLock.Unlock()
+
+	cutoff := historyKey(time.Now().Add(-retention))
+	users, err := s.List(ctx, "history/")
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		username := strings.TrimSuffix(user, "/")
+		keys, err := s.List(ctx, historyPrefix(username))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if key >= cutoff {
+				continue
+			}
+			if err := s.Delete(ctx, historyPrefix(username)+key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseHistoryTime : RFC 3339, or seconds since the epoch.
+func parseHistoryTime(field string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be RFC 3339 or seconds since the epoch", field)
+	}
+	return parsed, nil
+}
+
+// historyQueryFromData : Reads and checks the since, until, after and limit fields.
+func historyQueryFromData(since, until, after string, limit int) (historyQuery, error) {
+	query := historyQuery{After: after, Limit: limit}
+	var err error
+	if query.Since, err = parseHistoryTime("since", since); err != nil {
+		return query, err
+	}
+	if query.Until, err = parseHistoryTime("until", until); err != nil {
+		return query, err
+	}
+	if query.Limit <= 0 {
+		query.Limit = DefaultHistoryLimit
+	}
+	if query.Limit > MaxHistoryLimit {
+		return query, fmt.Errorf("limit cannot exceed %d", MaxHistoryLimit)
+	}
+	return query, nil
+}
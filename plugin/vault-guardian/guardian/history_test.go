@@ -0,0 +1,123 @@
+package guardian
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func historyRequest(storage logical.Storage, path string, data map[string]interface{}) *logical.Request {
+	return &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      path,
+		Storage:   storage,
+		EntityID:  "entity-alice",
+		Data:      data,
+	}
+}
+
+func TestBackend_SignHistory(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+
+	raw := signRequest(storage)
+	raw.ID = "request-raw"
+	if resp, err := b.HandleRequest(ctx, raw); err != nil || isError(resp) {
+		t.Fatalf("sign failed: %v %#v", err, resp)
+	}
+	tx := transactionRequest(storage, eip155TxRecipient, "600")
+	tx.ID = "request-tx"
+	if resp, err := b.HandleRequest(ctx, tx); err != nil || isError(resp) {
+		t.Fatalf("sign/transaction failed: %v %#v", err, resp)
+	}
+
+	resp, err := b.HandleRequest(ctx, historyRequest(storage, "history", nil))
+	if err != nil || isError(resp) {
+		t.Fatalf("history read failed: %v %#v", err, resp)
+	}
+	events := resp.Data["events"].([]*SignEvent)
+	if len(events) != 2 || resp.Data["next"] != nil {
+		t.Fatalf("expected both events on one page, got %#v", resp.Data)
+	}
+	if events[0].Mode != SignModeRaw || events[0].RequestID != "request-raw" || events[0].Digest != "0x"+testHash {
+		t.Errorf("unexpected raw event %#v", events[0])
+	}
+	if events[1].Mode != SignModeTransaction || events[1].Value != "600" || events[1].ChainID != "1" ||
+		events[1].Destination != eip155TxRecipient || events[1].EntityID != "entity-alice" {
+		t.Errorf("unexpected transaction event %#v", events[1])
+	}
+
+	// Paging through the same events one at a time
+	resp, err = b.HandleRequest(ctx, historyRequest(storage, "admin/history/alice", map[string]interface{}{"limit": 1}))
+	if err != nil || isError(resp) {
+		t.Fatalf("admin history read failed: %v %#v", err, resp)
+	}
+	first := resp.Data["events"].([]*SignEvent)
+	if len(first) != 1 || first[0].RequestID != "request-raw" || resp.Data["next"] == nil {
+		t.Fatalf("expected the first page to hold the raw event, got %#v", resp.Data)
+	}
+	resp, _ = b.HandleRequest(ctx, historyRequest(storage, "admin/history/alice", map[string]interface{}{"limit": 1, "after": resp.Data["next"]}))
+	second := resp.Data["events"].([]*SignEvent)
+	if len(second) != 1 || second[0].RequestID != "request-tx" || resp.Data["next"] != nil {
+		t.Fatalf("expected the last page to hold the transaction event, got %#v", resp.Data)
+	}
+
+	// Time ranges
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	resp, _ = b.HandleRequest(ctx, historyRequest(storage, "admin/history/alice", map[string]interface{}{"since": future}))
+	if len(resp.Data["events"].([]*SignEvent)) != 0 {
+		t.Fatalf("expected no events after %s, got %#v", future, resp.Data)
+	}
+	resp, _ = b.HandleRequest(ctx, historyRequest(storage, "admin/history/alice", map[string]interface{}{"until": future}))
+	if len(resp.Data["events"].([]*SignEvent)) != 2 {
+		t.Fatalf("expected both events before %s, got %#v", future, resp.Data)
+	}
+	resp, _ = b.HandleRequest(ctx, historyRequest(storage, "history", map[string]interface{}{"since": "yesterday"}))
+	if resp == nil || !isError(resp) {
+		t.Fatalf("expected an unparseable since to be refused, got %#v", resp)
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+
+	for i, at := range []time.Time{time.Now().Add(-48 * time.Hour), time.Now()} {
+		event := &SignEvent{Timestamp: at, Username: "alice", Mode: SignModeRaw, RequestID: string(rune('a' + i))}
+		if err := b.recordSignEvent(ctx, storage, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// No retention configured keeps everything
+	if err := b.pruneHistory(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := storage.List(ctx, historyPrefix("alice")); len(keys) != 2 {
+		t.Fatalf("expected history to be kept without a retention, got %v", keys)
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "authorize",
+		Storage:   storage,
+		Data:      map[string]interface{}{"history_retention": "24h"},
+	})
+	if err != nil || isError(resp) {
+		t.Fatalf("authorize failed: %v %#v", err, resp)
+	}
+	if err := b.pruneHistory(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	events, _, err := b.readHistory(ctx, storage, "alice", historyQuery{Limit: DefaultHistoryLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].RequestID != "b" {
+		t.Fatalf("expected only the recent event to survive, got %#v", events)
+	}
+}
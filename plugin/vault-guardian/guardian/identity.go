@@ -0,0 +1,359 @@
+package guardian
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/hashicorp/vault/api"
+	"github.com/okta/okta-sdk-golang/okta"
+)
+
+//-----------------------------------------
+//  Identity Providers
+//-----------------------------------------
+
+const (
+	// ProviderOkta : Users log in with Okta credentials, checked through Vault's auth/okta.
+	ProviderOkta = "okta"
+	// ProviderOIDC : Users log in with an ID token from an OpenID Connect issuer, e.g. Google.
+	ProviderOIDC = "oidc"
+	// DefaultOIDCIssuer : Issuer used when provider=oidc is configured without an oidc_issuer.
+	DefaultOIDCIssuer = "https://accounts.google.com"
+)
+
+// Credentials : Everything a user may present to guardian/login, providers use what they need.
+type Credentials struct {
+	Username string
+	Password string
+	IDToken  string
+	Passcode string
+	Factor   string
+}
+
+// IdentityProvider : Decides who a user is at login and whether they belong to the
+// organization, so the Guardian can run against Okta or a generic OIDC issuer.
+type IdentityProvider interface {
+	// Name : The provider value this implementation is selected by at authorize time.
+	Name() string
+	// Authenticate : Checks the credentials and returns the canonical username they prove.
+	Authenticate(ctx context.Context, creds Credentials) (username string, err error)
+	// UserExists : Whether username belongs to the organization, checked before creating a key.
+	UserExists(ctx context.Context, username string) (exists bool, err error)
+	// Register : Performs any provider-side setup for a brand new Guardian user.
+	Register(ctx context.Context, username string) error
+	// Unregister : Undoes Register when a maintainer deletes the user.
+	Unregister(ctx context.Context, username string) error
+}
+
+// GroupProvider : Implemented by identity providers which know what groups a user is in, so
+// signing policies can be attached to a group rather than each user.
+type GroupProvider interface {
+	Groups(ctx context.Context, username string) ([]string, error)
+}
+
+// NewIdentityProvider : Builds the IdentityProvider selected by cfg.Provider.
+func NewIdentityProvider(cfg *Config, vault *api.Client) (IdentityProvider, error) {
+	switch cfg.ProviderName() {
+	case ProviderOkta:
+		oktaConfig := okta.NewConfig().WithOrgUrl(fmt.Sprintf("https://%s.okta.com", cfg.OktaURL)).WithToken(cfg.OktaToken)
+		return &oktaProvider{
+			vault: vault,
+			okta:  okta.NewClient(oktaConfig, nil, nil)}, nil
+	case ProviderOIDC:
+		return &oidcProvider{
+			issuer:         cfg.OIDCIssuer,
+			clientID:       cfg.OIDCClientID,
+			allowedDomains: cfg.OIDCAllowedDomains}, nil
+	default:
+		return nil, fmt.Errorf("unknown identity provider %q", cfg.Provider)
+	}
+}
+
+//-----------------------------------------
+//  Okta
+//-----------------------------------------
+
+const (
+	oktaFactorActive   = "ACTIVE"
+	oktaResultWaiting  = "WAITING"
+	oktaResultSuccess  = "SUCCESS"
+	oktaResultRejected = "REJECTED"
+	oktaResultTimeout  = "TIMEOUT"
+
+	oktaPushPollInterval = time.Second
+)
+
+// oktaFactorTypes : The Okta factorType enrolled for each factor a login may name.
+var oktaFactorTypes = map[string]string{
+	MFAFactorPush: "push",
+	MFAFactorTOTP: "token:software:totp"}
+
+// oktaFactor : The parts of an Okta factor enrollment challengeFactor looks at.
+type oktaFactor struct {
+	ID         string `json:"id"`
+	FactorType string `json:"factorType"`
+	Status     string `json:"status"`
+}
+
+// oktaVerification : Okta's answer to a factor challenge, with where to poll a push from.
+type oktaVerification struct {
+	FactorResult string `json:"factorResult"`
+	Links        struct {
+		Poll struct {
+			Href string `json:"href"`
+		} `json:"poll"`
+	} `json:"_links"`
+}
+
+type oktaProvider struct {
+	vault *api.Client
+	okta  *okta.Client
+}
+
+func (p *oktaProvider) Name() string {
+	return ProviderOkta
+}
+
+// Authenticate : Logs in through auth/okta to check the password, then immediately revokes
+// the resulting token; the Guardian hands out its own single-use tokens instead.  auth/okta
+// bypasses Okta's MFA, which passes logins through whenever the sign-on policy lets them, so
+// any factor the login names is challenged here with challengeFactor.
+func (p *oktaProvider) Authenticate(ctx context.Context, creds Credentials) (username string, err error) {
+	if creds.Username == "" || creds.Password == "" {
+		return "", fmt.Errorf("okta_username and okta_password are required")
+	}
+	loginData := map[string]interface{}{"password": creds.Password}
+	loginResp, err := p.vault.Logical().Write(fmt.Sprintf("/auth/okta/login/%s", creds.Username), loginData)
+	if err != nil {
+		return "", err
+	}
+	if loginResp == nil || loginResp.Auth == nil {
+		return "", fmt.Errorf("no auth info returned")
+	}
+	if err := p.vault.Auth().Token().RevokeAccessor(loginResp.Auth.Accessor); err != nil {
+		return "", fmt.Errorf("unable to revoke Okta login token: %v", err)
+	}
+	if factor := mfaFactor(creds); factor != "" {
+		if err := p.challengeFactor(ctx, creds.Username, factor, creds.Passcode); err != nil {
+			return "", err
+		}
+	}
+	return creds.Username, nil
+}
+
+// challengeFactor : Verifies username's active Okta factor of the given kind, ErrMFANotEnrolled
+// if they have none.  A passcode is checked straight away, while a push is polled until Okta
+// reports its factorResult or ctx ends.
+func (p *oktaProvider) challengeFactor(ctx context.Context, username, factor, passcode string) error {
+	user, _, err := p.okta.User.GetUser(username, nil)
+	if err != nil {
+		return err
+	}
+	rq := p.okta.GetRequestExecutor()
+	listReq, err := rq.NewRequest("GET", fmt.Sprintf("/api/v1/users/%s/factors", user.Id), nil)
+	if err != nil {
+		return err
+	}
+	var factors []oktaFactor
+	if _, err := rq.Do(listReq, &factors); err != nil {
+		return fmt.Errorf("unable to list Okta factors: %v", err)
+	}
+	var enrolled *oktaFactor
+	for i := range factors {
+		if factors[i].FactorType == oktaFactorTypes[factor] && factors[i].Status == oktaFactorActive {
+			enrolled = &factors[i]
+			break
+		}
+	}
+	if enrolled == nil {
+		return ErrMFANotEnrolled
+	}
+
+	body := map[string]interface{}{}
+	if factor == MFAFactorTOTP {
+		body["passCode"] = passcode
+	}
+	verifyReq, err := rq.NewRequest("POST", fmt.Sprintf("/api/v1/users/%s/factors/%s/verify", user.Id, enrolled.ID), body)
+	if err != nil {
+		return err
+	}
+	var verification oktaVerification
+	if _, err := rq.Do(verifyReq, &verification); err != nil {
+		return fmt.Errorf("Okta did not accept the %s factor: %v", factor, err)
+	}
+	for verification.FactorResult == oktaResultWaiting {
+		pollURL, err := url.Parse(verification.Links.Poll.Href)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ErrMFATimedOut
+		case <-time.After(oktaPushPollInterval):
+		}
+		pollReq, err := rq.NewRequest("GET", pollURL.Path, nil)
+		if err != nil {
+			return err
+		}
+		verification = oktaVerification{}
+		if _, err := rq.Do(pollReq, &verification); err != nil {
+			return fmt.Errorf("unable to poll the Okta Verify push: %v", err)
+		}
+	}
+	switch verification.FactorResult {
+	case oktaResultSuccess:
+		return nil
+	case oktaResultRejected:
+		return ErrMFARejected
+	case oktaResultTimeout:
+		return ErrMFATimedOut
+	default:
+		return fmt.Errorf("Okta did not verify the %s factor, its result was %q", factor, verification.FactorResult)
+	}
+}
+
+func (p *oktaProvider) UserExists(ctx context.Context, username string) (exists bool, err error) {
+	// Determine what the response looks like for non-existent users
+	user, _, err := p.okta.User.GetUser(username, nil)
+	if err != nil {
+		return false, err
+	}
+	return user != nil, nil
+}
+
+// Groups : Names of the Okta groups username belongs to.
+func (p *oktaProvider) Groups(ctx context.Context, username string) ([]string, error) {
+	oktaGroups, _, err := p.okta.User.ListUserGroups(username, nil)
+	if err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for _, group := range oktaGroups {
+		if group != nil && group.Profile != nil {
+			groups = append(groups, group.Profile.Name)
+		}
+	}
+	return groups, nil
+}
+
+// Register : Registers the user with auth/okta so they belong to the enduser group.
+func (p *oktaProvider) Register(ctx context.Context, username string) error {
+	createData := map[string]interface{}{
+		"groups": []string{"vault-guardian-endusers"}}
+	_, err := p.vault.Logical().Write(fmt.Sprintf("/auth/okta/users/%s", username), createData)
+	return err
+}
+
+// Unregister : Removes the user from auth/okta, the Okta account itself is left alone.
+func (p *oktaProvider) Unregister(ctx context.Context, username string) error {
+	_, err := p.vault.Logical().Delete(fmt.Sprintf("/auth/okta/users/%s", username))
+	return err
+}
+
+//-----------------------------------------
+//  OpenID Connect
+//-----------------------------------------
+
+type oidcProvider struct {
+	issuer         string
+	clientID       string
+	allowedDomains []string
+
+	// verifier : Built from the issuer's discovery document on first use, and kept for as
+	// long as this provider, which lives as long as the Client and so the config.
+	mu       sync.Mutex
+	verifier *oidc.IDTokenVerifier
+}
+
+// oidcClaims : The ID token claims the Guardian cares about.
+type oidcClaims struct {
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+}
+
+func (p *oidcProvider) Name() string {
+	return ProviderOIDC
+}
+
+// idTokenVerifier : The verifier for the issuer, running discovery the first time it is asked
+// for.  A failed discovery is not kept, so the next login tries again.
+func (p *oidcProvider) idTokenVerifier() (*oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.verifier != nil {
+		return p.verifier, nil
+	}
+	// The provider fetches signing keys with this context long after the login which built
+	// it, so it cannot be that request's
+	provider, err := oidc.NewProvider(context.Background(), p.issuer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load OIDC discovery document: %v", err)
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.clientID})
+	return p.verifier, nil
+}
+
+// Authenticate : Verifies the ID token's signature, issuer, audience and expiry against the
+// issuer's discovery document, and returns its email as the username.  The issuer has to
+// vouch for the email with email_verified, since it becomes the Guardian username.
+func (p *oidcProvider) Authenticate(ctx context.Context, creds Credentials) (username string, err error) {
+	if creds.IDToken == "" {
+		return "", fmt.Errorf("id_token is required")
+	}
+	verifier, err := p.idTokenVerifier()
+	if err != nil {
+		return "", err
+	}
+	idToken, err := verifier.Verify(ctx, creds.IDToken)
+	if err != nil {
+		return "", err
+	}
+	var claims oidcClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return "", err
+	}
+	if claims.Email == "" {
+		return "", fmt.Errorf("id_token has no email claim")
+	}
+	if claims.EmailVerified == nil || !*claims.EmailVerified {
+		return "", fmt.Errorf("id_token email is not verified")
+	}
+	if !p.domainAllowed(claims.Email) {
+		return "", fmt.Errorf("%s is not in an allowed domain", claims.Email)
+	}
+	return claims.Email, nil
+}
+
+// UserExists : OIDC issuers have no directory to query, so membership is the domain allowlist.
+func (p *oidcProvider) UserExists(ctx context.Context, username string) (exists bool, err error) {
+	return p.domainAllowed(username), nil
+}
+
+func (p *oidcProvider) Register(ctx context.Context, username string) error {
+	return nil
+}
+
+func (p *oidcProvider) Unregister(ctx context.Context, username string) error {
+	return nil
+}
+
+// domainAllowed : Whether email is in one of the allowed domains.  Configs saved before
+// oidc_allowed_domains was required may have none, and then nobody is allowed.
+func (p *oidcProvider) domainAllowed(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range p.allowedDomains {
+		if strings.ToLower(allowed) == domain {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package guardian
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const testOIDCClientID = "guardian-test-client"
+
+// fakeOIDCIssuer : Local OpenID Connect issuer serving discovery and JWKS, and minting ID tokens.
+type fakeOIDCIssuer struct {
+	server      *httptest.Server
+	key         *rsa.PrivateKey
+	signer      jose.Signer
+	discoveries int32
+}
+
+func newFakeOIDCIssuer(t *testing.T) *fakeOIDCIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &fakeOIDCIssuer{key: key, signer: signer}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&issuer.discoveries, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                issuer.server.URL,
+			"authorization_endpoint":                issuer.server.URL + "/auth",
+			"token_endpoint":                        issuer.server.URL + "/token",
+			"jwks_uri":                              issuer.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &key.PublicKey,
+			KeyID:     "test-key",
+			Algorithm: "RS256",
+			Use:       "sig",
+		}}})
+	})
+	issuer.server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (f *fakeOIDCIssuer) idToken(t *testing.T, audience string, expiry time.Time, extra map[string]interface{}) string {
+	claims := jwt.Claims{
+		Issuer:   f.server.URL,
+		Subject:  "1234567890",
+		Audience: jwt.Audience{audience},
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+		Expiry:   jwt.NewNumericDate(expiry),
+	}
+	raw, err := jwt.Signed(f.signer).Claims(claims).Claims(extra).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestOIDCProvider_Authenticate(t *testing.T) {
+	issuer := newFakeOIDCIssuer(t)
+	defer issuer.server.Close()
+
+	cfg := &Config{
+		Provider:           ProviderOIDC,
+		OIDCIssuer:         issuer.server.URL,
+		OIDCClientID:       testOIDCClientID,
+		OIDCAllowedDomains: []string{"eximchain.com"}}
+	provider, err := NewIdentityProvider(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.Name() != ProviderOIDC {
+		t.Fatalf("expected oidc provider, got %s", provider.Name())
+	}
+
+	inAnHour := time.Now().Add(time.Hour)
+	verified := map[string]interface{}{"email": "alice@eximchain.com", "email_verified": true}
+	ctx := context.Background()
+
+	username, err := provider.Authenticate(ctx, Credentials{IDToken: issuer.idToken(t, testOIDCClientID, inAnHour, verified)})
+	if err != nil {
+		t.Fatalf("expected valid token to authenticate: %v", err)
+	}
+	if username != "alice@eximchain.com" {
+		t.Fatalf("expected username alice@eximchain.com, got %s", username)
+	}
+
+	failures := map[string]string{
+		"missing token":     "",
+		"wrong audience":    issuer.idToken(t, "someone-else", inAnHour, verified),
+		"expired":           issuer.idToken(t, testOIDCClientID, time.Now().Add(-time.Hour), verified),
+		"unverified email":  issuer.idToken(t, testOIDCClientID, inAnHour, map[string]interface{}{"email": "bob@eximchain.com", "email_verified": false}),
+		"foreign domain":    issuer.idToken(t, testOIDCClientID, inAnHour, map[string]interface{}{"email": "eve@example.com", "email_verified": true}),
+		"no email":          issuer.idToken(t, testOIDCClientID, inAnHour, map[string]interface{}{}),
+		"no email_verified": issuer.idToken(t, testOIDCClientID, inAnHour, map[string]interface{}{"email": "carol@eximchain.com"}),
+	}
+	for name, idToken := range failures {
+		if _, err := provider.Authenticate(ctx, Credentials{IDToken: idToken}); err == nil {
+			t.Errorf("%s: expected authentication to fail", name)
+		}
+	}
+	if discoveries := atomic.LoadInt32(&issuer.discoveries); discoveries != 1 {
+		t.Fatalf("expected discovery to run once for every login, ran %d times", discoveries)
+	}
+}
+
+func TestOIDCProvider_UserExists(t *testing.T) {
+	provider, err := NewIdentityProvider(&Config{
+		Provider:           ProviderOIDC,
+		OIDCClientID:       testOIDCClientID,
+		OIDCAllowedDomains: []string{"Eximchain.com"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if exists, _ := provider.UserExists(ctx, "alice@eximchain.com"); !exists {
+		t.Error("expected allowed domain to exist, ignoring case")
+	}
+	if exists, _ := provider.UserExists(ctx, "eve@example.com"); exists {
+		t.Error("expected foreign domain to be rejected")
+	}
+}
+
+func TestBackend_AuthorizeRequiresOIDCDomains(t *testing.T) {
+	b, storage := newTestBackend(t, &Config{
+		GuardianToken: "guardian-token",
+		Provider:      ProviderOIDC,
+		OIDCClientID:  testOIDCClientID})
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "authorize",
+		Storage:   storage,
+		Data:      map[string]interface{}{"max_token_refreshes": 3}})
+	if err != nil || errorCode(resp) != ErrCodeInvalidRequest {
+		t.Fatalf("expected authorize without oidc_allowed_domains to be refused, got %v %#v", err, resp)
+	}
+
+	// Configs saved before the domains were required let nobody in
+	provider, err := NewIdentityProvider(&Config{Provider: ProviderOIDC, OIDCClientID: testOIDCClientID}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := provider.UserExists(context.Background(), "alice@eximchain.com"); exists {
+		t.Fatal("expected a provider without allowed domains to refuse everyone")
+	}
+}
+
+func TestNewIdentityProvider_Unknown(t *testing.T) {
+	if _, err := NewIdentityProvider(&Config{Provider: "ldap"}, nil); err == nil {
+		t.Fatal("expected unknown provider to fail")
+	}
+}
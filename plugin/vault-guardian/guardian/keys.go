@@ -0,0 +1,339 @@
+package guardian
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	// KeyStorageKV : User keys live in the external KV mount at /keys/<username>.
+	KeyStorageKV = "kv"
+	// KeyStoragePlugin : User keys live in the plugin's seal-wrapped storage at users/<username>/key.
+	KeyStoragePlugin = "plugin"
+)
+
+//-----------------------------------------
+//  User Keys
+//-----------------------------------------
+
+// UserKey : Key material stored for each user in the configured keyStore.  New users get an HD
+// seed (stored as its mnemonic), and address_index selects the child at HDPathPrefix/index.
+// Users created before HD keys only hold privKeyHex; they are flagged as legacy and that
+// key keeps serving address_index 0.
+type UserKey struct {
+	Mnemonic         string `json:"mnemonic,omitempty"`
+	HDPath           string `json:"hdPath,omitempty"`
+	PrivKeyHex       string `json:"privKeyHex,omitempty"`
+	PublicAddressHex string `json:"publicAddressHex"`
+}
+
+// NewUserKey : Generates a fresh HD key for a new user.
+func NewUserKey() (*UserKey, error) {
+	mnemonic, publicAddressHex, err := CreateHDKey()
+	if err != nil {
+		return nil, err
+	}
+	return &UserKey{
+		Mnemonic:         mnemonic,
+		HDPath:           HDPathPrefix,
+		PublicAddressHex: publicAddressHex}, nil
+}
+
+// IsLegacy : True for single-key accounts which predate HD keys.
+func (key *UserKey) IsLegacy() bool {
+	return key.Mnemonic == ""
+}
+
+// HexKey : Returns the hex private key for the given address_index.
+func (key *UserKey) HexKey(index int) (privKeyHex string, err error) {
+	if key.IsLegacy() {
+		if key.PrivKeyHex == "" {
+			return "", fmt.Errorf("stored key has neither a mnemonic nor a privKeyHex")
+		}
+		if index != 0 {
+			return "", fmt.Errorf("legacy single-key account only supports address_index 0")
+		}
+		return key.PrivKeyHex, nil
+	}
+	return DeriveHexKey(key.Mnemonic, index)
+}
+
+// Address : Returns the checksummed address for the given address_index.
+func (key *UserKey) Address(index int) (pubAddressHex string, err error) {
+	privKeyHex, err := key.HexKey(index)
+	if err != nil {
+		return "", err
+	}
+	return AddressFromHexKey(privKeyHex)
+}
+
+// PublicKey : Returns the uncompressed public key for the given address_index, as 0x hex.
+func (key *UserKey) PublicKey(index int) (publicKeyHex string, err error) {
+	privKeyHex, err := key.HexKey(index)
+	if err != nil {
+		return "", err
+	}
+	return PublicKeyFromHexKey(privKeyHex)
+}
+
+func userKeyFromData(data map[string]interface{}) (*UserKey, error) {
+	if data == nil {
+		return nil, fmt.Errorf("no key data found")
+	}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var key UserKey
+	if err := json.Unmarshal(jsonData, &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (key *UserKey) data() (map[string]interface{}, error) {
+	jsonData, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//-----------------------------------------
+//  Key Stores
+//-----------------------------------------
+
+// keyStore : Where the Client keeps user keys, chosen by Config.KeyStorage.
+type keyStore interface {
+	// readKey : Returns nil without an error when username has no key.
+	readKey(ctx context.Context, username string) (*UserKey, error)
+	writeKey(ctx context.Context, username string, key *UserKey) error
+	deleteKey(ctx context.Context, username string) error
+	// listUsernames : Every user with a current key, leaving out retired ones.
+	listUsernames(ctx context.Context) ([]string, error)
+}
+
+// kvKeyStore : Keys in the KV mount at /keys, reached over the API with the guardian token.
+type kvKeyStore struct {
+	vault *api.Client
+}
+
+func (ks *kvKeyStore) readKey(ctx context.Context, username string) (*UserKey, error) {
+	resp, err := ks.vault.Logical().Read(fmt.Sprintf("/keys/%s", username))
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, nil
+	}
+	return userKeyFromData(resp.Data)
+}
+
+func (ks *kvKeyStore) writeKey(ctx context.Context, username string, key *UserKey) error {
+	secretData, err := key.data()
+	if err != nil {
+		return err
+	}
+	_, err = ks.vault.Logical().Write(fmt.Sprintf("/keys/%s", username), secretData)
+	return err
+}
+
+func (ks *kvKeyStore) deleteKey(ctx context.Context, username string) error {
+	_, err := ks.vault.Logical().Delete(fmt.Sprintf("/keys/%s", username))
+	return err
+}
+
+// listUsernames : Every username with a key in the KV mount, also used to migrate into plugin storage.
+func (ks *kvKeyStore) listUsernames(ctx context.Context) ([]string, error) {
+	resp, err := ks.vault.Logical().List("/keys")
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.Data == nil {
+		return nil, nil
+	}
+	rawKeys, _ := resp.Data["keys"].([]interface{})
+	usernames := make([]string, 0, len(rawKeys))
+	for _, rawKey := range rawKeys {
+		// Folders hold retired keys, which migrate along with their user
+		if username, ok := rawKey.(string); ok && !strings.HasSuffix(username, "/") {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames, nil
+}
+
+// createKey : The check-and-set write for a new user's key, storing key only if username has
+// none, and returning whichever key is stored afterwards.  Neither KV v1 nor plugin storage
+// can do this atomically, so callers hold the user's lock; writes are only made on the
+// active node, so that covers every login.
+func createKey(ctx context.Context, ks keyStore, username string, key *UserKey) (*UserKey, error) {
+	existing, err := ks.readKey(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
+	if err := ks.writeKey(ctx, username, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// pluginKeyStore : Keys in the backend's own storage.  users/ is listed in SealWrapStorage,
+// and no token can read it through the API, so raw key material never leaves the plugin.
+type pluginKeyStore struct {
+	storage logical.Storage
+}
+
+func userKeyPath(username string) string {
+	return fmt.Sprintf("users/%s/key", username)
+}
+
+func (ks *pluginKeyStore) readKey(ctx context.Context, username string) (*UserKey, error) {
+	entry, err := ks.storage.Get(ctx, userKeyPath(username))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	var key UserKey
+	if err := entry.DecodeJSON(&key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (ks *pluginKeyStore) writeKey(ctx context.Context, username string, key *UserKey) error {
+	entry, err := logical.StorageEntryJSON(userKeyPath(username), key)
+	if err != nil {
+		return err
+	}
+	return ks.storage.Put(ctx, entry)
+}
+
+func (ks *pluginKeyStore) deleteKey(ctx context.Context, username string) error {
+	return ks.storage.Delete(ctx, userKeyPath(username))
+}
+
+// listUsernames : Each user's key sits in their own folder under users/, next to their
+// retired keys.
+func (ks *pluginKeyStore) listUsernames(ctx context.Context) ([]string, error) {
+	folders, err := ks.storage.List(ctx, "users/")
+	if err != nil {
+		return nil, err
+	}
+	usernames := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		if strings.HasSuffix(folder, "/") {
+			usernames = append(usernames, strings.TrimSuffix(folder, "/"))
+		}
+	}
+	return usernames, nil
+}
+
+// migrateKeys : Moves every key from the KV mount into plugin storage.  Each key is copied,
+// read back and compared before its KV entry is deleted, so a run which stops part way leaves
+// every key in at least one store and can simply be repeated.  A user's current key moves
+// last, as it is what lists them in the KV mount.  Users whose plugin storage already holds
+// a different key are skipped, and their KV entries left for a maintainer to look at.
+func migrateKeys(ctx context.Context, from *kvKeyStore, to *pluginKeyStore) (migrated []string, skipped []string, err error) {
+	usernames, err := from.listUsernames(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	migrated, skipped = []string{}, []string{}
+	for _, username := range usernames {
+		key, err := from.readKey(ctx, username)
+		if err != nil {
+			return migrated, skipped, fmt.Errorf("reading key for %s: %v", username, err)
+		}
+		if key == nil {
+			continue
+		}
+		existing, err := to.readKey(ctx, username)
+		if err != nil {
+			return migrated, skipped, err
+		}
+		if existing != nil && *existing != *key {
+			skipped = append(skipped, username)
+			continue
+		}
+		names, err := migratedKeyNames(ctx, to.storage, username)
+		if err != nil {
+			return migrated, skipped, err
+		}
+		for _, name := range append(names, username) {
+			if err := moveKey(ctx, from, to, name); err != nil {
+				return migrated, skipped, err
+			}
+		}
+		migrated = append(migrated, username)
+	}
+	return migrated, skipped, nil
+}
+
+// migratedKeyNames : The keyStore names of the keys username retired by rotating, as listed
+// in their history, and of their named keys, as listed in their index.
+func migratedKeyNames(ctx context.Context, s logical.Storage, username string) ([]string, error) {
+	history, err := readKeyHistory(ctx, s, username, nil)
+	if err != nil {
+		return nil, err
+	}
+	namedKeys, err := readNamedKeys(ctx, s, username)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, version := range history {
+		if version.RetiredAt != nil {
+			names = append(names, retiredKeyName(username, version.Version))
+		}
+	}
+	for _, namedKey := range namedKeys {
+		names = append(names, namedKeyName(username, namedKey.Name))
+	}
+	return names, nil
+}
+
+// moveKey : Copies the key stored under name into plugin storage, unless an identical copy is
+// already there, and deletes it from the KV mount once the copy reads back the same.
+func moveKey(ctx context.Context, from *kvKeyStore, to *pluginKeyStore, name string) error {
+	key, err := from.readKey(ctx, name)
+	if err != nil {
+		return fmt.Errorf("reading key %s: %v", name, err)
+	}
+	if key == nil {
+		return nil
+	}
+	copied, err := to.readKey(ctx, name)
+	if err != nil {
+		return err
+	}
+	if copied == nil {
+		if err := to.writeKey(ctx, name, key); err != nil {
+			return fmt.Errorf("writing key %s: %v", name, err)
+		}
+		if copied, err = to.readKey(ctx, name); err != nil {
+			return err
+		}
+	}
+	if copied == nil || *copied != *key {
+		return fmt.Errorf("key %s in plugin storage does not match the KV mount, leaving it in place", name)
+	}
+	if err := from.deleteKey(ctx, name); err != nil {
+		return fmt.Errorf("deleting key %s from the KV mount: %v", name, err)
+	}
+	return nil
+}
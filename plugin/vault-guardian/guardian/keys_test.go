@@ -0,0 +1,288 @@
+package guardian
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/logical"
+)
+
+// fakeVault : Minimal stand-in for the Vault API the Client calls, holding a KV mount at
+// keys/, entity aliases for identity/lookup/entity, and the guardian token's own TTL.
+type fakeVault struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	kv       map[string]map[string]interface{}
+	entities map[string]string
+	requests int
+
+	// Seconds left on the guardian token, and how far a renewal may extend it
+	tokenTTL    int
+	creationTTL int
+	maxTTL      int
+	revoked     bool
+	wrapped     map[string]string
+	secretIDs   map[string]string
+}
+
+func newFakeVault(t testing.TB) *fakeVault {
+	fv := &fakeVault{
+		kv:        map[string]map[string]interface{}{},
+		entities:  map[string]string{},
+		wrapped:   map[string]string{},
+		secretIDs: map[string]string{}}
+	fv.server = httptest.NewServer(http.HandlerFunc(fv.handle))
+	return fv
+}
+
+func (fv *fakeVault) requestCount() int {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	return fv.requests
+}
+
+func (fv *fakeVault) handle(w http.ResponseWriter, r *http.Request) {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	fv.requests++
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	isList := r.Method == "LIST" || r.URL.Query().Get("list") == "true"
+	switch {
+	case path == "identity/lookup/entity":
+		var body struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		username, ok := fv.entities[body.ID]
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"id":      body.ID,
+			"aliases": []interface{}{map[string]interface{}{"name": username}},
+		}})
+	case path == "auth/token/lookup-self":
+		if fv.revoked {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"ttl":          fv.tokenTTL,
+			"creation_ttl": fv.creationTTL,
+			"renewable":    fv.creationTTL > 0,
+		}})
+	case path == "auth/token/renew-self":
+		fv.tokenTTL = fv.creationTTL
+		if fv.tokenTTL > fv.maxTTL {
+			fv.tokenTTL = fv.maxTTL
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token":   "guardian-token",
+			"lease_duration": fv.tokenTTL,
+			"renewable":      true,
+		}})
+	case path == "sys/wrapping/unwrap":
+		var body struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		wrappingToken := body.Token
+		if wrappingToken == "" {
+			wrappingToken = r.Header.Get("X-Vault-Token")
+		}
+		secretID, ok := fv.wrapped[wrappingToken]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["wrapping token is not valid or does not exist"]}`))
+			return
+		}
+		delete(fv.wrapped, wrappingToken)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"secret_id": secretID}})
+	case path == "auth/approle/login":
+		var body struct {
+			SecretID string `json:"secret_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		token, ok := fv.secretIDs[body.SecretID]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["invalid secret id"]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{"client_token": token}})
+	case path == "auth/token/create/guardian-enduser":
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": fmt.Sprintf("sign-token-%d", fv.requests),
+			"accessor":     fmt.Sprintf("sign-accessor-%d", fv.requests),
+		}})
+	case strings.TrimSuffix(path, "/") == "keys" && isList:
+		// Like KV, nested entries are listed as their top-level folder
+		keys := []string{}
+		seen := map[string]bool{}
+		for name := range fv.kv {
+			if slash := strings.Index(name, "/"); slash >= 0 {
+				name = name[:slash+1]
+			}
+			if !seen[name] {
+				seen[name] = true
+				keys = append(keys, name)
+			}
+		}
+		sort.Strings(keys)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+	case strings.HasPrefix(path, "keys/") && r.Method == http.MethodGet:
+		data, ok := fv.kv[strings.TrimPrefix(path, "keys/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	case strings.HasPrefix(path, "keys/") && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		var data map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&data)
+		fv.kv[strings.TrimPrefix(path, "keys/")] = data
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "keys/") && r.Method == http.MethodDelete:
+		delete(fv.kv, strings.TrimPrefix(path, "keys/"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":["unsupported by fakeVault"]}`))
+	}
+}
+
+func (fv *fakeVault) client(t testing.TB) *api.Client {
+	conf := api.DefaultConfig()
+	conf.Address = fv.server.URL
+	client, err := api.NewClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("guardian-token")
+	return client
+}
+
+func TestPluginKeyStore_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	ks := &pluginKeyStore{storage: &logical.InmemStorage{}}
+	missing, err := ks.readKey(ctx, "alice@eximchain.com")
+	if err != nil || missing != nil {
+		t.Fatalf("expected no key and no error, got %v, %v", missing, err)
+	}
+	key, err := NewUserKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.writeKey(ctx, "alice@eximchain.com", key); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ks.readKey(ctx, "alice@eximchain.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *read != *key {
+		t.Fatalf("expected %#v, got %#v", key, read)
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	ctx := context.Background()
+	fv := newFakeVault(t)
+	defer fv.server.Close()
+	from := &kvKeyStore{vault: fv.client(t)}
+	to := &pluginKeyStore{storage: &logical.InmemStorage{}}
+
+	legacyHex, legacyAddress, err := CreateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &UserKey{PrivKeyHex: legacyHex, PublicAddressHex: legacyAddress}
+	hd, err := NewUserKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := from.writeKey(ctx, "alice", legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.writeKey(ctx, "bob", hd); err != nil {
+		t.Fatal(err)
+	}
+	existing, err := NewUserKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := from.writeKey(ctx, "carol", hd); err != nil {
+		t.Fatal(err)
+	}
+	if err := to.writeKey(ctx, "carol", existing); err != nil {
+		t.Fatal(err)
+	}
+	// dave's key was copied by an earlier run which stopped before deleting it
+	if err := from.writeKey(ctx, "dave", existing); err != nil {
+		t.Fatal(err)
+	}
+	if err := to.writeKey(ctx, "dave", existing); err != nil {
+		t.Fatal(err)
+	}
+	// bob's named key moves with him
+	savings, err := NewUserKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := from.writeKey(ctx, namedKeyName("bob", "savings"), savings); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeNamedKeys(ctx, to.storage, "bob", []NamedKey{{Name: "savings", Address: savings.PublicAddressHex}}); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, skipped, err := migrateKeys(ctx, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(migrated, ",") != "alice,bob,dave" {
+		t.Errorf("expected alice, bob and dave to migrate, got %v", migrated)
+	}
+	if strings.Join(skipped, ",") != "carol" {
+		t.Errorf("expected carol to be skipped, got %v", skipped)
+	}
+
+	for name, want := range map[string]*UserKey{"alice": legacy, "bob": hd, "bob/named/savings": savings, "carol": existing, "dave": existing} {
+		got, err := to.readKey(ctx, name)
+		if err != nil || got == nil {
+			t.Fatalf("%s: expected key in plugin storage, got %v, %v", name, got, err)
+		}
+		if *got != *want {
+			t.Errorf("%s: expected %#v, got %#v", name, want, got)
+		}
+	}
+
+	// Only the skipped user's key is left in the KV mount
+	if len(fv.kv) != 1 || fv.kv["carol"] == nil {
+		t.Fatalf("expected only carol's key to be left in KV, got %v", fv.kv)
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	for _, username := range []string{"alice@example.com", "bob.smith+guardian@example.com", ".alice", "..alice"} {
+		if err := validateUsername(username); err != nil {
+			t.Errorf("expected %q to be allowed, got %v", username, err)
+		}
+	}
+	for _, username := range []string{"", ".", "..", "alice/named/savings", "../alice", "alice bob", "alice\n", "alice\x00"} {
+		if err := validateUsername(username); err == nil {
+			t.Errorf("expected %q to be refused", username)
+		}
+	}
+}
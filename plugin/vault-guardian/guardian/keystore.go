@@ -0,0 +1,201 @@
+package guardian
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/eximchain/go-ethereum/crypto"
+	"github.com/hashicorp/vault/logical/framework"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// ExportFormatKeystore : guardian/export returns a Web3 v3 keystore of one address.
+	ExportFormatKeystore = "keystore"
+	// ExportFormatMnemonic : guardian/export returns the BIP-39 mnemonic behind an HD key.
+	ExportFormatMnemonic = "mnemonic"
+
+	// KeystoreScryptN : scrypt cost for exported keystores, geth's StandardScryptN.
+	KeystoreScryptN = 1 << 18
+	// KeystoreScryptP : scrypt parallelization for exported keystores, geth's StandardScryptP.
+	KeystoreScryptP = 1
+	// MinKeystorePassphrase : Shortest passphrase an export will be encrypted with.
+	MinKeystorePassphrase = 8
+
+	keystoreScryptR     = 8
+	keystoreScryptDKLen = 32
+)
+
+//-----------------------------------------
+//  Key Export
+//-----------------------------------------
+
+// exportFields : guardian/export takes fresh credentials, the format, and the keystore passphrase.
+func exportFields() map[string]*framework.FieldSchema {
+	fields := reauthFields()
+	fields["format"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "keystore for a Web3 v3 JSON keystore of one address, or mnemonic for the HD seed.  Defaults to keystore."}
+	fields["passphrase"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Passphrase the keystore is encrypted with, at least 8 characters."}
+	fields["address_index"] = &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "Integer index of which generated address to put in the keystore.",
+		Default:     0}
+	return fields
+}
+
+//-----------------------------------------
+//  Web3 v3 Keystores
+//-----------------------------------------
+
+// KeystoreV3 : The Web3 Secret Storage format read by geth, MyEtherWallet and most wallets.
+type KeystoreV3 struct {
+	Address string           `json:"address"`
+	Crypto  KeystoreV3Crypto `json:"crypto"`
+	ID      string           `json:"id"`
+	Version int              `json:"version"`
+}
+
+// KeystoreV3Crypto : The encrypted key and how to decrypt it.  Only scrypt and
+// aes-128-ctr are produced or understood here.
+type KeystoreV3Crypto struct {
+	Cipher       string                 `json:"cipher"`
+	CipherText   string                 `json:"ciphertext"`
+	CipherParams KeystoreV3CipherParams `json:"cipherparams"`
+	KDF          string                 `json:"kdf"`
+	KDFParams    KeystoreV3ScryptParams `json:"kdfparams"`
+	MAC          string                 `json:"mac"`
+}
+
+// KeystoreV3CipherParams : The aes-128-ctr IV.
+type KeystoreV3CipherParams struct {
+	IV string `json:"iv"`
+}
+
+// KeystoreV3ScryptParams : The scrypt parameters the passphrase is stretched with.
+type KeystoreV3ScryptParams struct {
+	DKLen int    `json:"dklen"`
+	N     int    `json:"n"`
+	P     int    `json:"p"`
+	R     int    `json:"r"`
+	Salt  string `json:"salt"`
+}
+
+// EncryptKeystoreV3 : Encrypts privKeyHex under passphrase with a random salt and IV.
+func EncryptKeystoreV3(privKeyHex, passphrase string) (*KeystoreV3, error) {
+	salt := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	id := make([]byte, 16)
+	for _, random := range [][]byte{salt, iv, id} {
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+	}
+	// A version 4 UUID, as geth gives its keystores
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	keystore, err := encryptKeystoreV3(privKeyHex, passphrase, salt, iv, KeystoreScryptN, KeystoreScryptP)
+	if err != nil {
+		return nil, err
+	}
+	keystore.ID = fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+	return keystore, nil
+}
+
+func encryptKeystoreV3(privKeyHex, passphrase string, salt, iv []byte, n, p int) (*KeystoreV3, error) {
+	privKey, err := hex.DecodeString(privKeyHex)
+	if err != nil {
+		return nil, err
+	}
+	address, err := AddressFromHexKey(privKeyHex)
+	if err != nil {
+		return nil, err
+	}
+	derivedKey, err := scrypt.Key([]byte(passphrase), salt, n, keystoreScryptR, p, keystoreScryptDKLen)
+	if err != nil {
+		return nil, err
+	}
+	cipherText, err := aesCTR(derivedKey[:16], iv, privKey)
+	if err != nil {
+		return nil, err
+	}
+	return &KeystoreV3{
+		Address: strings.ToLower(strings.TrimPrefix(address, "0x")),
+		Version: 3,
+		Crypto: KeystoreV3Crypto{
+			Cipher:       "aes-128-ctr",
+			CipherText:   hex.EncodeToString(cipherText),
+			CipherParams: KeystoreV3CipherParams{IV: hex.EncodeToString(iv)},
+			KDF:          "scrypt",
+			KDFParams: KeystoreV3ScryptParams{
+				DKLen: keystoreScryptDKLen,
+				N:     n,
+				P:     p,
+				R:     keystoreScryptR,
+				Salt:  hex.EncodeToString(salt)},
+			MAC: hex.EncodeToString(crypto.Keccak256(derivedKey[16:32], cipherText))}}, nil
+}
+
+// DecryptKeystoreV3 : Returns the hex private key in keystoreJSON, checking its MAC first.
+func DecryptKeystoreV3(keystoreJSON []byte, passphrase string) (privKeyHex string, err error) {
+	var keystore KeystoreV3
+	if err := json.Unmarshal(keystoreJSON, &keystore); err != nil {
+		return "", err
+	}
+	params := keystore.Crypto.KDFParams
+	if keystore.Version != 3 || keystore.Crypto.KDF != "scrypt" || keystore.Crypto.Cipher != "aes-128-ctr" {
+		return "", fmt.Errorf("only version 3 scrypt/aes-128-ctr keystores are supported")
+	}
+	if params.DKLen < keystoreScryptDKLen {
+		return "", fmt.Errorf("keystore dklen must be at least %d", keystoreScryptDKLen)
+	}
+	salt, err := hex.DecodeString(params.Salt)
+	if err != nil {
+		return "", err
+	}
+	iv, err := hex.DecodeString(keystore.Crypto.CipherParams.IV)
+	if err != nil {
+		return "", err
+	}
+	if len(iv) != aes.BlockSize {
+		return "", fmt.Errorf("keystore iv must be %d bytes", aes.BlockSize)
+	}
+	cipherText, err := hex.DecodeString(keystore.Crypto.CipherText)
+	if err != nil {
+		return "", err
+	}
+	mac, err := hex.DecodeString(keystore.Crypto.MAC)
+	if err != nil {
+		return "", err
+	}
+	derivedKey, err := scrypt.Key([]byte(passphrase), salt, params.N, params.R, params.P, params.DKLen)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(crypto.Keccak256(derivedKey[16:32], cipherText), mac) {
+		return "", fmt.Errorf("could not decrypt keystore with the given passphrase")
+	}
+	privKey, err := aesCTR(derivedKey[:16], iv, cipherText)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(privKey), nil
+}
+
+func aesCTR(key, iv, input []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	output := make([]byte, len(input))
+	cipher.NewCTR(block, iv).XORKeyStream(output, input)
+	return output, nil
+}
@@ -0,0 +1,88 @@
+package guardian
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// The scrypt test vector from the Web3 Secret Storage definition.
+const (
+	web3TestKeystore   = `{"crypto":{"cipher":"aes-128-ctr","cipherparams":{"iv":"83dbcc02d8ccb40e466191a123791e0e"},"ciphertext":"d172bf743a674da9cdad04534d56926ef8358534d458fffccd4e6ad2fbde479c","kdf":"scrypt","kdfparams":{"dklen":32,"n":262144,"r":1,"p":8,"salt":"ab0c7876052600dd703518d6fc3fe8984592145b591fc8fb5c6d43190334ba19"},"mac":"2103ac29920d71da29f15d75b4a16dbe95cfd7ff8faea1056c33131d846e3097"},"id":"3198bc9c-6672-5ab3-d995-4942343ae5b6","version":3}`
+	web3TestPassphrase = "testpassword"
+	web3TestPrivKeyHex = "7a28b5ba57c53603b0b07b56bba752f7784bf506fa95edc395f5cf6c7514fe9d"
+)
+
+func TestDecryptKeystoreV3(t *testing.T) {
+	privKeyHex, err := DecryptKeystoreV3([]byte(web3TestKeystore), web3TestPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privKeyHex != web3TestPrivKeyHex {
+		t.Fatalf("expected %s, got %s", web3TestPrivKeyHex, privKeyHex)
+	}
+	if _, err := DecryptKeystoreV3([]byte(web3TestKeystore), "wrongpassword"); err == nil {
+		t.Fatal("expected the wrong passphrase to fail the MAC check")
+	}
+}
+
+func exportRequest(storage logical.Storage, data map[string]interface{}) *logical.Request {
+	data["okta_username"] = "alice"
+	data["okta_password"] = "hunter2"
+	return &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "export",
+		Storage:   storage,
+		EntityID:  "entity-alice",
+		Data:      data,
+	}
+}
+
+func TestBackend_Export(t *testing.T) {
+	b, storage, _, closeServer := newPushBackend(t, false)
+	defer closeServer()
+	ctx := context.Background()
+	cfg, client, _ := b.configAndClient(ctx, storage)
+	userKey, err := client.readKeyByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, _ := b.HandleRequest(ctx, exportRequest(storage, map[string]interface{}{"passphrase": "short"}))
+	if resp == nil || !isError(resp) {
+		t.Fatalf("expected a short passphrase to be refused, got %#v", resp)
+	}
+
+	resp, err = b.HandleRequest(ctx, exportRequest(storage, map[string]interface{}{"passphrase": "correct horse", "address_index": 2}))
+	if err != nil || isError(resp) {
+		t.Fatalf("keystore export failed: %v %#v", err, resp)
+	}
+	privKeyHex, err := DecryptKeystoreV3([]byte(resp.Data["keystore"].(string)), "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := userKey.HexKey(2)
+	if privKeyHex != want {
+		t.Fatal("expected the keystore to hold the key at address_index 2")
+	}
+
+	resp, err = b.HandleRequest(ctx, exportRequest(storage, map[string]interface{}{"format": ExportFormatMnemonic}))
+	if err != nil || isError(resp) || resp.Data["mnemonic"] != userKey.Mnemonic {
+		t.Fatalf("mnemonic export failed: %v %#v", err, resp)
+	}
+
+	events, _, err := b.readHistory(ctx, storage, "alice", historyQuery{Limit: DefaultHistoryLimit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Format != ExportFormatKeystore || events[1].Format != ExportFormatMnemonic || events[1].Mode != EventModeExport {
+		t.Fatalf("expected both exports on record, got %#v", events)
+	}
+
+	cfg.ExportDisabled = true
+	resp, _ = b.HandleRequest(ctx, exportRequest(storage, map[string]interface{}{"format": ExportFormatMnemonic}))
+	if resp == nil || !isError(resp) {
+		t.Fatalf("expected export to be refused once disabled, got %#v", resp)
+	}
+}
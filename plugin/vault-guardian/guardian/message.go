@@ -0,0 +1,68 @@
+package guardian
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/common/hexutil"
+	"github.com/eximchain/go-ethereum/crypto"
+)
+
+//-----------------------------------------
+//  EIP-191 Signed Data
+//-----------------------------------------
+
+const (
+	// EIP191VersionPersonal : Version 0x45 ('E'), the "\x19Ethereum Signed Message:\n" prefix used by personal_sign.
+	EIP191VersionPersonal = "0x45"
+	// EIP191VersionValidator : Version 0x00, data addressed to an intended validator contract.
+	EIP191VersionValidator = "0x00"
+
+	// MessageEncodingUTF8 : message is human-readable text, signed as its UTF-8 bytes.
+	MessageEncodingUTF8 = "utf8"
+	// MessageEncodingHex : message is 0x-prefixed hex, for binary payloads.
+	MessageEncodingHex = "hex"
+)
+
+// PersonalMessageHash : keccak256("\x19Ethereum Signed Message:\n" ‖ len(message) ‖ message), as
+// computed by personal_sign and the ethereum plugin's sign path.
+func PersonalMessageHash(message []byte) []byte {
+	msg := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(message), message)
+	return crypto.Keccak256([]byte(msg))
+}
+
+// ValidatorMessageHash : keccak256(0x19 ‖ 0x00 ‖ validator ‖ data), EIP-191's version 0x00.
+func ValidatorMessageHash(validator common.Address, data []byte) []byte {
+	return crypto.Keccak256([]byte{0x19, 0x00}, validator.Bytes(), data)
+}
+
+// decodeMessage : The bytes message stands for under encoding.
+func decodeMessage(message string, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "", MessageEncodingUTF8:
+		return []byte(message), nil
+	case MessageEncodingHex:
+		return hexutil.Decode(withHexPrefix(message))
+	default:
+		return nil, fmt.Errorf("message_encoding must be %q or %q", MessageEncodingUTF8, MessageEncodingHex)
+	}
+}
+
+// MessageHash : The EIP-191 hash of message for version, validator is only used by 0x00.
+func MessageHash(version string, validator string, message []byte) ([]byte, error) {
+	switch strings.ToLower(version) {
+	case "", EIP191VersionPersonal:
+		if validator != "" {
+			return nil, fmt.Errorf("validator is only used with version %s", EIP191VersionValidator)
+		}
+		return PersonalMessageHash(message), nil
+	case EIP191VersionValidator:
+		if !common.IsHexAddress(validator) {
+			return nil, fmt.Errorf("version %s requires a validator address", EIP191VersionValidator)
+		}
+		return ValidatorMessageHash(common.HexToAddress(validator), message), nil
+	default:
+		return nil, fmt.Errorf("version must be %s or %s", EIP191VersionPersonal, EIP191VersionValidator)
+	}
+}
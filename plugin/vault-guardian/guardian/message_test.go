@@ -0,0 +1,83 @@
+package guardian
+
+import (
+	"context"
+	"testing"
+
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/common/hexutil"
+	"github.com/eximchain/go-ethereum/crypto"
+	"github.com/hashicorp/vault/logical"
+)
+
+// hashMessage("Hello World") as published by ethers.js and web3.js.
+const helloWorldPersonalHash = "0xa1de988600a42c4b4ab089b619297c17d53cffae5d5120d82d8a92d0bb3b78f2"
+
+func TestMessageHash(t *testing.T) {
+	personal, err := MessageHash("", "", []byte("Hello World"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hexutil.Encode(personal) != helloWorldPersonalHash {
+		t.Errorf("expected %s, got %s", helloWorldPersonalHash, hexutil.Encode(personal))
+	}
+
+	validator := "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"
+	intended, err := MessageHash(EIP191VersionValidator, validator, []byte("Hello World"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimage := append([]byte{0x19, 0x00}, common.HexToAddress(validator).Bytes()...)
+	preimage = append(preimage, []byte("Hello World")...)
+	if want := crypto.Keccak256(preimage); hexutil.Encode(intended) != hexutil.Encode(want) {
+		t.Errorf("expected %x, got %x", want, intended)
+	}
+
+	if _, err := MessageHash(EIP191VersionValidator, "", []byte("Hello World")); err == nil {
+		t.Error("expected version 0x00 without a validator to fail")
+	}
+	if _, err := MessageHash(EIP191VersionPersonal, validator, []byte("Hello World")); err == nil {
+		t.Error("expected a validator with version 0x45 to fail")
+	}
+	if _, err := MessageHash("0x01", "", []byte("Hello World")); err == nil {
+		t.Error("expected unsupported versions to fail")
+	}
+}
+
+func TestBackend_SignMessage(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+
+	req := signRequest(storage)
+	req.Data = map[string]interface{}{"message": "48656c6c6f20576f726c64", "message_encoding": MessageEncodingHex}
+	resp, err := b.HandleRequest(ctx, req)
+	if err != nil || isError(resp) {
+		t.Fatalf("sign with message failed: %v %#v", err, resp)
+	}
+	if resp.Data["hash"] != helloWorldPersonalHash {
+		t.Fatalf("expected hash %s, got %v", helloWorldPersonalHash, resp.Data["hash"])
+	}
+	sig, err := hexutil.Decode(resp.Data["signature"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig[64] != 27 && sig[64] != 28 {
+		t.Fatalf("expected v of 27 or 28, got %d", sig[64])
+	}
+	sig[64] -= 27
+	hash, _ := hexutil.Decode(helloWorldPersonalHash)
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer := crypto.PubkeyToAddress(*pub).Hex(); signer != fv.kv["alice"]["publicAddressHex"] {
+		t.Fatalf("expected alice's address, recovered %s", signer)
+	}
+
+	req = signRequest(storage)
+	req.Data["message"] = "Hello World"
+	if resp, _ = b.HandleRequest(ctx, req); resp == nil || !isError(resp) {
+		t.Fatalf("expected raw_data and message together to be refused, got %#v", resp)
+	}
+}
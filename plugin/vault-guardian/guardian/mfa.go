@@ -0,0 +1,190 @@
+package guardian
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	// MFAFactorPush : Approve the login from Okta Verify, polled with a transaction_id.
+	MFAFactorPush = "push"
+	// MFAFactorTOTP : One-time passcode from Okta Verify or Google Authenticator.
+	MFAFactorTOTP = "totp"
+
+	// MFAPushWait : How long login blocks on a push before handing back a transaction_id.
+	MFAPushWait = 3 * time.Second
+	// MFAPushTimeout : How long a pending push may be polled before it is forgotten.
+	MFAPushTimeout = 5 * time.Minute
+
+	mfaStatusPending     = "pending"
+	mfaStatusRejected    = "rejected"
+	mfaStatusTimedOut    = "timed_out"
+	mfaStatusRequired    = "required"
+	mfaStatusNotEnrolled = "not_enrolled"
+)
+
+var (
+	// ErrMFARequired : The mount has require_mfa set and the login carried no factor.
+	ErrMFARequired = errors.New("this Guardian requires MFA, provide a passcode or factor=push")
+	// ErrMFANotEnrolled : The user has no active factor of the kind the login named.
+	ErrMFANotEnrolled = errors.New("no active MFA factor of that kind is enrolled")
+	// ErrMFARejected : The user declined the Okta Verify push.
+	ErrMFARejected = errors.New("MFA push was rejected")
+	// ErrMFATimedOut : The Okta Verify push was never answered.
+	ErrMFATimedOut = errors.New("MFA push timed out before it was answered")
+)
+
+// mfaFactor : The factor a login is using, a passcode on its own implies totp.
+func mfaFactor(creds Credentials) string {
+	if creds.Factor == "" && creds.Passcode != "" {
+		return MFAFactorTOTP
+	}
+	return strings.ToLower(creds.Factor)
+}
+
+// validateMFA : Checks the factor and passcode agree, and that a factor is present when the
+// mount requires MFA.
+func validateMFA(cfg *Config, creds Credentials) error {
+	switch mfaFactor(creds) {
+	case "":
+		if cfg.RequireMFA {
+			return ErrMFARequired
+		}
+	case MFAFactorTOTP:
+		if creds.Passcode == "" {
+			return fmt.Errorf("factor=%s requires a passcode", MFAFactorTOTP)
+		}
+	case MFAFactorPush:
+		if creds.Passcode != "" {
+			return fmt.Errorf("a passcode cannot be combined with factor=%s", MFAFactorPush)
+		}
+	default:
+		return fmt.Errorf("factor must be %q or %q", MFAFactorPush, MFAFactorTOTP)
+	}
+	return nil
+}
+
+// mfaErrorCodes : The error_code sent with each mfa_status.
+var mfaErrorCodes = map[string]string{
+	mfaStatusPending:     ErrCodeMFAPending,
+	mfaStatusRejected:    ErrCodeMFARejected,
+	mfaStatusTimedOut:    ErrCodeMFATimedOut,
+	mfaStatusRequired:    ErrCodeMFARequired,
+	mfaStatusNotEnrolled: ErrCodeMFARequired}
+
+// mfaErrResp : Error response which also carries an mfa_status, so clients can tell a push
+// they should keep polling from one that was rejected.
+func mfaErrResp(req *logical.Request, status string, msg string, transactionID string) *logical.Response {
+	extra := map[string]interface{}{"mfa_status": status}
+	if transactionID != "" {
+		extra["transaction_id"] = transactionID
+	}
+	return errorResp(req, mfaErrorCodes[status], msg, extra)
+}
+
+//-----------------------------------------
+//  Pending Push Logins
+//-----------------------------------------
+
+// pendingLogin : An Okta login waiting on a push.  done is closed once username and err are set.
+type pendingLogin struct {
+	claimedUsername string
+	expires         time.Time
+	done            chan struct{}
+	username        string
+	err             error
+}
+
+// pendingLogins : Push logins still running in the background, by transaction_id.  These
+// live in memory, so a poll has to reach the same Vault node which started the push.
+type pendingLogins struct {
+	mu     sync.Mutex
+	logins map[string]*pendingLogin
+}
+
+func newPendingLogins() *pendingLogins {
+	return &pendingLogins{logins: map[string]*pendingLogin{}}
+}
+
+// start : Runs authenticate in the background and returns its transaction_id.  The
+// request's context ends with the request, so the login gets its own.
+func (p *pendingLogins) start(client *Client, creds Credentials) (string, *pendingLogin, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, err
+	}
+	transactionID := hex.EncodeToString(idBytes)
+	login := &pendingLogin{
+		claimedUsername: creds.Username,
+		expires:         time.Now().Add(MFAPushTimeout),
+		done:            make(chan struct{})}
+	p.mu.Lock()
+	p.logins[transactionID] = login
+	p.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), MFAPushTimeout)
+		defer cancel()
+		login.username, login.err = client.authenticate(ctx, creds)
+		close(login.done)
+	}()
+	return transactionID, login, nil
+}
+
+// get : Looks up a pending login, which only the username that started it may poll.
+func (p *pendingLogins) get(transactionID string, username string) (*pendingLogin, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	login, ok := p.logins[transactionID]
+	if !ok || login.claimedUsername != username || time.Now().After(login.expires) {
+		return nil, false
+	}
+	return login, true
+}
+
+// finish : Forgets a login once its result is handed out, false if a concurrent poll already
+// took it.
+func (p *pendingLogins) finish(transactionID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.logins[transactionID]; !ok {
+		return false
+	}
+	delete(p.logins, transactionID)
+	return true
+}
+
+// tidy : Drops logins nobody came back to poll.
+func (p *pendingLogins) tidy() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for transactionID, login := range p.logins {
+		if now.After(login.expires) {
+			delete(p.logins, transactionID)
+		}
+	}
+}
+
+// wait : Result of the login if it completes within timeout, finished is false otherwise.
+func (login *pendingLogin) wait(timeout time.Duration) (username string, finished bool, err error) {
+	select {
+	case <-login.done:
+		return login.username, true, login.err
+	default:
+	}
+	select {
+	case <-login.done:
+		return login.username, true, login.err
+	case <-time.After(timeout):
+		return "", false, nil
+	}
+}
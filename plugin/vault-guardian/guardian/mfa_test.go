@@ -0,0 +1,239 @@
+package guardian
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/okta/okta-sdk-golang/okta"
+)
+
+// pushProvider : An Okta stand-in whose push is answered by sending on result.
+type pushProvider struct {
+	result chan error
+}
+
+func (p *pushProvider) Name() string {
+	return ProviderOkta
+}
+
+func (p *pushProvider) Authenticate(ctx context.Context, creds Credentials) (string, error) {
+	if creds.Factor != MFAFactorPush {
+		return creds.Username, nil
+	}
+	if err := <-p.result; err != nil {
+		return "", err
+	}
+	return creds.Username, nil
+}
+
+func (p *pushProvider) UserExists(ctx context.Context, username string) (bool, error) {
+	return true, nil
+}
+
+func (p *pushProvider) Register(ctx context.Context, username string) error {
+	return nil
+}
+
+func (p *pushProvider) Unregister(ctx context.Context, username string) error {
+	return nil
+}
+
+// newPushBackend : A signing backend whose cached Client authenticates with a pushProvider.
+func newPushBackend(t *testing.T, requireMFA bool) (*backend, logical.Storage, *pushProvider, func()) {
+	b, storage, fv := newSigningBackend(t)
+	cfg, client, err := b.configAndClient(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &pushProvider{result: make(chan error, 1)}
+	cfg.Provider = ProviderOkta
+	cfg.RequireMFA = requireMFA
+	client.identity = provider
+	return b, storage, provider, fv.server.Close
+}
+
+func loginRequest(storage logical.Storage, data map[string]interface{}) *logical.Request {
+	data["okta_username"] = "alice"
+	data["okta_password"] = "hunter2"
+	return &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "login",
+		Storage:   storage,
+		Data:      data,
+	}
+}
+
+// fakeOktaFactors : Local stand-in for Okta's factors API.  alice has an active push and
+// totp factor, bob only a totp factor he never activated.  Pushes wait for one poll, then
+// answer with pushResult.
+type fakeOktaFactors struct {
+	server     *httptest.Server
+	mu         sync.Mutex
+	pushResult string
+	verified   int
+}
+
+func newFakeOktaFactors() *fakeOktaFactors {
+	fo := &fakeOktaFactors{}
+	factors := map[string][]oktaFactor{
+		"00ualice": {{ID: "push1", FactorType: "push", Status: "ACTIVE"}, {ID: "totp1", FactorType: "token:software:totp", Status: "ACTIVE"}},
+		"00ubob":   {{ID: "totp2", FactorType: "token:software:totp", Status: "PENDING_ACTIVATION"}}}
+	fo.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fo.mu.Lock()
+		defer fo.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/users/"), "/")
+		switch {
+		case len(parts) == 1:
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": "00u" + parts[0], "status": "ACTIVE"})
+		case len(parts) == 2 && parts[1] == "factors":
+			json.NewEncoder(w).Encode(factors[parts[0]])
+		case len(parts) == 4 && parts[3] == "verify":
+			fo.verified++
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			if parts[2] == "totp1" {
+				if body["passCode"] != "123456" {
+					w.WriteHeader(http.StatusForbidden)
+					json.NewEncoder(w).Encode(map[string]interface{}{"errorCode": "E0000068", "errorSummary": "Invalid Passcode/Answer"})
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"factorResult": "SUCCESS"})
+				return
+			}
+			poll := fo.server.URL + r.URL.Path[:len(r.URL.Path)-len("verify")] + "transactions/tx1"
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"factorResult": "WAITING",
+				"_links":       map[string]interface{}{"poll": map[string]interface{}{"href": poll}}})
+		case len(parts) == 5 && parts[3] == "transactions":
+			json.NewEncoder(w).Encode(map[string]interface{}{"factorResult": fo.pushResult})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return fo
+}
+
+func TestOktaProvider_ChallengeFactor(t *testing.T) {
+	fo := newFakeOktaFactors()
+	defer fo.server.Close()
+	config := okta.NewConfig().
+		WithOrgUrl(fo.server.URL).
+		WithToken("okta-token").
+		WithCache(false).
+		WithTestingDisableHttpsCheck(true)
+	provider := &oktaProvider{okta: okta.NewClient(config, nil, nil)}
+	ctx := context.Background()
+
+	if err := provider.challengeFactor(ctx, "alice", MFAFactorTOTP, "123456"); err != nil {
+		t.Fatalf("expected alice's passcode to be accepted, got %v", err)
+	}
+	if err := provider.challengeFactor(ctx, "alice", MFAFactorTOTP, "000000"); err == nil {
+		t.Fatal("expected a wrong passcode to be refused")
+	}
+
+	// bob's factor was never activated, so there is nothing to challenge
+	fo.mu.Lock()
+	verified := fo.verified
+	fo.mu.Unlock()
+	for _, factor := range []string{MFAFactorTOTP, MFAFactorPush} {
+		if err := provider.challengeFactor(ctx, "bob", factor, "123456"); err != ErrMFANotEnrolled {
+			t.Errorf("%s: expected ErrMFANotEnrolled, got %v", factor, err)
+		}
+	}
+	fo.mu.Lock()
+	if fo.verified != verified {
+		t.Fatal("expected no challenge without an active factor")
+	}
+	fo.mu.Unlock()
+
+	pushResults := map[string]error{"SUCCESS": nil, "REJECTED": ErrMFARejected, "TIMEOUT": ErrMFATimedOut}
+	for result, want := range pushResults {
+		fo.mu.Lock()
+		fo.pushResult = result
+		fo.mu.Unlock()
+		if err := provider.challengeFactor(ctx, "alice", MFAFactorPush, ""); err != want {
+			t.Errorf("%s: expected %v, got %v", result, want, err)
+		}
+	}
+}
+
+func TestLogin_RequireMFA(t *testing.T) {
+	b, storage, _, cleanup := newPushBackend(t, true)
+	defer cleanup()
+
+	resp, _ := b.HandleRequest(context.Background(), loginRequest(storage, map[string]interface{}{}))
+	if resp == nil || errorData(resp)["mfa_status"] != mfaStatusRequired {
+		t.Fatalf("expected login without a factor to be refused, got %#v", resp)
+	}
+
+	resp, err := b.HandleRequest(context.Background(), loginRequest(storage, map[string]interface{}{"passcode": "123456"}))
+	if err != nil || isError(resp) || resp.Data["client_token"] == nil {
+		t.Fatalf("expected passcode login to succeed, got %v %#v", err, resp)
+	}
+
+	resp, _ = b.HandleRequest(context.Background(), loginRequest(storage, map[string]interface{}{"factor": "sms"}))
+	if resp == nil || !isError(resp) {
+		t.Fatalf("expected an unknown factor to be refused, got %#v", resp)
+	}
+}
+
+func TestLogin_PushPendingThenApproved(t *testing.T) {
+	b, storage, provider, cleanup := newPushBackend(t, false)
+	defer cleanup()
+	ctx := context.Background()
+
+	resp, err := b.HandleRequest(ctx, loginRequest(storage, map[string]interface{}{"factor": MFAFactorPush}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errorData(resp)["mfa_status"] != mfaStatusPending {
+		t.Fatalf("expected a pending push, got %#v", resp)
+	}
+	transactionID := errorData(resp)["transaction_id"].(string)
+
+	// Nobody else may poll alice's push
+	poll := loginRequest(storage, map[string]interface{}{"transaction_id": transactionID})
+	poll.Data["okta_username"] = "mallory"
+	if resp, _ = b.HandleRequest(ctx, poll); resp == nil || !isError(resp) {
+		t.Fatalf("expected another username's poll to fail, got %#v", resp)
+	}
+
+	resp, _ = b.HandleRequest(ctx, loginRequest(storage, map[string]interface{}{"transaction_id": transactionID}))
+	if errorData(resp)["mfa_status"] != mfaStatusPending {
+		t.Fatalf("expected the push to still be pending, got %#v", resp)
+	}
+
+	provider.result <- nil
+	login, ok := b.mfaLogins.get(transactionID, "alice")
+	if !ok {
+		t.Fatal("expected the pending login to still be tracked")
+	}
+	<-login.done
+	resp, err = b.HandleRequest(ctx, loginRequest(storage, map[string]interface{}{"transaction_id": transactionID}))
+	if err != nil || isError(resp) || resp.Data["client_token"] == nil {
+		t.Fatalf("expected an approved push to log in, got %v %#v", err, resp)
+	}
+
+	resp, _ = b.HandleRequest(ctx, loginRequest(storage, map[string]interface{}{"transaction_id": transactionID}))
+	if resp == nil || !isError(resp) {
+		t.Fatalf("expected a transaction_id to be single-use, got %#v", resp)
+	}
+}
+
+func TestLogin_PushRejected(t *testing.T) {
+	b, storage, provider, cleanup := newPushBackend(t, false)
+	defer cleanup()
+
+	provider.result <- ErrMFARejected
+	resp, _ := b.HandleRequest(context.Background(), loginRequest(storage, map[string]interface{}{"factor": MFAFactorPush}))
+	if resp == nil || errorData(resp)["mfa_status"] != mfaStatusRejected {
+		t.Fatalf("expected a rejected push, got %#v", resp)
+	}
+}
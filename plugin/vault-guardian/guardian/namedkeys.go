@@ -0,0 +1,178 @@
+package guardian
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/vault/helper/locksutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	// DefaultKeyName : The key every user gets at first login, which an empty key_name selects.
+	DefaultKeyName = "default"
+)
+
+const keyNameSegment = `[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}`
+
+var keyNamePattern = regexp.MustCompile(`^` + keyNameSegment + `$`)
+
+//-----------------------------------------
+//  Named Keys
+//-----------------------------------------
+
+// NamedKey : One of the extra keys a user has created beyond their default.  The key itself
+// lives in the keyStore under namedKeyName, alongside the user's current and retired keys.
+type NamedKey struct {
+	Name      string    `json:"name"`
+	Address   string    `json:"address"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// KeyExistsError : Returned when a user creates a named key they already hold.
+type KeyExistsError struct {
+	Name string
+}
+
+func (e *KeyExistsError) Error() string {
+	return fmt.Sprintf("a key named %s already exists", e.Name)
+}
+
+func namedKeysPath(username string) string {
+	return "named-keys/" + username
+}
+
+// namedKeyName : Where a named key lives in the keyStore, and the name it is escrowed under.
+func namedKeyName(username, keyName string) string {
+	return fmt.Sprintf("%s/named/%s", username, keyName)
+}
+
+// isDefaultKey : Whether keyName selects the key the user got at first login.
+func isDefaultKey(keyName string) bool {
+	return keyName == "" || keyName == DefaultKeyName
+}
+
+func validateKeyName(keyName string) error {
+	if !keyNamePattern.MatchString(keyName) {
+		return fmt.Errorf("key_name must be up to 64 letters, digits, '.', '_' or '-', starting with a letter or digit")
+	}
+	return nil
+}
+
+// readNamedKeys : username's named keys, oldest first, not counting their default key.
+func readNamedKeys(ctx context.Context, s logical.Storage, username string) ([]NamedKey, error) {
+	entry, err := s.Get(ctx, namedKeysPath(username))
+	if err != nil {
+		return nil, err
+	}
+	namedKeys := []NamedKey{}
+	if entry != nil {
+		if err := entry.DecodeJSON(&namedKeys); err != nil {
+			return nil, err
+		}
+	}
+	return namedKeys, nil
+}
+
+func writeNamedKeys(ctx context.Context, s logical.Storage, username string, namedKeys []NamedKey) error {
+	entry, err := logical.StorageEntryJSON(namedKeysPath(username), namedKeys)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// readKeyByName : The key keyName selects for username, their default key when it is empty.
+// keyName is checked with validateKeyName beforehand.
+func readKeyByName(ctx context.Context, client *Client, username, keyName string) (*UserKey, error) {
+	if isDefaultKey(keyName) {
+		return client.readKeyByUsername(ctx, username)
+	}
+	userKey, err := client.keys.readKey(ctx, namedKeyName(username, keyName))
+	if err != nil {
+		return nil, err
+	}
+	if userKey == nil {
+		return nil, ErrNoNamedKey
+	}
+	return userKey, nil
+}
+
+// createNamedKey : Generates a key named keyName for username, who must already have their
+// default key.  limit is the policy with the lowest max_keys attached to them, or nil, and
+// is checked against the default key plus every named key they hold.  The key is escrowed
+// and written before the index lists it, so a failure part way leaves it unlisted, and any
+// escrow made for it is taken back.
+func (b *backend) createNamedKey(ctx context.Context, s logical.Storage, cfg *Config, client *Client, username, keyName string, limit *SigningPolicy) (*NamedKey, *policyDenial, error) {
+	lock := locksutil.LockForKey(b.userLocks, username)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := client.readKeyByUsername(ctx, username); err != nil {
+		return nil, nil, err
+	}
+	namedKeys, err := readNamedKeys(ctx, s, username)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, namedKey := range namedKeys {
+		if namedKey.Name == keyName {
+			return nil, nil, &KeyExistsError{Name: keyName}
+		}
+	}
+	if limit != nil && len(namedKeys)+1 >= limit.MaxKeys {
+		return nil, &policyDenial{
+			Reason: DenyMaxKeysReached,
+			Policy: limit.Name,
+			Detail: fmt.Sprintf("users may hold at most %d keys", limit.MaxKeys)}, nil
+	}
+
+	userKey, err := NewUserKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	name := namedKeyName(username, keyName)
+	oldEscrow, err := b.readEscrowRecord(ctx, s, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := b.escrowKey(ctx, s, cfg, name, userKey); err != nil {
+		return nil, nil, fmt.Errorf("escrowing new key: %v", err)
+	}
+	if err := client.keys.writeKey(ctx, name, userKey); err != nil {
+		b.restoreEscrowRecord(ctx, s, name, oldEscrow)
+		return nil, nil, fmt.Errorf("storing key: %v", err)
+	}
+	namedKey := NamedKey{Name: keyName, Address: userKey.PublicAddressHex, CreatedAt: time.Now().UTC()}
+	if err := writeNamedKeys(ctx, s, username, append(namedKeys, namedKey)); err != nil {
+		if deleteErr := client.keys.deleteKey(ctx, name); deleteErr != nil {
+			b.Logger().Error("unable to remove an unlisted named key", "username", username, "key_name", keyName, "error", deleteErr)
+		}
+		b.restoreEscrowRecord(ctx, s, name, oldEscrow)
+		return nil, nil, err
+	}
+	return &namedKey, nil, nil
+}
+
+// deleteNamedKeys : Removes every named key username holds, along with their escrow and the
+// index, for deleteUser.
+func deleteNamedKeys(ctx context.Context, s logical.Storage, client *Client, username string) error {
+	namedKeys, err := readNamedKeys(ctx, s, username)
+	if err != nil {
+		return err
+	}
+	for _, namedKey := range namedKeys {
+		name := namedKeyName(username, namedKey.Name)
+		if err := client.keys.deleteKey(ctx, name); err != nil {
+			return fmt.Errorf("deleting key %s: %v", namedKey.Name, err)
+		}
+		for _, path := range []string{escrowRecordPath(name), recoveryRecordPath(name)} {
+			if err := s.Delete(ctx, path); err != nil {
+				return err
+			}
+		}
+	}
+	return s.Delete(ctx, namedKeysPath(username))
+}
@@ -0,0 +1,97 @@
+package guardian
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/eximchain/go-ethereum/common/hexutil"
+	"github.com/eximchain/go-ethereum/crypto"
+	"github.com/hashicorp/vault/logical"
+)
+
+func keyRequest(storage logical.Storage, op logical.Operation, keyName string) *logical.Request {
+	return &logical.Request{
+		Operation: op,
+		Path:      "keys/" + keyName,
+		Storage:   storage,
+		EntityID:  "entity-alice",
+		Data:      map[string]interface{}{},
+	}
+}
+
+func TestBackend_NamedKeys(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+	writePolicy(t, b, storage, "two-keys", map[string]interface{}{"users": "*", "max_keys": 2})
+
+	resp, err := b.HandleRequest(ctx, keyRequest(storage, logical.UpdateOperation, "savings"))
+	if err != nil || isError(resp) {
+		t.Fatalf("creating savings failed: %v %#v", err, resp)
+	}
+	savings := resp.Data["address"].(string)
+	if savings == fv.kv["alice"]["publicAddressHex"] || fv.kv["alice/named/savings"] == nil {
+		t.Fatalf("expected a new key stored beside alice's, got %s", savings)
+	}
+
+	refused := map[string]string{"savings": ErrCodeKeyExists, "default": ErrCodeKeyExists, "spending": ErrCodePolicyDenied}
+	for keyName, code := range refused {
+		resp, _ = b.HandleRequest(ctx, keyRequest(storage, logical.UpdateOperation, keyName))
+		if errorCode(resp) != code {
+			t.Errorf("creating %s: expected %s, got %#v", keyName, code, resp)
+		}
+		if code == ErrCodePolicyDenied && errorData(resp)["denial_reason"] != DenyMaxKeysReached {
+			t.Errorf("expected max_keys_reached, got %#v", errorData(resp))
+		}
+	}
+
+	resp, err = b.HandleRequest(ctx, keyRequest(storage, logical.ListOperation, ""))
+	if err != nil || isError(resp) {
+		t.Fatalf("listing keys failed: %v %#v", err, resp)
+	}
+	if keys := resp.Data["keys"].([]string); len(keys) != 2 || keys[0] != DefaultKeyName || keys[1] != "savings" {
+		t.Fatalf("expected default and savings, got %v", keys)
+	}
+	resp, err = b.HandleRequest(ctx, keyRequest(storage, logical.ReadOperation, "savings"))
+	if err != nil || isError(resp) || resp.Data["public_address"] != savings {
+		t.Fatalf("expected to read savings' address %s, got %v %#v", savings, err, resp)
+	}
+
+	// sign signs with the key named, and the default key without one
+	for keyName, want := range map[string]interface{}{"savings": savings, "": fv.kv["alice"]["publicAddressHex"]} {
+		req := signRequest(storage)
+		req.Data["key_name"] = keyName
+		resp, err = b.HandleRequest(ctx, req)
+		if err != nil || isError(resp) {
+			t.Fatalf("signing with %q failed: %v %#v", keyName, err, resp)
+		}
+		sig, _ := hexutil.Decode(resp.Data["signature"].(string))
+		hash, _ := hex.DecodeString(testHash)
+		pub, err := crypto.SigToPub(hash, sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signer := crypto.PubkeyToAddress(*pub).Hex(); signer != want {
+			t.Fatalf("signing with %q: expected %s, recovered %s", keyName, want, signer)
+		}
+	}
+	for keyName, code := range map[string]string{"missing": ErrCodeNotFound, "not a name": ErrCodeInvalidRequest} {
+		req := signRequest(storage)
+		req.Data["key_name"] = keyName
+		if resp, _ = b.HandleRequest(ctx, req); errorCode(resp) != code {
+			t.Errorf("signing with %q: expected %s, got %#v", keyName, code, resp)
+		}
+	}
+
+	// Deleting the user takes their named keys with them
+	if _, err := b.HandleRequest(ctx, userRequest(storage, logical.DeleteOperation, map[string]interface{}{"confirm": "alice"})); err != nil {
+		t.Fatal(err)
+	}
+	if len(fv.kv) != 0 {
+		t.Fatalf("expected every key to be gone, got %v", fv.kv)
+	}
+	if namedKeys, _ := readNamedKeys(ctx, storage, "alice"); len(namedKeys) != 0 {
+		t.Fatalf("expected the index to be gone, got %v", namedKeys)
+	}
+}
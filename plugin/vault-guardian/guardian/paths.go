@@ -3,77 +3,148 @@ package guardian
 import (
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"math/big"
+	"time"
 
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/common/hexutil"
+	"github.com/eximchain/go-ethereum/common/math"
+	"github.com/eximchain/go-ethereum/core/types"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
 
-func cleanErrResp(context string, err error) *logical.Response {
-	if err == nil {
-		return logical.ErrorResponse(context)
+func (b *backend) pathLogin(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	// Fetch login credentials
+	creds := Credentials{
+		Username: data.Get("okta_username").(string),
+		Password: data.Get("okta_password").(string),
+		IDToken:  data.Get("id_token").(string),
+		Passcode: data.Get("passcode").(string),
+		Factor:   data.Get("factor").(string)}
+	transactionID := data.Get("transaction_id").(string)
+
+	cfg, client, err := b.configAndClient(ctx, req.Storage)
+	if err != nil {
+		return b.configAndClientErrResp(req, cfg, err), nil
 	}
-	return logical.ErrorResponse(context + "\n\n" + err.Error())
-}
 
-func readConfigErrResp(err error) *logical.Response {
-	return cleanErrResp("Error reading Config() from Storage: ", err)
-}
+	// Polls of a push already underway are bounded by MFAPushTimeout, everything else
+	// draws on the login budget before reaching the identity provider
+	if transactionID == "" {
+		if limitErr := b.checkLoginRate(req, cfg, creds.Username); limitErr != nil {
+			return rateLimitedResp(req, limitErr), nil
+		}
+	}
 
-func makeClientErrResp(err error) *logical.Response {
-	return cleanErrResp("Error building Client from Config: ", err)
-}
+	// Polling a push which is already underway
+	if transactionID != "" {
+		login, ok := b.mfaLogins.get(transactionID, creds.Username)
+		if !ok {
+			return errorResp(req, ErrCodeUnknownTransaction, "Unknown or expired transaction_id, please login again.", nil), nil
+		}
+		return b.finishPushLogin(ctx, req, cfg, client, transactionID, login, 0)
+	}
 
-func keyFromTokenErrResp(err error) *logical.Response {
-	return cleanErrResp("Failed to load key from token: ", err)
-}
+	if cfg.ProviderName() == ProviderOkta {
+		mfaErr := validateMFA(cfg, creds)
+		if mfaErr == ErrMFARequired {
+			return mfaErrResp(req, mfaStatusRequired, mfaErr.Error(), ""), nil
+		}
+		if mfaErr != nil {
+			return invalidRequestResp(req, mfaErr.Error()), nil
+		}
+		if mfaFactor(creds) == MFAFactorPush {
+			if creds.Username == "" || creds.Password == "" {
+				return invalidRequestResp(req, "okta_username and okta_password are required"), nil
+			}
+			transactionID, login, startErr := b.mfaLogins.start(client, creds)
+			if startErr != nil {
+				return b.internalErrResp(req, ErrCodeUpstreamFailed, "Unable to start MFA push", startErr), nil
+			}
+			return b.finishPushLogin(ctx, req, cfg, client, transactionID, login, MFAPushWait)
+		}
+	}
 
-func (b *backend) pathLogin(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	// Fetch login credentials
-	oktaUser := data.Get("okta_username").(string)
-	oktaPass := data.Get("okta_password").(string)
+	// Check their credentials with the identity provider
+	username, loginErr := client.authenticate(ctx, creds)
+	if loginErr != nil {
+		return b.loginErrResp(req, cfg, loginErr), nil
+	}
+	return b.completeLogin(ctx, req, cfg, client, username)
+}
 
-	cfg, err := b.Config(ctx, req.Storage)
-	if err != nil {
-		return readConfigErrResp(err), err
+// finishPushLogin : Waits up to timeout on a push login, then either completes it or tells
+// the client to poll again with its transaction_id.
+func (b *backend) finishPushLogin(ctx context.Context, req *logical.Request, cfg *Config, client *Client, transactionID string, login *pendingLogin, timeout time.Duration) (*logical.Response, error) {
+	username, finished, loginErr := login.wait(timeout)
+	if !finished {
+		return mfaErrResp(req, mfaStatusPending, "Waiting for the Okta Verify push to be approved, poll again with this transaction_id.", transactionID), nil
 	}
-	client, err := cfg.Client()
-	if err != nil {
-		return makeClientErrResp(err), err
+	if !b.mfaLogins.finish(transactionID) {
+		return errorResp(req, ErrCodeUnknownTransaction, "Unknown or expired transaction_id, please login again.", nil), nil
+	}
+	if loginErr != nil {
+		return b.loginErrResp(req, cfg, loginErr), nil
 	}
+	return b.completeLogin(ctx, req, cfg, client, username)
+}
+
+// loginErrResp : Rejected and timed out pushes, and factors which are not enrolled, get their
+// own mfa_status, anything else is a plain login failure.
+func (b *backend) loginErrResp(req *logical.Request, cfg *Config, loginErr error) *logical.Response {
+	switch loginErr {
+	case ErrMFARejected:
+		return mfaErrResp(req, mfaStatusRejected, "The Okta Verify push was rejected.", "")
+	case ErrMFATimedOut:
+		return mfaErrResp(req, mfaStatusTimedOut, "The Okta Verify push was not answered in time, please login again.", "")
+	case ErrMFANotEnrolled:
+		return mfaErrResp(req, mfaStatusNotEnrolled, "The account has no active factor of the kind given, enroll one with Okta first.", "")
+	}
+	return b.internalErrResp(req, ErrCodeLoginFailed, fmt.Sprintf("Unable to login with %s with the provided credentials", cfg.ProviderName()), loginErr)
+}
 
+// completeLogin : Everything after the user has proven who they are, creating their account
+// on first login and handing back a single-use sign token.
+func (b *backend) completeLogin(ctx context.Context, req *logical.Request, cfg *Config, client *Client, username string) (*logical.Response, error) {
+	if err := validateUsername(username); err != nil {
+		return b.internalErrResp(req, ErrCodeLoginFailed, fmt.Sprintf("Unable to login with %s, the account's username cannot be used", cfg.ProviderName()), err), nil
+	}
 	// Do we have an account for them?
-	newUser, checkErr := client.isNewUser(oktaUser)
+	newUser, checkErr := client.isNewUser(ctx, username)
 	if checkErr != nil {
-		return cleanErrResp(fmt.Sprintf("User check failed, here's conf: %#v", cfg), checkErr), checkErr
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to check whether the user has an account", checkErr), nil
 	}
 	pubAddress := ""
 	if newUser {
-		// Verify it's a real Okta account
-		isOktaUser, oktaCheckErr := client.oktaAccountExists(oktaUser)
-		if oktaCheckErr != nil {
-			return cleanErrResp("Failed to verify whether user's Okta account exists:", oktaCheckErr), oktaCheckErr
+		// Verify it's a real account in the organization
+		isOrgUser, orgCheckErr := client.accountExists(ctx, username)
+		if orgCheckErr != nil {
+			return b.internalErrResp(req, ErrCodeUpstreamFailed, "Failed to verify whether user's account exists", orgCheckErr), nil
 		}
-		if isOktaUser {
+		if isOrgUser {
+			// Another login may have created the key since isNewUser, then this one is not new
 			var createErr error
-			pubAddress, createErr = client.createEnduser(oktaUser)
+			pubAddress, newUser, createErr = b.createUser(ctx, req.Storage, cfg, client, username)
+			if createErr == ErrKeyInEscrow {
+				return errorResp(req, ErrCodeKeyInEscrow, "This account's key is missing but escrowed, ask the maintainers to recover it at guardian/admin/escrow/recover.", nil), nil
+			}
 			if createErr != nil {
-				return cleanErrResp("Error creating user and keys: ", createErr), createErr
+				return b.internalErrResp(req, ErrCodeKeyCreationFailed, "Error creating user and keys", createErr), nil
 			}
 		} else {
-			return cleanErrResp("Username does not belong to Guardian's Okta organization, not creating account.", nil), nil
+			return errorResp(req, ErrCodeNotInOrganization, "Username does not belong to Guardian's organization, not creating account.", nil), nil
 		}
 	}
 
-	// Perform the actual login call, get client_token
-	clientToken, loginErr := client.loginEnduser(oktaUser, oktaPass)
-	if loginErr != nil {
-		return cleanErrResp("Unable to login with Okta with the provided credentials:", loginErr), loginErr
+	// Hand out a single-use sign token in place of a full login token
+	clientToken, tokenErr := b.issueSignToken(ctx, req.Storage, client, cfg, username, cfg.TokenRefreshes())
+	if tokenErr != nil {
+		return b.internalErrResp(req, ErrCodeUpstreamFailed, "Unable to create single-use sign token", tokenErr), nil
 	}
 
-	// This method is prototyped, commenting out while we get core flow working
-	// single_sign_token := client.makeSingleSignToken(oktaUser)
-
 	var respData map[string]interface{}
 	if newUser {
 		respData = map[string]interface{}{
@@ -86,104 +157,1379 @@ func (b *backend) pathLogin(ctx context.Context, req *logical.Request, data *fra
 }
 
 func (b *backend) pathAuthorize(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	secretID, ok := data.GetOk("secret_id")
+	secretID, hasSecretID := data.GetOk("secret_id")
 	cfg, loadCfgErr := b.Config(ctx, req.Storage)
 	if loadCfgErr != nil {
-		return readConfigErrResp(loadCfgErr), loadCfgErr
+		return b.configAndClientErrResp(req, nil, loadCfgErr), nil
+	}
+
+	// Connection settings come first, the SecretID exchange goes over them
+	vaultAddr, ok := data.GetOk("vault_addr")
+	if ok {
+		cfg.VaultAddr = vaultAddr.(string)
+	}
+
+	vaultCACert, ok := data.GetOk("vault_ca_cert")
+	if ok {
+		cfg.VaultCACert = vaultCACert.(string)
+	}
+
+	vaultClientCert, ok := data.GetOk("vault_client_cert")
+	if ok {
+		cfg.VaultClientCert = vaultClientCert.(string)
+	}
+
+	vaultClientKey, ok := data.GetOk("vault_client_key")
+	if ok {
+		cfg.VaultClientKey = vaultClientKey.(string)
+	}
+
+	vaultTLSServerName, ok := data.GetOk("vault_tls_server_name")
+	if ok {
+		cfg.VaultTLSServerName = vaultTLSServerName.(string)
 	}
+
+	vaultNamespace, ok := data.GetOk("vault_namespace")
 	if ok {
-		client, makeClientErr := cfg.Client()
+		cfg.VaultNamespace = vaultNamespace.(string)
+	}
+
+	if validateErr := cfg.validateVaultConnection(); validateErr != nil {
+		return invalidRequestResp(req, "Invalid Vault connection settings: "+validateErr.Error()), nil
+	}
+
+	if hasSecretID {
+		client, makeClientErr := cfg.Client(req.Storage)
 		if makeClientErr != nil {
-			return makeClientErrResp(makeClientErr), makeClientErr
+			return b.configAndClientErrResp(req, cfg, makeClientErr), nil
 		}
 		guardianToken, tokenErr := client.tokenFromSecretID(secretID.(string))
 		if tokenErr != nil {
-			return logical.ErrorResponse("Error fetching token using SecretID: " + tokenErr.Error()), tokenErr
+			return b.internalErrResp(req, ErrCodeUpstreamFailed, "Error fetching token using SecretID", tokenErr), nil
 		}
 		cfg.GuardianToken = guardianToken
 	}
 	if cfg.GuardianToken == "" {
-		return logical.ErrorResponse("secret_id was missing, could not get a guardianToken"), nil
+		return invalidRequestResp(req, "secret_id was missing, could not get a guardianToken"), nil
+	}
+
+	wrappedSecretID, ok := data.GetOk("wrapped_secret_id")
+	if ok && wrappedSecretID.(string) != "" {
+		entry := &logical.StorageEntry{Key: wrappedSecretIDPath, Value: []byte(wrappedSecretID.(string))}
+		if err := req.Storage.Put(ctx, entry); err != nil {
+			return b.internalErrResp(req, ErrCodeStorageFailed, "Error saving the wrapped_secret_id", err), nil
+		}
+	}
+
+	keyStorage, ok := data.GetOk("key_storage")
+	if ok {
+		cfg.KeyStorage = keyStorage.(string)
+	}
+	if mode := cfg.KeyStorageMode(); mode != KeyStorageKV && mode != KeyStoragePlugin {
+		return invalidRequestResp(req, fmt.Sprintf("key_storage must be %q or %q", KeyStorageKV, KeyStoragePlugin)), nil
+	}
+
+	provider, ok := data.GetOk("provider")
+	if ok {
+		cfg.Provider = provider.(string)
 	}
 
 	oktaURL, ok := data.GetOk("okta_url")
 	if ok {
 		cfg.OktaURL = oktaURL.(string)
 	}
-	if cfg.OktaURL == "" {
-		return logical.ErrorResponse("Must provide an okta_url"), nil
-	}
 
 	oktaToken, ok := data.GetOk("okta_token")
 	if ok {
 		cfg.OktaToken = oktaToken.(string)
 	}
-	if cfg.OktaToken == "" {
-		return logical.ErrorResponse("Must provide an okta_token"), nil
+
+	oidcIssuer, ok := data.GetOk("oidc_issuer")
+	if ok {
+		cfg.OIDCIssuer = oidcIssuer.(string)
+	}
+
+	oidcClientID, ok := data.GetOk("oidc_client_id")
+	if ok {
+		cfg.OIDCClientID = oidcClientID.(string)
+	}
+
+	oidcAllowedDomains, ok := data.GetOk("oidc_allowed_domains")
+	if ok {
+		cfg.OIDCAllowedDomains = oidcAllowedDomains.([]string)
+	}
+
+	requireMFA, ok := data.GetOk("require_mfa")
+	if ok {
+		cfg.RequireMFA = requireMFA.(bool)
+	}
+
+	switch cfg.ProviderName() {
+	case ProviderOkta:
+		if cfg.OktaURL == "" {
+			return invalidRequestResp(req, "Must provide an okta_url"), nil
+		}
+		if cfg.OktaToken == "" {
+			return invalidRequestResp(req, "Must provide an okta_token"), nil
+		}
+	case ProviderOIDC:
+		if cfg.OIDCIssuer == "" {
+			cfg.OIDCIssuer = DefaultOIDCIssuer
+		}
+		if cfg.OIDCClientID == "" {
+			return invalidRequestResp(req, "Must provide an oidc_client_id"), nil
+		}
+		if len(cfg.OIDCAllowedDomains) == 0 {
+			return invalidRequestResp(req, "Must provide oidc_allowed_domains, or any account at the issuer could log in"), nil
+		}
+		if cfg.RequireMFA {
+			return invalidRequestResp(req, "require_mfa is only supported with provider=okta, enforce MFA at the OIDC issuer instead"), nil
+		}
+	default:
+		return invalidRequestResp(req, fmt.Sprintf("provider must be %q or %q", ProviderOkta, ProviderOIDC)), nil
+	}
+
+	signTokenTTL, ok := data.GetOk("sign_token_ttl")
+	if ok {
+		cfg.SignTokenTTL = signTokenTTL.(int)
+	}
+	if cfg.SignTokenTTL < 0 {
+		return invalidRequestResp(req, "sign_token_ttl cannot be negative"), nil
+	}
+
+	maxTokenRefreshes, ok := data.GetOk("max_token_refreshes")
+	if ok {
+		refreshes := maxTokenRefreshes.(int)
+		cfg.MaxTokenRefreshes = &refreshes
+	}
+	if cfg.TokenRefreshes() < 0 {
+		return invalidRequestResp(req, "max_token_refreshes cannot be negative"), nil
+	}
+
+	exportDisabled, ok := data.GetOk("export_disabled")
+	if ok {
+		cfg.ExportDisabled = exportDisabled.(bool)
+	}
+
+	escrowThreshold, ok := data.GetOk("escrow_threshold")
+	if ok {
+		cfg.EscrowThreshold = escrowThreshold.(int)
+	}
+	if cfg.EscrowThreshold != 0 && (cfg.EscrowThreshold < 2 || cfg.EscrowThreshold > 255) {
+		return invalidRequestResp(req, "escrow_threshold must be 0 to disable escrow, or between 2 and 255"), nil
+	}
+
+	for field, limit := range map[string]*int{
+		"login_rate_limit":        &cfg.LoginRateLimit,
+		"sign_rate_limit":         &cfg.SignRateLimit,
+		"global_login_rate_limit": &cfg.GlobalLoginRateLimit,
+		"global_sign_rate_limit":  &cfg.GlobalSignRateLimit} {
+		if value, ok := data.GetOk(field); ok {
+			*limit = value.(int)
+		}
+		if *limit < 0 {
+			return invalidRequestResp(req, field+" cannot be negative"), nil
+		}
+	}
+
+	historyRetention, ok := data.GetOk("history_retention")
+	if ok {
+		cfg.HistoryRetention = historyRetention.(int)
+	}
+	if cfg.HistoryRetention < 0 {
+		return invalidRequestResp(req, "history_retention cannot be negative"), nil
+	}
+
+	reconcileInterval, ok := data.GetOk("reconcile_interval")
+	if ok {
+		cfg.ReconcileInterval = reconcileInterval.(int)
+	}
+	if cfg.ReconcileInterval < 0 {
+		return invalidRequestResp(req, "reconcile_interval cannot be negative"), nil
 	}
 
 	jsonCfg, err := logical.StorageEntryJSON("config", cfg)
 	if err != nil {
-		return logical.ErrorResponse("Error making a StorageEntryJSON out of the config: " + err.Error()), err
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error making a StorageEntryJSON out of the config", err), nil
 	}
 	if err := req.Storage.Put(ctx, jsonCfg); err != nil {
-		return logical.ErrorResponse("Error saving the config StorageEntry: " + err.Error()), err
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error saving the config StorageEntry", err), nil
+	}
+	if hasSecretID {
+		// A new token starts with a clean record, the next periodic run fills it in
+		if err := req.Storage.Delete(ctx, tokenStatusPath); err != nil {
+			return b.internalErrResp(req, ErrCodeStorageFailed, "Error resetting the token status", err), nil
+		}
 	}
+	b.invalidateClient()
 
-	return &logical.Response{
-		Data: map[string]interface{}{"newConfig": cfg},
-	}, nil
+	return &logical.Response{Data: configData(cfg)}, nil
 }
 
-func (b *backend) pathSign(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	rawDataStr := data.Get("raw_data")
+func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, loadCfgErr := b.Config(ctx, req.Storage)
+	if loadCfgErr != nil {
+		return b.configAndClientErrResp(req, nil, loadCfgErr), nil
+	}
+	return &logical.Response{Data: configData(cfg)}, nil
+}
 
-	rawDataBytes, decodeErr := hex.DecodeString(rawDataStr.(string))
-	if decodeErr != nil {
-		return logical.ErrorResponse("Unable to decode raw_data string from hex to bytes: " + decodeErr.Error()), decodeErr
+func (b *backend) pathReadAuthorize(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, loadCfgErr := b.Config(ctx, req.Storage)
+	if loadCfgErr != nil {
+		return b.configAndClientErrResp(req, nil, loadCfgErr), nil
+	}
+	status, statusErr := b.readTokenStatus(ctx, req.Storage)
+	if statusErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading the token status", statusErr), nil
+	}
+	wrapped, wrappedErr := req.Storage.Get(ctx, wrappedSecretIDPath)
+	if wrappedErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error checking for a wrapped_secret_id", wrappedErr), nil
+	}
+	respData := map[string]interface{}{
+		"authorized":            cfg.GuardianToken != "",
+		"renewable":             status.Renewable,
+		"renewal_possible":      status.RenewalPossible,
+		"wrapped_secret_id_set": wrapped != nil,
+		"last_error":            status.LastError}
+	if !status.CheckedAt.IsZero() {
+		respData["checked_at"] = status.CheckedAt
+	}
+	if !status.ExpireTime.IsZero() {
+		respData["expire_time"] = status.ExpireTime
+		respData["ttl"] = int64(time.Until(status.ExpireTime).Seconds())
+	}
+	if !status.LastRenewal.IsZero() {
+		respData["last_renewal"] = status.LastRenewal
+	}
+	if !status.LastReauthorize.IsZero() {
+		respData["last_reauthorize"] = status.LastReauthorize
 	}
+	return &logical.Response{Data: respData}, nil
+}
 
+func (b *backend) pathMigrateKeys(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	cfg, loadCfgErr := b.Config(ctx, req.Storage)
 	if loadCfgErr != nil {
-		return readConfigErrResp(loadCfgErr), loadCfgErr
+		return b.configAndClientErrResp(req, nil, loadCfgErr), nil
+	}
+	if cfg.GuardianToken == "" {
+		return errorResp(req, ErrCodeNotConfigured, "Guardian must be authorized before migrating keys", nil), nil
 	}
-	client, makeClientErr := cfg.Client()
+	vault, makeClientErr := vaultClientFromConfig(cfg)
 	if makeClientErr != nil {
-		return makeClientErrResp(makeClientErr), makeClientErr
+		return b.configAndClientErrResp(req, cfg, makeClientErr), nil
 	}
 
-	privKeyHex, readKeyErr := client.readKeyHexByEntityID(req.EntityID)
-	if readKeyErr != nil {
-		return keyFromTokenErrResp(readKeyErr), readKeyErr
+	migrated, skipped, migrateErr := migrateKeys(ctx, &kvKeyStore{vault: vault}, &pluginKeyStore{storage: req.Storage})
+	if migrateErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, fmt.Sprintf("Migration stopped after moving %d keys, key_storage is unchanged", len(migrated)), migrateErr), nil
 	}
-	sigBytes, err := SignWithHexKey(rawDataBytes, privKeyHex)
+
+	cfg.KeyStorage = KeyStoragePlugin
+	jsonCfg, err := logical.StorageEntryJSON("config", cfg)
 	if err != nil {
-		return logical.ErrorResponse("Failed to unmarshall key & sign: " + err.Error()), err
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error making a StorageEntryJSON out of the config", err), nil
 	}
-	sigHex := hex.EncodeToString(sigBytes)
+	if err := req.Storage.Put(ctx, jsonCfg); err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error saving the config StorageEntry", err), nil
+	}
+	b.invalidateClient()
+
 	return &logical.Response{
-		Data: map[string]interface{}{"signature": "0x" + sigHex},
+		Data: map[string]interface{}{
+			"migrated":    migrated,
+			"skipped":     skipped,
+			"key_storage": cfg.KeyStorage},
 	}, nil
 }
 
+func (b *backend) pathSign(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	addressIndex := data.Get("address_index").(int)
+	keyName, keyNameErr := keyNameFromFields(data)
+	if keyNameErr != nil {
+		return invalidRequestResp(req, keyNameErr.Error()), nil
+	}
+	hashBytes, hasMessage, digestErr := digestFromFields(data)
+	if digestErr != nil {
+		return invalidRequestResp(req, digestErr.Error()), nil
+	}
+	// Like personal_sign, message signatures default to a v of 27 or 28
+	defaultFormat := SignatureFormatRaw
+	if hasMessage {
+		defaultFormat = SignatureFormatV27
+	}
+	signatureFormat, formatErr := parseSignatureFormat(data.Get("signature_format").(string), defaultFormat)
+	if formatErr != nil {
+		return invalidRequestResp(req, formatErr.Error()), nil
+	}
+	intent := signIntent{Mode: SignModeRaw}
+	if hasMessage {
+		intent.Mode = SignModeMessage
+	}
+
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+
+	username, userKey, signTokenRecord, readKeyErr := b.keyForRequest(ctx, req, client, cfg, keyName)
+	if limitErr, ok := readKeyErr.(*RateLimitError); ok {
+		return rateLimitedResp(req, limitErr), nil
+	}
+	if disabledErr, ok := readKeyErr.(*AccountDisabledError); ok {
+		return errorResp(req, ErrCodeAccountDisabled, disabledErr.Error(), nil), nil
+	}
+	if readKeyErr != nil {
+		return b.keyErrResp(req, readKeyErr), nil
+	}
+	privKeyHex, deriveErr := userKey.HexKey(addressIndex)
+	if deriveErr != nil {
+		return invalidRequestResp(req, "Unable to derive key for address_index: "+deriveErr.Error()), nil
+	}
+	denial, _, policyErr := b.enforceSigningPolicy(ctx, req.Storage, client, username, intent)
+	if policyErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to check signing policy", policyErr), nil
+	}
+	if denial != nil {
+		return policyDenialResp(req, denial), nil
+	}
+	sigBytes, err := SignWithHexKey(hashBytes, privKeyHex)
+	if err != nil {
+		return b.internalErrResp(req, ErrCodeSignFailed, "Failed to unmarshall key & sign", err), nil
+	}
+	if recordErr := b.recordSignEvent(ctx, req.Storage, newSignEvent(req, username, keyName, addressIndex, hashBytes, intent)); recordErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to record sign event", recordErr), nil
+	}
+	respData := formatSignature(sigBytes, signatureFormat)
+	if hasMessage {
+		respData["hash"] = hexutil.Encode(hashBytes)
+	}
+	return b.signedResponse(ctx, req, client, cfg, signTokenRecord, respData)
+}
+
+func (b *backend) pathSignTransaction(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	addressIndex := data.Get("address_index").(int)
+	keyName, keyNameErr := keyNameFromFields(data)
+	if keyNameErr != nil {
+		return invalidRequestResp(req, keyNameErr.Error()), nil
+	}
+	chainID, ok := math.ParseBig256(data.Get("chain_id").(string))
+	if !ok || chainID.Sign() <= 0 {
+		return invalidRequestResp(req, "chain_id must be a positive number"), nil
+	}
+
+	var tx *types.Transaction
+	var txErr error
+	if rawTx := data.Get("raw_tx").(string); rawTx != "" {
+		rawTxBytes, decodeErr := hexutil.Decode(withHexPrefix(rawTx))
+		if decodeErr != nil {
+			return invalidRequestResp(req, "Unable to decode raw_tx string from hex to bytes: "+decodeErr.Error()), nil
+		}
+		tx, txErr = NewTxFromRLP(rawTxBytes, chainID)
+	} else {
+		tx, txErr = NewTxFromFields(TxFields{
+			Nonce:    data.Get("nonce").(string),
+			GasPrice: data.Get("gas_price").(string),
+			GasLimit: data.Get("gas_limit").(string),
+			To:       data.Get("to").(string),
+			Value:    data.Get("value").(string),
+			Data:     data.Get("data").(string)})
+	}
+	if txErr != nil {
+		return invalidRequestResp(req, "Invalid transaction: "+txErr.Error()), nil
+	}
+	intent := signIntent{
+		Mode:        SignModeTransaction,
+		ChainID:     chainID,
+		Destination: tx.To(),
+		Creation:    tx.To() == nil,
+		Value:       tx.Value()}
+
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+
+	username, userKey, signTokenRecord, readKeyErr := b.keyForRequest(ctx, req, client, cfg, keyName)
+	if limitErr, ok := readKeyErr.(*RateLimitError); ok {
+		return rateLimitedResp(req, limitErr), nil
+	}
+	if disabledErr, ok := readKeyErr.(*AccountDisabledError); ok {
+		return errorResp(req, ErrCodeAccountDisabled, disabledErr.Error(), nil), nil
+	}
+	if readKeyErr != nil {
+		return b.keyErrResp(req, readKeyErr), nil
+	}
+	privKeyHex, deriveErr := userKey.HexKey(addressIndex)
+	if deriveErr != nil {
+		return invalidRequestResp(req, "Unable to derive key for address_index: "+deriveErr.Error()), nil
+	}
+	denial, spend, policyErr := b.enforceSigningPolicy(ctx, req.Storage, client, username, intent)
+	if policyErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to check signing policy", policyErr), nil
+	}
+	if denial != nil {
+		return policyDenialResp(req, denial), nil
+	}
+	signingHash := types.NewEIP155Signer(chainID).Hash(tx)
+	signedTx, signErr := SignTxWithHexKey(tx, chainID, privKeyHex)
+	if signErr != nil {
+		b.releaseSpend(ctx, req.Storage, username, spend)
+		return b.internalErrResp(req, ErrCodeSignFailed, "Failed to sign transaction", signErr), nil
+	}
+	respData, encodeErr := signedTxData(signedTx, chainID)
+	if encodeErr != nil {
+		b.releaseSpend(ctx, req.Storage, username, spend)
+		return b.internalErrResp(req, ErrCodeSignFailed, "Failed to encode signed transaction", encodeErr), nil
+	}
+	if recordErr := b.recordSignEvent(ctx, req.Storage, newSignEvent(req, username, keyName, addressIndex, signingHash.Bytes(), intent)); recordErr != nil {
+		b.releaseSpend(ctx, req.Storage, username, spend)
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to record sign event", recordErr), nil
+	}
+	return b.signedResponse(ctx, req, client, cfg, signTokenRecord, respData)
+}
+
+func (b *backend) pathSignTyped(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	addressIndex := data.Get("address_index").(int)
+	keyName, keyNameErr := keyNameFromFields(data)
+	if keyNameErr != nil {
+		return invalidRequestResp(req, keyNameErr.Error()), nil
+	}
+	var expectedChainID *big.Int
+	if chainIDStr := data.Get("chain_id").(string); chainIDStr != "" {
+		var ok bool
+		if expectedChainID, ok = math.ParseBig256(chainIDStr); !ok {
+			return invalidRequestResp(req, "chain_id must be a number"), nil
+		}
+	}
+	typedData, parseErr := ParseTypedData([]byte(data.Get("typed_data").(string)))
+	if parseErr != nil {
+		return invalidRequestResp(req, parseErr.Error()), nil
+	}
+	if validateErr := typedData.Validate(expectedChainID); validateErr != nil {
+		return invalidRequestResp(req, "Invalid typed_data: "+validateErr.Error()), nil
+	}
+	digest, domainSeparator, messageHash, hashErr := typedData.Digest()
+	if hashErr != nil {
+		return invalidRequestResp(req, "Unable to hash typed_data: "+hashErr.Error()), nil
+	}
+	chainID, _ := typedData.ChainID()
+	intent := signIntent{Mode: SignModeTyped, ChainID: chainID}
+	if verifyingContract, ok := typedData.Domain["verifyingContract"].(string); ok {
+		contract := common.HexToAddress(verifyingContract)
+		intent.Destination = &contract
+	}
+
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+
+	username, userKey, signTokenRecord, readKeyErr := b.keyForRequest(ctx, req, client, cfg, keyName)
+	if limitErr, ok := readKeyErr.(*RateLimitError); ok {
+		return rateLimitedResp(req, limitErr), nil
+	}
+	if disabledErr, ok := readKeyErr.(*AccountDisabledError); ok {
+		return errorResp(req, ErrCodeAccountDisabled, disabledErr.Error(), nil), nil
+	}
+	if readKeyErr != nil {
+		return b.keyErrResp(req, readKeyErr), nil
+	}
+	privKeyHex, deriveErr := userKey.HexKey(addressIndex)
+	if deriveErr != nil {
+		return invalidRequestResp(req, "Unable to derive key for address_index: "+deriveErr.Error()), nil
+	}
+	denial, _, policyErr := b.enforceSigningPolicy(ctx, req.Storage, client, username, intent)
+	if policyErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to check signing policy", policyErr), nil
+	}
+	if denial != nil {
+		return policyDenialResp(req, denial), nil
+	}
+	sigBytes, signErr := SignWithHexKey(digest, privKeyHex)
+	if signErr != nil {
+		return b.internalErrResp(req, ErrCodeSignFailed, "Failed to unmarshall key & sign", signErr), nil
+	}
+	if recordErr := b.recordSignEvent(ctx, req.Storage, newSignEvent(req, username, keyName, addressIndex, digest, intent)); recordErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to record sign event", recordErr), nil
+	}
+	// eth_signTypedData returns v as 27 or 28
+	sigBytes[64] += 27
+	respData := map[string]interface{}{
+		"signature":        hexutil.Encode(sigBytes),
+		"digest":           hexutil.Encode(digest),
+		"domain_separator": hexutil.Encode(domainSeparator),
+		"message_hash":     hexutil.Encode(messageHash),
+		"primary_type":     typedData.PrimaryType,
+		"chain_id":         chainID.String()}
+	return b.signedResponse(ctx, req, client, cfg, signTokenRecord, respData)
+}
+
+// digestFromFields : The hash a sign or verify request is about.  Messages are hashed here,
+// raw_data is taken as given, as long as it is a 32 byte hash.
+func digestFromFields(data *framework.FieldData) (hashBytes []byte, hasMessage bool, err error) {
+	rawDataStr := data.Get("raw_data").(string)
+	message, hasMessage := data.GetOk("message")
+	if !hasMessage {
+		hashBytes, err = hex.DecodeString(rawDataStr)
+		if err != nil {
+			return nil, false, fmt.Errorf("Unable to decode raw_data string from hex to bytes: %v", err)
+		}
+		if len(hashBytes) != 32 {
+			return nil, false, fmt.Errorf("raw_data must be a 32 byte hash, got %d bytes", len(hashBytes))
+		}
+		return hashBytes, false, nil
+	}
+	if rawDataStr != "" {
+		return nil, true, fmt.Errorf("Provide either raw_data or message, not both")
+	}
+	messageBytes, err := decodeMessage(message.(string), data.Get("message_encoding").(string))
+	if err != nil {
+		return nil, true, fmt.Errorf("Unable to decode message: %v", err)
+	}
+	hashBytes, err = MessageHash(data.Get("version").(string), data.Get("validator").(string), messageBytes)
+	return hashBytes, true, err
+}
+
+// signedResponse : Wraps the result of a sign call, along with the fresh_client_token which
+// follows it when the caller's login has refreshes left.
+func (b *backend) signedResponse(ctx context.Context, req *logical.Request, client *Client, cfg *Config, record *signToken, respData map[string]interface{}) (*logical.Response, error) {
+	freshToken, refreshErr := b.refreshSignToken(ctx, req.Storage, client, cfg, record)
+	if refreshErr != nil {
+		return b.internalErrResp(req, ErrCodeUpstreamFailed, "Signed, but unable to create fresh_client_token", refreshErr), nil
+	}
+	if freshToken != "" {
+		respData["fresh_client_token"] = freshToken
+	}
+	return &logical.Response{Data: respData}, nil
+}
+
 func (b *backend) pathGetAddress(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	cfg, loadCfgErr := b.Config(ctx, req.Storage)
-	if loadCfgErr != nil {
-		return readConfigErrResp(loadCfgErr), loadCfgErr
+	addressIndex := data.Get("address_index").(int)
+	keyName, keyNameErr := keyNameFromFields(data)
+	if keyNameErr != nil {
+		return invalidRequestResp(req, keyNameErr.Error()), nil
 	}
-	client, makeClientErr := cfg.Client()
-	if makeClientErr != nil {
-		return makeClientErrResp(makeClientErr), makeClientErr
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	username, signTokenRecord, callerErr := b.callerForRequest(ctx, req, client)
+	if callerErr != nil {
+		return b.callerErrResp(req, callerErr), nil
+	}
+	// Only the default key's addresses are cached
+	pubAddress, publicKey, legacy, cached := b.identities.address(username, addressIndex)
+	if !cached || !isDefaultKey(keyName) {
+		userKey, readKeyErr := readKeyByName(ctx, client, username, keyName)
+		if readKeyErr != nil {
+			return b.keyErrResp(req, readKeyErr), nil
+		}
+		privKeyHex, deriveErr := userKey.HexKey(addressIndex)
+		if deriveErr != nil {
+			return invalidRequestResp(req, "Unable to derive key for address_index: "+deriveErr.Error()), nil
+		}
+		var getAddressErr error
+		pubAddress, getAddressErr = AddressFromHexKey(privKeyHex)
+		if getAddressErr != nil {
+			return b.internalErrResp(req, ErrCodeInternal, "Fail to derive address from private key", getAddressErr), nil
+		}
+		publicKey, getAddressErr = PublicKeyFromHexKey(privKeyHex)
+		if getAddressErr != nil {
+			return b.internalErrResp(req, ErrCodeInternal, "Fail to derive public key from private key", getAddressErr), nil
+		}
+		legacy = userKey.IsLegacy()
+		if isDefaultKey(keyName) {
+			b.identities.setAddress(username, addressIndex, pubAddress, publicKey, legacy)
+		}
+	}
+	compressedPublicKey, compressErr := CompressPublicKey(publicKey)
+	if compressErr != nil {
+		return b.internalErrResp(req, ErrCodeInternal, "Fail to compress public key", compressErr), nil
+	}
+	respData := map[string]interface{}{
+		"public_address":        pubAddress,
+		"public_key":            publicKey,
+		"compressed_public_key": compressedPublicKey,
+		"address_index":         addressIndex,
+		"legacy":                legacy}
+	if !isDefaultKey(keyName) {
+		respData["key_name"] = keyName
+	}
+	freshToken, refreshErr := b.refreshSignToken(ctx, req.Storage, client, cfg, signTokenRecord)
+	if refreshErr != nil {
+		return b.internalErrResp(req, ErrCodeUpstreamFailed, "Unable to create fresh_client_token", refreshErr), nil
+	}
+	if freshToken != "" {
+		respData["fresh_client_token"] = freshToken
+	}
+	return &logical.Response{Data: respData}, nil
+}
+
+func (b *backend) pathVerify(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	addressIndex := data.Get("address_index").(int)
+	keyName, keyNameErr := keyNameFromFields(data)
+	if keyNameErr != nil {
+		return invalidRequestResp(req, keyNameErr.Error()), nil
+	}
+	hashBytes, _, digestErr := digestFromFields(data)
+	if digestErr != nil {
+		return invalidRequestResp(req, digestErr.Error()), nil
+	}
+	sigBytes, decodeErr := hexutil.Decode(withHexPrefix(data.Get("signature").(string)))
+	if decodeErr != nil {
+		return invalidRequestResp(req, "Unable to decode signature string from hex to bytes: "+decodeErr.Error()), nil
+	}
+	publicKey, signer, recoverErr := RecoverSigner(hashBytes, sigBytes)
+	if recoverErr != nil {
+		return invalidRequestResp(req, "Unable to recover the signer: "+recoverErr.Error()), nil
+	}
+	addresses := data.Get("addresses").([]string)
+	for _, address := range addresses {
+		if !common.IsHexAddress(address) {
+			return invalidRequestResp(req, fmt.Sprintf("addresses entry %q is not an address", address)), nil
+		}
+	}
+
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	username, signTokenRecord, callerErr := b.callerForRequest(ctx, req, client)
+	if callerErr != nil {
+		return b.callerErrResp(req, callerErr), nil
 	}
-	privKeyHex, readKeyErr := client.readKeyHexByEntityID(req.EntityID)
+	userKey, readKeyErr := readKeyByName(ctx, client, username, keyName)
 	if readKeyErr != nil {
-		return keyFromTokenErrResp(readKeyErr), readKeyErr
+		return b.keyErrResp(req, readKeyErr), nil
+	}
+	callerAddress, deriveErr := userKey.Address(addressIndex)
+	if deriveErr != nil {
+		return invalidRequestResp(req, "Unable to derive key for address_index: "+deriveErr.Error()), nil
+	}
+
+	// The signer may be the caller, or any of the given addresses
+	matched := ""
+	if callerAddress == signer {
+		matched = signer
+	}
+	for _, address := range addresses {
+		if common.HexToAddress(address).Hex() == signer {
+			matched = signer
+		}
+	}
+	respData := map[string]interface{}{
+		"signer":          signer,
+		"public_key":      publicKey,
+		"valid":           matched != "",
+		"matched_address": matched,
+		"matches_caller":  callerAddress == signer}
+	freshToken, refreshErr := b.refreshSignToken(ctx, req.Storage, client, cfg, signTokenRecord)
+	if refreshErr != nil {
+		return b.internalErrResp(req, ErrCodeUpstreamFailed, "Unable to create fresh_client_token", refreshErr), nil
+	}
+	if freshToken != "" {
+		respData["fresh_client_token"] = freshToken
+	}
+	return &logical.Response{Data: respData}, nil
+}
+
+// callerForRequest : Resolves the caller's username.  Single-use tokens minted by the plugin
+// are resolved through their sign token record, which is consumed and returned; any other
+// token is resolved through its entity, which is cached.
+func (b *backend) callerForRequest(ctx context.Context, req *logical.Request, client *Client) (username string, record *signToken, err error) {
+	record, err = b.consumeSignToken(ctx, req.Storage, req.ClientTokenAccessor)
+	if err != nil {
+		return "", nil, err
+	}
+	if record != nil {
+		return record.Username, record, nil
+	}
+	if username, ok := b.identities.username(req.EntityID); ok {
+		return username, nil, nil
+	}
+	username, err = client.usernameFromEntityID(req.EntityID)
+	if err != nil {
+		return "", nil, err
+	}
+	b.identities.setUsername(req.EntityID, username)
+	return username, nil, nil
+}
+
+// keyForRequest : Loads the caller's key named keyName, their default key when it is empty,
+// along with whatever callerForRequest resolved.
+// Callers over their sign budget get a *RateLimitError before the key is read.  Their
+// single-use token is spent all the same and no other is minted, so they have to log in
+// again.  Disabled users get an *AccountDisabledError instead of their key.
+func (b *backend) keyForRequest(ctx context.Context, req *logical.Request, client *Client, cfg *Config, keyName string) (username string, userKey *UserKey, record *signToken, err error) {
+	username, record, err = b.callerForRequest(ctx, req, client)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if limitErr := b.checkSignRate(req, cfg, username); limitErr != nil {
+		return username, nil, record, limitErr
+	}
+	if activeErr := checkAccountActive(ctx, req.Storage, username); activeErr != nil {
+		return username, nil, record, activeErr
+	}
+	userKey, err = readKeyByName(ctx, client, username, keyName)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return username, userKey, record, nil
+}
+
+func (b *backend) pathHistory(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	query, queryErr := historyQueryFromFields(data)
+	if queryErr != nil {
+		return invalidRequestResp(req, queryErr.Error()), nil
+	}
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	username, signTokenRecord, callerErr := b.callerForRequest(ctx, req, client)
+	if callerErr != nil {
+		return b.callerErrResp(req, callerErr), nil
+	}
+	respData, historyErr := b.historyData(ctx, req.Storage, username, query)
+	if historyErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading sign history", historyErr), nil
+	}
+	freshToken, refreshErr := b.refreshSignToken(ctx, req.Storage, client, cfg, signTokenRecord)
+	if refreshErr != nil {
+		return b.internalErrResp(req, ErrCodeUpstreamFailed, "Unable to create fresh_client_token", refreshErr), nil
+	}
+	if freshToken != "" {
+		respData["fresh_client_token"] = freshToken
+	}
+	return &logical.Response{Data: respData}, nil
+}
+
+func (b *backend) pathAdminHistory(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	query, queryErr := historyQueryFromFields(data)
+	if queryErr != nil {
+		return invalidRequestResp(req, queryErr.Error()), nil
+	}
+	respData, historyErr := b.historyData(ctx, req.Storage, data.Get("user").(string), query)
+	if historyErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading sign history", historyErr), nil
+	}
+	return &logical.Response{Data: respData}, nil
+}
+
+// historyQueryFromFields : The paging and time range fields shared by both history paths.
+func historyQueryFromFields(data *framework.FieldData) (historyQuery, error) {
+	return historyQueryFromData(
+		data.Get("since").(string),
+		data.Get("until").(string),
+		data.Get("after").(string),
+		data.Get("limit").(int))
+}
+
+// historyData : One page of username's events, with next set when there are more.
+func (b *backend) historyData(ctx context.Context, s logical.Storage, username string, query historyQuery) (map[string]interface{}, error) {
+	events, next, err := b.readHistory(ctx, s, username, query)
+	if err != nil {
+		return nil, err
+	}
+	respData := map[string]interface{}{
+		"username": username,
+		"events":   events}
+	if next != "" {
+		respData["next"] = next
+	}
+	return respData, nil
+}
+
+func (b *backend) pathRotate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	username, signTokenRecord, callerErr := b.callerForRequest(ctx, req, client)
+	if callerErr != nil {
+		return b.callerErrResp(req, callerErr), nil
+	}
+	if denied := b.reauthenticate(ctx, req, cfg, client, data, username); denied != nil {
+		return denied, nil
+	}
+	current, previous, rotateErr := b.rotateKey(ctx, req.Storage, cfg, client, username, RotatedByUser, data.Get("reason").(string))
+	if rotateErr == ErrNoKey {
+		return b.keyErrResp(req, rotateErr), nil
+	}
+	if rotateErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to rotate key", rotateErr), nil
+	}
+	respData := map[string]interface{}{
+		"address":          current.Address,
+		"key_version":      current.Version,
+		"previous_address": previous.Address}
+	freshToken, refreshErr := b.refreshSignToken(ctx, req.Storage, client, cfg, signTokenRecord)
+	if refreshErr != nil {
+		return b.internalErrResp(req, ErrCodeUpstreamFailed, "Rotated, but unable to create fresh_client_token", refreshErr), nil
+	}
+	if freshToken != "" {
+		respData["fresh_client_token"] = freshToken
+	}
+	return &logical.Response{Data: respData}, nil
+}
+
+func (b *backend) pathAdminRotate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	username := data.Get("user").(string)
+	current, previous, rotateErr := b.rotateKey(ctx, req.Storage, cfg, client, username, RotatedByMaintainer, data.Get("reason").(string))
+	if rotateErr == ErrNoKey {
+		return b.keyErrResp(req, rotateErr), nil
 	}
-	pubAddress, getAddressErr := AddressFromHexKey(privKeyHex)
-	if getAddressErr != nil {
-		return logical.ErrorResponse("Fail to derive address from private key: " + getAddressErr.Error()), getAddressErr
+	if rotateErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to rotate key", rotateErr), nil
 	}
 	return &logical.Response{
-		Data: map[string]interface{}{"public_address": pubAddress},
+		Data: map[string]interface{}{
+			"username":         username,
+			"address":          current.Address,
+			"key_version":      current.Version,
+			"previous_address": previous.Address},
 	}, nil
 }
+
+func (b *backend) pathExport(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	format := data.Get("format").(string)
+	if format == "" {
+		format = ExportFormatKeystore
+	}
+	passphrase := data.Get("passphrase").(string)
+	addressIndex := data.Get("address_index").(int)
+	switch format {
+	case ExportFormatKeystore:
+		if len(passphrase) < MinKeystorePassphrase {
+			return invalidRequestResp(req, fmt.Sprintf("A keystore export needs a passphrase of at least %d characters", MinKeystorePassphrase)), nil
+		}
+	case ExportFormatMnemonic:
+	default:
+		return invalidRequestResp(req, fmt.Sprintf("format must be %q or %q", ExportFormatKeystore, ExportFormatMnemonic)), nil
+	}
+
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	if cfg.ExportDisabled {
+		return errorResp(req, ErrCodeExportDisabled, "Key export is disabled on this Guardian", nil), nil
+	}
+	username, signTokenRecord, callerErr := b.callerForRequest(ctx, req, client)
+	if callerErr != nil {
+		return b.callerErrResp(req, callerErr), nil
+	}
+	// A disabled user's key stays in the Guardian
+	if activeErr := checkAccountActive(ctx, req.Storage, username); activeErr != nil {
+		if disabledErr, ok := activeErr.(*AccountDisabledError); ok {
+			return errorResp(req, ErrCodeAccountDisabled, disabledErr.Error(), nil), nil
+		}
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to read account", activeErr), nil
+	}
+	if denied := b.reauthenticate(ctx, req, cfg, client, data, username); denied != nil {
+		return denied, nil
+	}
+	userKey, readKeyErr := client.readKeyByUsername(ctx, username)
+	if readKeyErr != nil {
+		return b.keyErrResp(req, readKeyErr), nil
+	}
+
+	var respData map[string]interface{}
+	if format == ExportFormatMnemonic {
+		if userKey.IsLegacy() {
+			return invalidRequestResp(req, "Legacy single-key accounts have no mnemonic, export a keystore instead"), nil
+		}
+		respData = map[string]interface{}{
+			"mnemonic": userKey.Mnemonic,
+			"hd_path":  userKey.HDPath,
+			"address":  userKey.PublicAddressHex}
+	} else {
+		privKeyHex, deriveErr := userKey.HexKey(addressIndex)
+		if deriveErr != nil {
+			return invalidRequestResp(req, "Unable to derive key for address_index: "+deriveErr.Error()), nil
+		}
+		keystore, encryptErr := EncryptKeystoreV3(privKeyHex, passphrase)
+		if encryptErr != nil {
+			return b.internalErrResp(req, ErrCodeInternal, "Unable to encrypt keystore", encryptErr), nil
+		}
+		keystoreJSON, encodeErr := json.Marshal(keystore)
+		if encodeErr != nil {
+			return b.internalErrResp(req, ErrCodeInternal, "Unable to encode keystore", encodeErr), nil
+		}
+		respData = map[string]interface{}{
+			"keystore":      string(keystoreJSON),
+			"address":       common.HexToAddress(keystore.Address).Hex(),
+			"address_index": addressIndex}
+	}
+
+	// Nothing leaves the plugin unless the export is on record
+	if recordErr := b.recordSignEvent(ctx, req.Storage, newExportEvent(req, username, addressIndex, format)); recordErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to record export", recordErr), nil
+	}
+	freshToken, refreshErr := b.refreshSignToken(ctx, req.Storage, client, cfg, signTokenRecord)
+	if refreshErr != nil {
+		return b.internalErrResp(req, ErrCodeUpstreamFailed, "Unable to create fresh_client_token", refreshErr), nil
+	}
+	if freshToken != "" {
+		respData["fresh_client_token"] = freshToken
+	}
+	return &logical.Response{Data: respData}, nil
+}
+
+func (b *backend) pathAddresses(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	username, signTokenRecord, callerErr := b.callerForRequest(ctx, req, client)
+	if callerErr != nil {
+		return b.callerErrResp(req, callerErr), nil
+	}
+	addresses, historyErr := b.addressHistory(ctx, req.Storage, client, username, data.Get("address_index").(int))
+	if historyErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading address history", historyErr), nil
+	}
+	respData := map[string]interface{}{"addresses": addresses}
+	freshToken, refreshErr := b.refreshSignToken(ctx, req.Storage, client, cfg, signTokenRecord)
+	if refreshErr != nil {
+		return b.internalErrResp(req, ErrCodeUpstreamFailed, "Unable to create fresh_client_token", refreshErr), nil
+	}
+	if freshToken != "" {
+		respData["fresh_client_token"] = freshToken
+	}
+	return &logical.Response{Data: respData}, nil
+}
+
+// keyNameFromFields : The key_name a request selects, empty or default for the caller's
+// default key.
+func keyNameFromFields(data *framework.FieldData) (string, error) {
+	keyName := data.Get("key_name").(string)
+	if isDefaultKey(keyName) {
+		return keyName, nil
+	}
+	return keyName, validateKeyName(keyName)
+}
+
+func (b *backend) pathKeyList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	username, signTokenRecord, callerErr := b.callerForRequest(ctx, req, client)
+	if callerErr != nil {
+		return b.callerErrResp(req, callerErr), nil
+	}
+	namedKeys, readErr := readNamedKeys(ctx, req.Storage, username)
+	if readErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading named keys", readErr), nil
+	}
+	names := []string{DefaultKeyName}
+	for _, namedKey := range namedKeys {
+		names = append(names, namedKey.Name)
+	}
+	resp := logical.ListResponse(names)
+	freshToken, refreshErr := b.refreshSignToken(ctx, req.Storage, client, cfg, signTokenRecord)
+	if refreshErr != nil {
+		return b.internalErrResp(req, ErrCodeUpstreamFailed, "Unable to create fresh_client_token", refreshErr), nil
+	}
+	if freshToken != "" {
+		resp.Data["fresh_client_token"] = freshToken
+	}
+	return resp, nil
+}
+
+func (b *backend) pathKeyCreate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	keyName := data.Get("key_name").(string)
+	if isDefaultKey(keyName) {
+		return errorResp(req, ErrCodeKeyExists, "Every user already holds the default key", nil), nil
+	}
+	if nameErr := validateKeyName(keyName); nameErr != nil {
+		return invalidRequestResp(req, nameErr.Error()), nil
+	}
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	username, signTokenRecord, callerErr := b.callerForRequest(ctx, req, client)
+	if callerErr != nil {
+		return b.callerErrResp(req, callerErr), nil
+	}
+	activeErr := checkAccountActive(ctx, req.Storage, username)
+	if disabledErr, ok := activeErr.(*AccountDisabledError); ok {
+		return errorResp(req, ErrCodeAccountDisabled, disabledErr.Error(), nil), nil
+	}
+	if activeErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to read the user's account", activeErr), nil
+	}
+	limit, policyErr := b.keyLimitFor(ctx, req.Storage, client, username)
+	if policyErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to check signing policy", policyErr), nil
+	}
+	namedKey, denial, createErr := b.createNamedKey(ctx, req.Storage, cfg, client, username, keyName, limit)
+	if existsErr, ok := createErr.(*KeyExistsError); ok {
+		return errorResp(req, ErrCodeKeyExists, existsErr.Error(), nil), nil
+	}
+	if createErr == ErrNoKey {
+		return b.keyErrResp(req, createErr), nil
+	}
+	if createErr != nil {
+		return b.internalErrResp(req, ErrCodeKeyCreationFailed, "Unable to create the key", createErr), nil
+	}
+	if denial != nil {
+		return policyDenialResp(req, denial), nil
+	}
+	respData := map[string]interface{}{
+		"key_name":   namedKey.Name,
+		"address":    namedKey.Address,
+		"created_at": namedKey.CreatedAt.Format(time.RFC3339)}
+	freshToken, refreshErr := b.refreshSignToken(ctx, req.Storage, client, cfg, signTokenRecord)
+	if refreshErr != nil {
+		return b.internalErrResp(req, ErrCodeUpstreamFailed, "Created the key, but unable to create fresh_client_token", refreshErr), nil
+	}
+	if freshToken != "" {
+		respData["fresh_client_token"] = freshToken
+	}
+	return &logical.Response{Data: respData}, nil
+}
+
+func (b *backend) pathAdminAddresses(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	username := data.Get("user").(string)
+	addresses, historyErr := b.addressHistory(ctx, req.Storage, client, username, data.Get("address_index").(int))
+	if historyErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading address history", historyErr), nil
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"username":  username,
+			"addresses": addresses},
+	}, nil
+}
+
+func (b *backend) pathUserList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	usernames, listErr := client.keys.listUsernames(ctx)
+	if listErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error listing users", listErr), nil
+	}
+	return logical.ListResponse(usernames), nil
+}
+
+func (b *backend) pathUserRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	details, readErr := b.userDetails(ctx, req.Storage, client, data.Get("user").(string))
+	if readErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading user", readErr), nil
+	}
+	if details == nil {
+		return nil, nil
+	}
+	return &logical.Response{Data: details}, nil
+}
+
+func (b *backend) pathUserWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	username := data.Get("user").(string)
+	status, statusErr := parseUserStatus(data.Get("status").(string))
+	if statusErr != nil {
+		return invalidRequestResp(req, statusErr.Error()), nil
+	}
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	userKey, readKeyErr := client.keys.readKey(ctx, username)
+	if readKeyErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading user", readKeyErr), nil
+	}
+	if userKey == nil {
+		return errorResp(req, ErrCodeUserNotFound, fmt.Sprintf("%s has no Guardian key", username), nil), nil
+	}
+	if _, setErr := setAccountStatus(ctx, req.Storage, username, status, data.Get("reason").(string)); setErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error updating user", setErr), nil
+	}
+	details, readErr := b.userDetails(ctx, req.Storage, client, username)
+	if readErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading user", readErr), nil
+	}
+	return &logical.Response{Data: details}, nil
+}
+
+func (b *backend) pathUserDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	username := data.Get("user").(string)
+	if data.Get("confirm").(string) != username {
+		return invalidRequestResp(req, "Deleting a user destroys their keys; set confirm to their username to go ahead"), nil
+	}
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	if deleteErr := b.deleteUser(ctx, req.Storage, client, username); deleteErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error deleting user", deleteErr), nil
+	}
+	return nil, nil
+}
+
+func (b *backend) pathUserRepair(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	username := data.Get("user").(string)
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	userKey, repaired, repairErr := b.repairUser(ctx, req.Storage, cfg, client, username)
+	if repairErr != nil {
+		return b.internalErrResp(req, ErrCodeUpstreamFailed, fmt.Sprintf("Unable to repair %s, completed: %v", username, repaired), repairErr), nil
+	}
+	respData := map[string]interface{}{
+		"username": username,
+		"has_key":  userKey != nil,
+		"repaired": repaired}
+	if userKey != nil {
+		respData["address"] = userKey.PublicAddressHex
+	}
+	return &logical.Response{Data: respData}, nil
+}
+
+func (b *backend) pathReconcileRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	report, readErr := b.readReconcileReport(ctx, req.Storage)
+	if readErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading reconciliation report", readErr), nil
+	}
+	if report == nil {
+		return nil, nil
+	}
+	return &logical.Response{Data: reconcileReportData(report)}, nil
+}
+
+func (b *backend) pathReconcileRun(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	report, reconcileErr := b.reconcileUsers(ctx, req.Storage)
+	if reconcileErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Unable to reconcile users", reconcileErr), nil
+	}
+	return &logical.Response{Data: reconcileReportData(report)}, nil
+}
+
+func reconcileReportData(report *ReconcileReport) map[string]interface{} {
+	return map[string]interface{}{
+		"started_at":  report.StartedAt,
+		"finished_at": report.FinishedAt,
+		"provider":    report.Provider,
+		"checked":     report.Checked,
+		"suspended":   report.Suspended,
+		"reactivated": report.Reactivated,
+		"errors":      report.Errors}
+}
+
+func (b *backend) pathEscrowMaintainerList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, "escrow/maintainers/")
+	if err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error listing escrow maintainers", err), nil
+	}
+	return logical.ListResponse(names), nil
+}
+
+func (b *backend) pathEscrowMaintainerRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	maintainer, err := b.readEscrowMaintainer(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading escrow maintainer", err), nil
+	}
+	if maintainer == nil {
+		return nil, nil
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"name":        maintainer.Name,
+			"pgp_key":     maintainer.PGPKey,
+			"fingerprint": maintainer.Fingerprint},
+	}, nil
+}
+
+func (b *backend) pathEscrowMaintainerWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	pgpKey := data.Get("pgp_key").(string)
+	entity, parseErr := parsePGPKey(pgpKey)
+	if parseErr != nil {
+		return invalidRequestResp(req, "Invalid pgp_key: "+parseErr.Error()), nil
+	}
+	maintainer := &EscrowMaintainer{Name: name, PGPKey: pgpKey, Fingerprint: pgpFingerprint(entity)}
+	entry, err := logical.StorageEntryJSON(escrowMaintainerPath(name), maintainer)
+	if err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error making a StorageEntryJSON out of the maintainer", err), nil
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error saving the maintainer StorageEntry", err), nil
+	}
+	return &logical.Response{Data: map[string]interface{}{"fingerprint": maintainer.Fingerprint}}, nil
+}
+
+func (b *backend) pathEscrowMaintainerDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, escrowMaintainerPath(data.Get("name").(string))); err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error deleting escrow maintainer", err), nil
+	}
+	return nil, nil
+}
+
+func (b *backend) pathEscrowShares(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	username := data.Get("user").(string)
+	record, err := b.readEscrowRecord(ctx, req.Storage, username)
+	if err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading escrow", err), nil
+	}
+	if record == nil {
+		return nil, nil
+	}
+	shares := make([]map[string]interface{}, 0, len(record.Shares))
+	for _, share := range record.Shares {
+		shares = append(shares, map[string]interface{}{
+			"maintainer":      share.Maintainer,
+			"fingerprint":     share.Fingerprint,
+			"encrypted_share": share.EncryptedShare})
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"username":   username,
+			"address":    record.Address,
+			"threshold":  record.Threshold,
+			"created_at": record.CreatedAt,
+			"shares":     shares},
+	}, nil
+}
+
+func (b *backend) pathEscrowRecover(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	username := data.Get("user").(string)
+	maintainer := data.Get("maintainer").(string)
+	if maintainer == "" || data.Get("share").(string) == "" {
+		return invalidRequestResp(req, "Must provide the maintainer and their decrypted share"), nil
+	}
+	submitted, threshold, recovered, submitErr := b.submitRecoveryShare(ctx, req.Storage, username, maintainer, data.Get("share").(string))
+	if submitErr == ErrNoEscrow {
+		return errorResp(req, ErrCodeNotFound, fmt.Sprintf("No key is escrowed for %s", username), nil), nil
+	}
+	if submitErr != nil {
+		return invalidRequestResp(req, "Unable to accept share: "+submitErr.Error()), nil
+	}
+	respData := map[string]interface{}{
+		"submitted": submitted,
+		"threshold": threshold,
+		"recovered": recovered != nil}
+	if recovered == nil {
+		return &logical.Response{Data: respData}, nil
+	}
+
+	cfg, client, clientErr := b.configAndClient(ctx, req.Storage)
+	if clientErr != nil {
+		return b.configAndClientErrResp(req, cfg, clientErr), nil
+	}
+	if writeErr := client.keys.writeKey(ctx, username, recovered); writeErr != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Rebuilt the key, but unable to restore it", writeErr), nil
+	}
+	b.identities.invalidateUser(username)
+	respData["address"] = recovered.PublicAddressHex
+	return &logical.Response{Data: respData}, nil
+}
+
+func (b *backend) pathEscrowRecoverCancel(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, recoveryRecordPath(data.Get("user").(string))); err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error discarding submitted shares", err), nil
+	}
+	return nil, nil
+}
+
+func (b *backend) pathPolicyList(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, "policies/")
+	if err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error listing signing policies", err), nil
+	}
+	return logical.ListResponse(names), nil
+}
+
+func (b *backend) pathPolicyRead(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	policy, err := b.readPolicy(ctx, req.Storage, data.Get("name").(string))
+	if err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading signing policy", err), nil
+	}
+	if policy == nil {
+		return nil, nil
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"name":              policy.Name,
+			"users":             policy.Users,
+			"groups":            policy.Groups,
+			"allowed_modes":     policy.AllowedModes,
+			"chain_ids":         policy.ChainIDs,
+			"allowed_addresses": policy.AllowedAddresses,
+			"max_value":         policy.MaxValue,
+			"daily_max_value":   policy.DailyMaxValue,
+			"max_keys":          policy.MaxKeys},
+	}, nil
+}
+
+func (b *backend) pathPolicyWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := data.Get("name").(string)
+	policy, err := b.readPolicy(ctx, req.Storage, name)
+	if err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error reading signing policy", err), nil
+	}
+	if policy == nil {
+		policy = &SigningPolicy{Name: name}
+	}
+
+	for field, rule := range map[string]*[]string{
+		"users":             &policy.Users,
+		"groups":            &policy.Groups,
+		"allowed_modes":     &policy.AllowedModes,
+		"chain_ids":         &policy.ChainIDs,
+		"allowed_addresses": &policy.AllowedAddresses} {
+		if value, ok := data.GetOk(field); ok {
+			*rule = value.([]string)
+		}
+	}
+	maxValue, ok := data.GetOk("max_value")
+	if ok {
+		policy.MaxValue = maxValue.(string)
+	}
+	dailyMaxValue, ok := data.GetOk("daily_max_value")
+	if ok {
+		policy.DailyMaxValue = dailyMaxValue.(string)
+	}
+	maxKeys, ok := data.GetOk("max_keys")
+	if ok {
+		policy.MaxKeys = maxKeys.(int)
+	}
+	if validateErr := policy.validate(); validateErr != nil {
+		return invalidRequestResp(req, "Invalid signing policy: "+validateErr.Error()), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(policyPath(name), policy)
+	if err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error making a StorageEntryJSON out of the policy", err), nil
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error saving the policy StorageEntry", err), nil
+	}
+	return nil, nil
+}
+
+func (b *backend) pathPolicyDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, policyPath(data.Get("name").(string))); err != nil {
+		return b.internalErrResp(req, ErrCodeStorageFailed, "Error deleting signing policy", err), nil
+	}
+	return nil, nil
+}
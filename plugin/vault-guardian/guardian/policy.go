@@ -0,0 +1,391 @@
+package guardian
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/common/math"
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	// SignModeRaw : guardian/sign with a raw_data hash, which the plugin cannot inspect.
+	SignModeRaw = "raw"
+	// SignModeMessage : guardian/sign with an EIP-191 message.
+	SignModeMessage = "message"
+	// SignModeTransaction : guardian/sign/transaction.
+	SignModeTransaction = "transaction"
+	// SignModeTyped : guardian/sign/typed.
+	SignModeTyped = "typed"
+
+	// PolicyAllUsers : Listed in a policy's users, attaches it to everyone.
+	PolicyAllUsers = "*"
+
+	// DailySpendWindow : Period the daily_max_value applies over, rolling rather than per calendar day.
+	DailySpendWindow = 24 * time.Hour
+)
+
+// Reasons a sign request was denied by policy, returned as denial_reason.
+const (
+	DenyModeNotAllowed        = "mode_not_allowed"
+	DenyChainIDNotAllowed     = "chain_id_not_allowed"
+	DenyDestinationNotAllowed = "destination_not_allowed"
+	DenyValueExceedsMax       = "value_exceeds_max"
+	DenyDailyValueExceeded    = "daily_value_exceeded"
+	DenyMaxKeysReached        = "max_keys_reached"
+)
+
+var signModes = []string{SignModeRaw, SignModeMessage, SignModeTransaction, SignModeTyped}
+
+//-----------------------------------------
+//  Signing Policies
+//-----------------------------------------
+
+// SigningPolicy : Limits on what the users and Okta groups it is attached to may sign.  Any
+// empty rule is unrestricted, and a user bound by several policies has to satisfy all of them.
+// The one exception is allowed_modes: a policy with chain, destination or value rules only
+// allows the modes those rules can be checked against unless it lists its modes itself.
+type SigningPolicy struct {
+	Name             string   `json:"name"`
+	Users            []string `json:"users"`
+	Groups           []string `json:"groups"`
+	AllowedModes     []string `json:"allowed_modes"`
+	ChainIDs         []string `json:"chain_ids"`
+	AllowedAddresses []string `json:"allowed_addresses"`
+	MaxValue         string   `json:"max_value"`
+	DailyMaxValue    string   `json:"daily_max_value"`
+	MaxKeys          int      `json:"max_keys"`
+}
+
+// signIntent : What a sign request is about to do, as far as the plugin can tell.  Raw
+// hashes and messages have no chain, destination or value.
+type signIntent struct {
+	Mode        string
+	ChainID     *big.Int
+	Destination *common.Address
+	Creation    bool
+	Value       *big.Int
+}
+
+// policyDenial : Why a sign request was refused, and by which policy.
+type policyDenial struct {
+	Reason string
+	Policy string
+	Detail string
+}
+
+// spendEntry : One transaction's value, kept for the rolling daily limit.
+type spendEntry struct {
+	At    time.Time `json:"at"`
+	Value string    `json:"value"`
+}
+
+func policyPath(name string) string {
+	return "policies/" + name
+}
+
+func spendPath(username string) string {
+	return "spend/" + username
+}
+
+// validate : Checks the rule values parse, and normalizes addresses and modes.
+func (p *SigningPolicy) validate() error {
+	for i, mode := range p.AllowedModes {
+		mode = strings.ToLower(mode)
+		if !containsString(signModes, mode) {
+			return fmt.Errorf("allowed_modes must be drawn from %s", strings.Join(signModes, ", "))
+		}
+		p.AllowedModes[i] = mode
+	}
+	for _, chainID := range p.ChainIDs {
+		if parsed, ok := math.ParseBig256(chainID); !ok || parsed.Sign() <= 0 {
+			return fmt.Errorf("chain_ids entry %q is not a positive number", chainID)
+		}
+	}
+	for i, address := range p.AllowedAddresses {
+		if !common.IsHexAddress(address) {
+			return fmt.Errorf("allowed_addresses entry %q is not an address", address)
+		}
+		p.AllowedAddresses[i] = common.HexToAddress(address).Hex()
+	}
+	for field, value := range map[string]string{"max_value": p.MaxValue, "daily_max_value": p.DailyMaxValue} {
+		if value == "" {
+			continue
+		}
+		if parsed, ok := math.ParseBig256(value); !ok || parsed.Sign() < 0 {
+			return fmt.Errorf("%s %q is not a valid amount of wei", field, value)
+		}
+	}
+	if p.MaxKeys < 0 {
+		return fmt.Errorf("max_keys cannot be negative")
+	}
+	return nil
+}
+
+// appliesTo : Whether the policy is attached to username or any of their groups.
+func (p *SigningPolicy) appliesTo(username string, groups []string) bool {
+	if containsString(p.Users, PolicyAllUsers) || containsString(p.Users, username) {
+		return true
+	}
+	for _, group := range groups {
+		if containsString(p.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasStructuredRules : Whether the policy limits chains, destinations or value, which only
+// sign/transaction and sign/typed can be checked against.
+func (p *SigningPolicy) hasStructuredRules() bool {
+	return len(p.ChainIDs) > 0 || len(p.AllowedAddresses) > 0 || p.MaxValue != "" || p.DailyMaxValue != ""
+}
+
+// allowedModes : The modes the policy allows.  Without allowed_modes, a policy with structured
+// rules allows only transaction and typed signing, since a raw hash or message could be the
+// signing hash of a transaction those rules would have refused.
+func (p *SigningPolicy) allowedModes() []string {
+	if len(p.AllowedModes) == 0 && p.hasStructuredRules() {
+		return []string{SignModeTransaction, SignModeTyped}
+	}
+	return p.AllowedModes
+}
+
+// check : The first rule intent breaks, ignoring the daily limit which needs the spend history.
+func (p *SigningPolicy) check(intent signIntent) *policyDenial {
+	deny := func(reason, detail string) *policyDenial {
+		return &policyDenial{Reason: reason, Policy: p.Name, Detail: detail}
+	}
+	if modes := p.allowedModes(); len(modes) > 0 && !containsString(modes, intent.Mode) {
+		return deny(DenyModeNotAllowed, fmt.Sprintf("%s signing is not allowed", intent.Mode))
+	}
+	if len(p.ChainIDs) > 0 && intent.ChainID != nil {
+		allowed := false
+		for _, chainID := range p.ChainIDs {
+			parsed, _ := math.ParseBig256(chainID)
+			allowed = allowed || parsed.Cmp(intent.ChainID) == 0
+		}
+		if !allowed {
+			return deny(DenyChainIDNotAllowed, fmt.Sprintf("chain %s is not allowed", intent.ChainID.String()))
+		}
+	}
+	if len(p.AllowedAddresses) > 0 {
+		if intent.Creation {
+			return deny(DenyDestinationNotAllowed, "contract creation is not allowed")
+		}
+		if intent.Destination == nil && (intent.Mode == SignModeTransaction || intent.Mode == SignModeTyped) {
+			return deny(DenyDestinationNotAllowed, "there is no destination to check against allowed_addresses")
+		}
+		if intent.Destination != nil && !containsString(p.AllowedAddresses, intent.Destination.Hex()) {
+			return deny(DenyDestinationNotAllowed, fmt.Sprintf("%s is not an allowed destination", intent.Destination.Hex()))
+		}
+	}
+	if p.MaxValue != "" && intent.Value != nil {
+		maxValue, _ := math.ParseBig256(p.MaxValue)
+		if intent.Value.Cmp(maxValue) > 0 {
+			return deny(DenyValueExceedsMax, fmt.Sprintf("value exceeds the %s wei limit per transaction", p.MaxValue))
+		}
+	}
+	return nil
+}
+
+// policiesFor : Every stored policy attached to username, directly or through their groups.
+func (b *backend) policiesFor(ctx context.Context, s logical.Storage, client *Client, username string) ([]*SigningPolicy, error) {
+	names, err := s.List(ctx, "policies/")
+	if err != nil {
+		return nil, err
+	}
+	policies := []*SigningPolicy{}
+	for _, name := range names {
+		policy, err := b.readPolicy(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+		if policy != nil {
+			policies = append(policies, policy)
+		}
+	}
+
+	// Only ask the identity provider for groups when some policy is attached to one
+	var groups []string
+	for _, policy := range policies {
+		if len(policy.Groups) > 0 {
+			if groups, err = b.groupsFor(ctx, client, username); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	applicable := []*SigningPolicy{}
+	for _, policy := range policies {
+		if policy.appliesTo(username, groups) {
+			applicable = append(applicable, policy)
+		}
+	}
+	return applicable, nil
+}
+
+// keyLimitFor : The policy with the lowest max_keys attached to username, or nil when none
+// of their policies limits how many keys they may hold.
+func (b *backend) keyLimitFor(ctx context.Context, s logical.Storage, client *Client, username string) (*SigningPolicy, error) {
+	policies, err := b.policiesFor(ctx, s, client, username)
+	if err != nil {
+		return nil, err
+	}
+	var limit *SigningPolicy
+	for _, policy := range policies {
+		if policy.MaxKeys > 0 && (limit == nil || policy.MaxKeys < limit.MaxKeys) {
+			limit = policy
+		}
+	}
+	return limit, nil
+}
+
+// groupsFor : username's groups, cached alongside the rest of their identity.
+func (b *backend) groupsFor(ctx context.Context, client *Client, username string) ([]string, error) {
+	if groups, ok := b.identities.groups(username); ok {
+		return groups, nil
+	}
+	groups, err := client.groupsForUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	b.identities.setGroups(username, groups)
+	return groups, nil
+}
+
+// enforceSigningPolicy : Checks intent against every policy bound to username.  A value
+// which passes is reserved against the daily limit straight away, so concurrent requests
+// cannot both slip under it, and the reservation is returned for releaseSpend should the
+// signature then fail.
+func (b *backend) enforceSigningPolicy(ctx context.Context, s logical.Storage, client *Client, username string, intent signIntent) (*policyDenial, *spendEntry, error) {
+	policies, err := b.policiesFor(ctx, s, client, username)
+	if err != nil {
+		return nil, nil, err
+	}
+	dailyLimited := false
+	for _, policy := range policies {
+		if denial := policy.check(intent); denial != nil {
+			return denial, nil, nil
+		}
+		dailyLimited = dailyLimited || policy.DailyMaxValue != ""
+	}
+	if !dailyLimited || intent.Value == nil || intent.Value.Sign() == 0 {
+		return nil, nil, nil
+	}
+
+	b.spendLock.Lock()
+	defer b.spendLock.Unlock()
+	entries, spent, err := b.recentSpend(ctx, s, username)
+	if err != nil {
+		return nil, nil, err
+	}
+	total := new(big.Int).Add(spent, intent.Value)
+	for _, policy := range policies {
+		if policy.DailyMaxValue == "" {
+			continue
+		}
+		dailyMax, _ := math.ParseBig256(policy.DailyMaxValue)
+		if total.Cmp(dailyMax) > 0 {
+			return &policyDenial{
+				Reason: DenyDailyValueExceeded,
+				Policy: policy.Name,
+				Detail: fmt.Sprintf("%s wei already sent in the last 24 hours, the limit is %s", spent.String(), policy.DailyMaxValue)}, nil, nil
+		}
+	}
+	spend := spendEntry{At: time.Now().UTC(), Value: intent.Value.String()}
+	if err := writeSpend(ctx, s, username, append(entries, spend)); err != nil {
+		return nil, nil, err
+	}
+	return nil, &spend, nil
+}
+
+// releaseSpend : Takes back a value enforceSigningPolicy reserved for a signature which was
+// never produced.  spend may be nil, when nothing was reserved.  Failing to release it only
+// leaves the limit stricter than it should be, so that is logged rather than returned.
+func (b *backend) releaseSpend(ctx context.Context, s logical.Storage, username string, spend *spendEntry) {
+	if spend == nil {
+		return
+	}
+	b.spendLock.Lock()
+	defer b.spendLock.Unlock()
+	entries, _, err := b.recentSpend(ctx, s, username)
+	if err == nil {
+		for i, entry := range entries {
+			if entry.At.Equal(spend.At) && entry.Value == spend.Value {
+				err = writeSpend(ctx, s, username, append(entries[:i], entries[i+1:]...))
+				break
+			}
+		}
+	}
+	if err != nil {
+		b.Logger().Error("unable to release the spend reserved for a failed signature", "username", username, "error", err)
+	}
+}
+
+func writeSpend(ctx context.Context, s logical.Storage, username string, entries []spendEntry) error {
+	entry, err := logical.StorageEntryJSON(spendPath(username), entries)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// recentSpend : username's spend entries within the DailySpendWindow, and their total.
+func (b *backend) recentSpend(ctx context.Context, s logical.Storage, username string) ([]spendEntry, *big.Int, error) {
+	entry, err := s.Get(ctx, spendPath(username))
+	if err != nil {
+		return nil, nil, err
+	}
+	total := new(big.Int)
+	if entry == nil {
+		return nil, total, nil
+	}
+	var entries []spendEntry
+	if err := entry.DecodeJSON(&entries); err != nil {
+		return nil, nil, err
+	}
+	cutoff := time.Now().Add(-DailySpendWindow)
+	recent := []spendEntry{}
+	for _, spend := range entries {
+		if spend.At.Before(cutoff) {
+			continue
+		}
+		value, _ := math.ParseBig256(spend.Value)
+		total.Add(total, value)
+		recent = append(recent, spend)
+	}
+	return recent, total, nil
+}
+
+func (b *backend) readPolicy(ctx context.Context, s logical.Storage, name string) (*SigningPolicy, error) {
+	entry, err := s.Get(ctx, policyPath(name))
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var policy SigningPolicy
+	if err := entry.DecodeJSON(&policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// policyDenialResp : Error response carrying a machine-readable denial_reason.
+func policyDenialResp(req *logical.Request, denial *policyDenial) *logical.Response {
+	return errorResp(req, ErrCodePolicyDenied, "Denied by signing policy: "+denial.Detail, map[string]interface{}{
+		"denial_reason": denial.Reason,
+		"policy":        denial.Policy})
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
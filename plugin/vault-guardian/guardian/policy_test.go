@@ -0,0 +1,203 @@
+package guardian
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/hashicorp/vault/logical"
+)
+
+// groupProvider : An identity provider which only knows alice's groups.
+type groupProvider struct {
+	pushProvider
+	groups map[string][]string
+}
+
+func (p *groupProvider) Groups(ctx context.Context, username string) ([]string, error) {
+	return p.groups[username], nil
+}
+
+func writePolicy(t *testing.T, b *backend, storage logical.Storage, name string, data map[string]interface{}) {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "admin/policies/" + name,
+		Storage:   storage,
+		Data:      data,
+	})
+	if err != nil || isError(resp) {
+		t.Fatalf("writing policy %s failed: %v %#v", name, err, resp)
+	}
+}
+
+func transactionRequest(storage logical.Storage, to, value string) *logical.Request {
+	return &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "sign/transaction",
+		Storage:   storage,
+		EntityID:  "entity-alice",
+		Data: map[string]interface{}{
+			"chain_id":  "1",
+			"gas_limit": "21000",
+			"to":        to,
+			"value":     value},
+	}
+}
+
+func TestSigningPolicy_Check(t *testing.T) {
+	allowed := common.HexToAddress(eip155TxRecipient)
+	other := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	policy := &SigningPolicy{
+		Name:             "treasury",
+		AllowedModes:     []string{SignModeTransaction},
+		ChainIDs:         []string{"1", "0x3"},
+		AllowedAddresses: []string{eip155TxRecipient},
+		MaxValue:         "1000"}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]struct {
+		intent signIntent
+		reason string
+	}{
+		"allowed":      {signIntent{Mode: SignModeTransaction, ChainID: big.NewInt(3), Destination: &allowed, Value: big.NewInt(1000)}, ""},
+		"raw":          {signIntent{Mode: SignModeRaw}, DenyModeNotAllowed},
+		"wrong chain":  {signIntent{Mode: SignModeTransaction, ChainID: big.NewInt(4), Destination: &allowed}, DenyChainIDNotAllowed},
+		"wrong to":     {signIntent{Mode: SignModeTransaction, ChainID: big.NewInt(1), Destination: &other}, DenyDestinationNotAllowed},
+		"creation":     {signIntent{Mode: SignModeTransaction, ChainID: big.NewInt(1), Creation: true}, DenyDestinationNotAllowed},
+		"too valuable": {signIntent{Mode: SignModeTransaction, ChainID: big.NewInt(1), Destination: &allowed, Value: big.NewInt(1001)}, DenyValueExceedsMax},
+	}
+	for name, c := range cases {
+		denial := policy.check(c.intent)
+		switch {
+		case c.reason == "" && denial != nil:
+			t.Errorf("%s: expected no denial, got %#v", name, denial)
+		case c.reason != "" && (denial == nil || denial.Reason != c.reason):
+			t.Errorf("%s: expected %s, got %#v", name, c.reason, denial)
+		}
+	}
+
+	// Structured rules without allowed_modes leave nothing to sign blind
+	contracts := &SigningPolicy{Name: "contracts", AllowedAddresses: []string{eip155TxRecipient}}
+	if err := contracts.validate(); err != nil {
+		t.Fatal(err)
+	}
+	contractCases := map[string]struct {
+		intent signIntent
+		reason string
+	}{
+		"transaction":      {signIntent{Mode: SignModeTransaction, ChainID: big.NewInt(1), Destination: &allowed}, ""},
+		"typed":            {signIntent{Mode: SignModeTyped, ChainID: big.NewInt(1), Destination: &allowed}, ""},
+		"raw":              {signIntent{Mode: SignModeRaw}, DenyModeNotAllowed},
+		"message":          {signIntent{Mode: SignModeMessage}, DenyModeNotAllowed},
+		"typed, no domain": {signIntent{Mode: SignModeTyped, ChainID: big.NewInt(1)}, DenyDestinationNotAllowed},
+	}
+	for name, c := range contractCases {
+		denial := contracts.check(c.intent)
+		switch {
+		case c.reason == "" && denial != nil:
+			t.Errorf("%s: expected no denial, got %#v", name, denial)
+		case c.reason != "" && (denial == nil || denial.Reason != c.reason):
+			t.Errorf("%s: expected %s, got %#v", name, c.reason, denial)
+		}
+	}
+
+	for _, invalid := range []*SigningPolicy{
+		{AllowedModes: []string{"everything"}},
+		{ChainIDs: []string{"0"}},
+		{AllowedAddresses: []string{"0x1234"}},
+		{MaxValue: "-1"},
+	} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("expected %#v to be invalid", invalid)
+		}
+	}
+}
+
+func TestBackend_SigningPolicy(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+
+	// Without a policy, anything goes
+	if resp, err := b.HandleRequest(ctx, signRequest(storage)); err != nil || isError(resp) {
+		t.Fatalf("expected unrestricted signing, got %v %#v", err, resp)
+	}
+
+	writePolicy(t, b, storage, "everyone", map[string]interface{}{
+		"users":           "*",
+		"allowed_modes":   "transaction,typed",
+		"chain_ids":       "1",
+		"max_value":       "600",
+		"daily_max_value": "1000"})
+
+	resp, _ := b.HandleRequest(ctx, signRequest(storage))
+	if resp == nil || errorData(resp)["denial_reason"] != DenyModeNotAllowed || errorData(resp)["policy"] != "everyone" {
+		t.Fatalf("expected raw signing to be denied, got %#v", resp)
+	}
+	resp, _ = b.HandleRequest(ctx, transactionRequest(storage, eip155TxRecipient, "700"))
+	if resp == nil || errorData(resp)["denial_reason"] != DenyValueExceedsMax {
+		t.Fatalf("expected the per-transaction limit to apply, got %#v", resp)
+	}
+	resp, err := b.HandleRequest(ctx, transactionRequest(storage, eip155TxRecipient, "600"))
+	if err != nil || isError(resp) {
+		t.Fatalf("expected a transaction within limits to sign, got %v %#v", err, resp)
+	}
+	resp, _ = b.HandleRequest(ctx, transactionRequest(storage, eip155TxRecipient, "500"))
+	if resp == nil || errorData(resp)["denial_reason"] != DenyDailyValueExceeded {
+		t.Fatalf("expected the rolling daily limit to apply, got %#v", resp)
+	}
+	// A value reserved for a signature which then failed is given back
+	_, client, err := b.configAndClient(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := common.HexToAddress(eip155TxRecipient)
+	denial, spend, err := b.enforceSigningPolicy(ctx, storage, client, "alice", signIntent{Mode: SignModeTransaction, ChainID: big.NewInt(1), Destination: &recipient, Value: big.NewInt(400)})
+	if err != nil || denial != nil || spend == nil {
+		t.Fatalf("expected 400 wei to be reserved, got %#v %#v %v", denial, spend, err)
+	}
+	b.releaseSpend(ctx, storage, "alice", spend)
+	resp, err = b.HandleRequest(ctx, transactionRequest(storage, eip155TxRecipient, "400"))
+	if err != nil || isError(resp) {
+		t.Fatalf("expected a transaction within the daily limit to sign, got %v %#v", err, resp)
+	}
+
+	read, err := b.HandleRequest(ctx, &logical.Request{Operation: logical.ReadOperation, Path: "admin/policies/everyone", Storage: storage})
+	if err != nil || read == nil || read.Data["daily_max_value"] != "1000" {
+		t.Fatalf("expected to read the policy back, got %v %#v", err, read)
+	}
+	list, err := b.HandleRequest(ctx, &logical.Request{Operation: logical.ListOperation, Path: "admin/policies/", Storage: storage})
+	if err != nil || len(list.Data["keys"].([]string)) != 1 {
+		t.Fatalf("expected one policy listed, got %v %#v", err, list)
+	}
+}
+
+func TestBackend_SigningPolicyByGroup(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+	_, client, err := b.configAndClient(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.identity = &groupProvider{groups: map[string][]string{"alice": {"interns"}}}
+
+	writePolicy(t, b, storage, "interns", map[string]interface{}{
+		"groups":            "interns",
+		"allowed_addresses": "0x0000000000000000000000000000000000000001"})
+	writePolicy(t, b, storage, "auditors", map[string]interface{}{
+		"groups":        "auditors",
+		"allowed_modes": "typed"})
+
+	resp, _ := b.HandleRequest(ctx, transactionRequest(storage, eip155TxRecipient, "1"))
+	if resp == nil || errorData(resp)["denial_reason"] != DenyDestinationNotAllowed || errorData(resp)["policy"] != "interns" {
+		t.Fatalf("expected the interns policy to deny the destination, got %#v", resp)
+	}
+	resp, err = b.HandleRequest(ctx, transactionRequest(storage, "0x0000000000000000000000000000000000000001", "1"))
+	if err != nil || isError(resp) {
+		t.Fatalf("expected alice not to be bound by the auditors policy, got %v %#v", err, resp)
+	}
+}
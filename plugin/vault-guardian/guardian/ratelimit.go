@@ -0,0 +1,172 @@
+package guardian
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	// DefaultLoginRateLimit : Logins per minute allowed for each username and remote address.
+	DefaultLoginRateLimit = 10
+	// DefaultSignRateLimit : Signatures per minute allowed for each user, entity and remote address.
+	DefaultSignRateLimit = 60
+
+	rateActionLogin = "login"
+	rateActionSign  = "sign"
+	rateKeyGlobal   = "global"
+)
+
+//-----------------------------------------
+//  Rate Limiting
+//-----------------------------------------
+
+// RateLimitError : Returned when a request is over one of its budgets, with how long until
+// the emptiest bucket it drew on has a token again.
+type RateLimitError struct {
+	Action     string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("Too many %s requests, retry after %d seconds", e.Action, e.RetryAfterSeconds())
+}
+
+// RetryAfterSeconds : RetryAfter rounded up, so retrying on time always succeeds.
+func (e *RateLimitError) RetryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// rateLimit : One budget a request draws on, perMinute tokens refilled evenly over a
+// minute.  Buckets hold at most a minute's worth, which is also the burst allowed.
+type rateLimit struct {
+	key       string
+	perMinute int
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter : In-memory token buckets, so each node of a cluster keeps its own counts.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+// take : Draws a token from every bucket in limits, or from none of them if any is empty.
+// A refused request still draws from the buckets it is over, down to a minute's deficit, so
+// a client which keeps retrying stays throttled until it slows down, but it does not eat into
+// the budgets it did have room in.
+func (l *rateLimiter) take(action string, limits []rateLimit) *RateLimitError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	refused := false
+	buckets := make([]*tokenBucket, len(limits))
+	for i, limit := range limits {
+		capacity := float64(limit.perMinute)
+		bucket, ok := l.buckets[limit.key]
+		if !ok {
+			bucket = &tokenBucket{tokens: capacity, updated: now}
+			l.buckets[limit.key] = bucket
+		}
+		refill := now.Sub(bucket.updated).Minutes() * capacity
+		bucket.tokens = math.Min(capacity, bucket.tokens+refill)
+		bucket.updated = now
+		refused = refused || bucket.tokens < 1
+		buckets[i] = bucket
+	}
+	if !refused {
+		for _, bucket := range buckets {
+			bucket.tokens--
+		}
+		return nil
+	}
+	var retryAfter time.Duration
+	for i, bucket := range buckets {
+		if bucket.tokens >= 1 {
+			continue
+		}
+		capacity := float64(limits[i].perMinute)
+		bucket.tokens = math.Max(-capacity, bucket.tokens-1)
+		wait := time.Duration((1 - bucket.tokens) / capacity * float64(time.Minute))
+		if wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	return &RateLimitError{Action: action, RetryAfter: retryAfter}
+}
+
+// tidy : Drops buckets untouched for a minute, which have refilled and hold nothing worth keeping.
+func (l *rateLimiter) tidy() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := time.Now().Add(-time.Minute)
+	for key, bucket := range l.buckets {
+		if bucket.updated.Before(cutoff) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// remoteAddr : The caller's address, when Vault passed one through.
+func remoteAddr(req *logical.Request) string {
+	if req.Connection == nil {
+		return ""
+	}
+	return req.Connection.RemoteAddr
+}
+
+// checkLoginRate : Spends a login token for username and the caller's address, along with
+// the global login budget when one is configured.
+func (b *backend) checkLoginRate(req *logical.Request, cfg *Config, username string) *RateLimitError {
+	perKey := cfg.LoginRateLimitPerMinute()
+	limits := []rateLimit{}
+	if username != "" {
+		limits = append(limits, rateLimit{key: rateActionLogin + "/user/" + username, perMinute: perKey})
+	}
+	if addr := remoteAddr(req); addr != "" {
+		limits = append(limits, rateLimit{key: rateActionLogin + "/addr/" + addr, perMinute: perKey})
+	}
+	if cfg.GlobalLoginRateLimit > 0 {
+		limits = append(limits, rateLimit{key: rateActionLogin + "/" + rateKeyGlobal, perMinute: cfg.GlobalLoginRateLimit})
+	}
+	return b.rateLimits.take(rateActionLogin, limits)
+}
+
+// checkSignRate : Spends a sign token for username, the caller's entity and address, along
+// with the global sign budget when one is configured.
+func (b *backend) checkSignRate(req *logical.Request, cfg *Config, username string) *RateLimitError {
+	perKey := cfg.SignRateLimitPerMinute()
+	limits := []rateLimit{{key: rateActionSign + "/user/" + username, perMinute: perKey}}
+	if req.EntityID != "" {
+		limits = append(limits, rateLimit{key: rateActionSign + "/entity/" + req.EntityID, perMinute: perKey})
+	}
+	if addr := remoteAddr(req); addr != "" {
+		limits = append(limits, rateLimit{key: rateActionSign + "/addr/" + addr, perMinute: perKey})
+	}
+	if cfg.GlobalSignRateLimit > 0 {
+		limits = append(limits, rateLimit{key: rateActionSign + "/" + rateKeyGlobal, perMinute: cfg.GlobalSignRateLimit})
+	}
+	return b.rateLimits.take(rateActionSign, limits)
+}
+
+// rateLimitedResp : Error response carrying retry_after in seconds.
+func rateLimitedResp(req *logical.Request, limitErr *RateLimitError) *logical.Response {
+	return errorResp(req, ErrCodeRateLimited, limitErr.Error(), rateLimitedData(limitErr))
+}
+
+func rateLimitedData(limitErr *RateLimitError) map[string]interface{} {
+	return map[string]interface{}{
+		"rate_limited": true,
+		"retry_after":  limitErr.RetryAfterSeconds()}
+}
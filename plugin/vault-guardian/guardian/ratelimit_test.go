@@ -0,0 +1,130 @@
+package guardian
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestRateLimiter_Concurrent(t *testing.T) {
+	limiter := newRateLimiter()
+	limits := []rateLimit{{key: "sign/user/alice", perMinute: 20}}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed, refused := 0, 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limitErr := limiter.take(rateActionSign, limits)
+			mu.Lock()
+			defer mu.Unlock()
+			if limitErr == nil {
+				allowed++
+				return
+			}
+			refused++
+			if limitErr.RetryAfterSeconds() < 1 || limitErr.RetryAfterSeconds() > 63 {
+				t.Errorf("expected retry after at most a minute's deficit, got %v", limitErr.RetryAfter)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 20 || refused != 80 {
+		t.Fatalf("expected exactly the burst of 20 through, got %d allowed and %d refused", allowed, refused)
+	}
+	// Every refusal counted, until the bucket was a minute in deficit
+	if tokens := limiter.buckets["sign/user/alice"].tokens; tokens > -19 {
+		t.Fatalf("expected the refusals to leave alice's bucket a minute in deficit, got %v", tokens)
+	}
+
+	// A refusal on one budget does not spend the others
+	other := rateLimit{key: "sign/addr/10.0.0.1", perMinute: 20}
+	if limitErr := limiter.take(rateActionSign, append(limits, other)); limitErr == nil {
+		t.Fatal("expected alice's empty bucket to refuse the request")
+	}
+	if limiter.buckets[other.key].tokens != 20 {
+		t.Fatalf("expected the address bucket to be untouched, got %v", limiter.buckets[other.key].tokens)
+	}
+}
+
+func TestBackend_LoginRateLimit(t *testing.T) {
+	b, storage, _, closeServer := newPushBackend(t, false)
+	defer closeServer()
+	ctx := context.Background()
+	cfg, _, _ := b.configAndClient(ctx, storage)
+	cfg.LoginRateLimit = 2
+
+	for i := 0; i < 2; i++ {
+		if resp, err := b.HandleRequest(ctx, loginRequest(storage, map[string]interface{}{})); err != nil || isError(resp) {
+			t.Fatalf("login %d failed: %v %#v", i, err, resp)
+		}
+	}
+	resp, err := b.HandleRequest(ctx, loginRequest(storage, map[string]interface{}{}))
+	if err != nil || resp == nil || errorData(resp)["rate_limited"] != true || errorData(resp)["retry_after"].(float64) < 1 {
+		t.Fatalf("expected the third login to be rate limited, got %v %#v", err, resp)
+	}
+
+	// The same address is limited across usernames
+	fromAddr := func(username string) *logical.Request {
+		req := loginRequest(storage, map[string]interface{}{})
+		req.Data["okta_username"] = username
+		req.Connection = &logical.Connection{RemoteAddr: "10.0.0.1"}
+		return req
+	}
+	for _, username := range []string{"bob", "carol"} {
+		if resp, err := b.HandleRequest(ctx, fromAddr(username)); err != nil || isError(resp) {
+			t.Fatalf("login as %s failed: %v %#v", username, err, resp)
+		}
+	}
+	resp, _ = b.HandleRequest(ctx, fromAddr("dave"))
+	if resp == nil || errorData(resp)["rate_limited"] != true {
+		t.Fatalf("expected the address to be rate limited, got %#v", resp)
+	}
+}
+
+func TestBackend_SignRateLimit(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+	cfg, _, _ := b.configAndClient(ctx, storage)
+	cfg.SignRateLimit = 3
+
+	for i := 0; i < 3; i++ {
+		if resp, err := b.HandleRequest(ctx, signRequest(storage)); err != nil || isError(resp) {
+			t.Fatalf("sign %d failed: %v %#v", i, err, resp)
+		}
+	}
+	// Made with a single-use token which could still be refreshed
+	entry, err := logical.StorageEntryJSON(signTokenPath("limited"), &signToken{
+		Username:           "alice",
+		RefreshesRemaining: 5,
+		ExpiresAt:          time.Now().Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := b.HandleRequest(ctx, signWithAccessor(storage, "limited"))
+	if err != nil || resp == nil || errorData(resp)["rate_limited"] != true || resp.Data["signature"] != nil {
+		t.Fatalf("expected the fourth sign to be rate limited, got %v %#v", err, resp)
+	}
+	if status := resp.Data[logical.HTTPStatusCode]; status != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %v", status)
+	}
+	if _, ok := errorData(resp)["fresh_client_token"]; ok {
+		t.Fatalf("expected no fresh_client_token to be minted for a refused sign, got %#v", resp)
+	}
+	if records := signTokenRecords(t, storage); len(records) != 0 {
+		t.Fatalf("expected the refused sign to consume its token, got %#v", records)
+	}
+	if keys, _ := storage.List(ctx, historyPrefix("alice")); len(keys) != 3 {
+		t.Fatalf("expected only the three signatures in the history, got %v", keys)
+	}
+}
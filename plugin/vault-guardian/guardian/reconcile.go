@@ -0,0 +1,172 @@
+package guardian
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	// UserStatusSuspended : Reconciliation found the user's account gone from the identity
+	// provider, and blocked them from signing.  Cleared by the next reconciliation which finds
+	// the account active again.
+	UserStatusSuspended = "suspended"
+
+	// DefaultReconcileInterval : How often users are checked against Okta when
+	// reconcile_interval is not configured.
+	DefaultReconcileInterval = time.Hour
+
+	reconcileReportPath = "reconcile/report"
+)
+
+//-----------------------------------------
+//  Identity Reconciliation
+//-----------------------------------------
+
+// StatusProvider : Implemented by identity providers with a directory that tracks whether an
+// account is still live, so users who leave lose signing without waiting out their tokens.
+type StatusProvider interface {
+	// AccountStatus : The directory's status for username, and whether it may keep signing.
+	AccountStatus(ctx context.Context, username string) (status string, active bool, err error)
+}
+
+// ReconcileChange : One user whose status a reconciliation changed.
+type ReconcileChange struct {
+	Username       string `json:"username"`
+	ProviderStatus string `json:"provider_status"`
+}
+
+// ReconcileReport : The outcome of the last reconciliation, read at guardian/admin/reconcile.
+type ReconcileReport struct {
+	StartedAt   time.Time         `json:"started_at"`
+	FinishedAt  time.Time         `json:"finished_at"`
+	Provider    string            `json:"provider"`
+	Checked     int               `json:"checked"`
+	Suspended   []ReconcileChange `json:"suspended"`
+	Reactivated []ReconcileChange `json:"reactivated"`
+	Errors      map[string]string `json:"errors"`
+}
+
+// AccountStatus : Okta's status for the user.  Deprovisioned and suspended accounts, and
+// ones which no longer exist at all, may not sign.
+func (p *oktaProvider) AccountStatus(ctx context.Context, username string) (status string, active bool, err error) {
+	user, resp, err := p.okta.User.GetUser(username, nil)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return "NOT_FOUND", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if user == nil {
+		return "NOT_FOUND", false, nil
+	}
+	switch user.Status {
+	case "DEPROVISIONED", "SUSPENDED":
+		return user.Status, false, nil
+	default:
+		return user.Status, true, nil
+	}
+}
+
+// reconcileUsers : Checks every user with a key against the identity provider, suspending
+// those whose account is no longer live and restoring suspended ones whose account is back.
+// Users a maintainer disabled are left disabled either way.
+func (b *backend) reconcileUsers(ctx context.Context, s logical.Storage) (*ReconcileReport, error) {
+	b.reconcileLock.Lock()
+	defer b.reconcileLock.Unlock()
+	cfg, client, err := b.configAndClient(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	statusProvider, ok := client.identity.(StatusProvider)
+	if !ok {
+		return nil, fmt.Errorf("the %s provider has no directory to reconcile users against", client.identity.Name())
+	}
+	usernames, err := client.keys.listUsernames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(usernames)
+	report := &ReconcileReport{
+		StartedAt:   time.Now().UTC(),
+		Provider:    cfg.ProviderName(),
+		Suspended:   []ReconcileChange{},
+		Reactivated: []ReconcileChange{},
+		Errors:      map[string]string{}}
+	for _, username := range usernames {
+		status, active, err := statusProvider.AccountStatus(ctx, username)
+		if err != nil {
+			report.Errors[username] = err.Error()
+			continue
+		}
+		report.Checked++
+		account, err := readAccount(ctx, s, username)
+		if err != nil {
+			return nil, err
+		}
+		change := ReconcileChange{Username: username, ProviderStatus: status}
+		switch {
+		case !active && account.Status == UserStatusActive:
+			if _, err := setAccountStatus(ctx, s, username, UserStatusSuspended, fmt.Sprintf("%s status is %s", cfg.ProviderName(), status)); err != nil {
+				return nil, err
+			}
+			report.Suspended = append(report.Suspended, change)
+		case active && account.Status == UserStatusSuspended:
+			if _, err := setAccountStatus(ctx, s, username, UserStatusActive, ""); err != nil {
+				return nil, err
+			}
+			report.Reactivated = append(report.Reactivated, change)
+		}
+	}
+	report.FinishedAt = time.Now().UTC()
+	b.lastReconcile = report.FinishedAt
+
+	entry, err := logical.StorageEntryJSON(reconcileReportPath, report)
+	if err != nil {
+		return nil, err
+	}
+	return report, s.Put(ctx, entry)
+}
+
+// reconcileIfDue : Runs reconcileUsers from the PeriodicFunc once per reconcile_interval,
+// when the configured provider has a directory to check.
+func (b *backend) reconcileIfDue(ctx context.Context, s logical.Storage) error {
+	cfg, err := b.Config(ctx, s)
+	if err != nil {
+		return err
+	}
+	if cfg.GuardianToken == "" || cfg.ProviderName() != ProviderOkta {
+		return nil
+	}
+	b.reconcileLock.Lock()
+	due := time.Since(b.lastReconcile) >= cfg.ReconcilePeriod()
+	b.reconcileLock.Unlock()
+	if !due {
+		return nil
+	}
+	report, err := b.reconcileUsers(ctx, s)
+	if err != nil {
+		return err
+	}
+	if len(report.Suspended) > 0 || len(report.Reactivated) > 0 || len(report.Errors) > 0 {
+		b.Logger().Info("reconciled users with identity provider", "checked", report.Checked,
+			"suspended", len(report.Suspended), "reactivated", len(report.Reactivated), "errors", len(report.Errors))
+	}
+	return nil
+}
+
+func (b *backend) readReconcileReport(ctx context.Context, s logical.Storage) (*ReconcileReport, error) {
+	entry, err := s.Get(ctx, reconcileReportPath)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	var report ReconcileReport
+	if err := entry.DecodeJSON(&report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
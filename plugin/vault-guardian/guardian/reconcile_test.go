@@ -0,0 +1,130 @@
+package guardian
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/okta/okta-sdk-golang/okta"
+)
+
+// fakeOktaUsers : Local stand-in for Okta's users API, holding each user's lifecycle status.
+type fakeOktaUsers struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	statuses map[string]string
+}
+
+func newFakeOktaUsers(statuses map[string]string) *fakeOktaUsers {
+	fo := &fakeOktaUsers{statuses: statuses}
+	fo.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fo.mu.Lock()
+		defer fo.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		login := strings.TrimPrefix(r.URL.Path, "/api/v1/users/")
+		status, ok := fo.statuses[login]
+		if r.Method != http.MethodGet || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"errorCode":    "E0000007",
+				"errorSummary": "Not found: Resource not found: " + login + " (User)"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      "00u" + login,
+			"status":  status,
+			"profile": map[string]interface{}{"login": login}})
+	}))
+	return fo
+}
+
+func (fo *fakeOktaUsers) setStatus(login, status string) {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	fo.statuses[login] = status
+}
+
+func (fo *fakeOktaUsers) provider(t *testing.T, fv *fakeVault) *oktaProvider {
+	config := okta.NewConfig().
+		WithOrgUrl(fo.server.URL).
+		WithToken("okta-token").
+		WithCache(false).
+		WithTestingDisableHttpsCheck(true)
+	return &oktaProvider{vault: fv.client(t), okta: okta.NewClient(config, nil, nil)}
+}
+
+func TestBackend_Reconcile(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+	cfg, client, _ := b.configAndClient(ctx, storage)
+	for _, username := range []string{"bob", "carol", "dave", "erin"} {
+		key, err := NewUserKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.keys.writeKey(ctx, username, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := setAccountStatus(ctx, storage, "dave", UserStatusDisabled, "on leave"); err != nil {
+		t.Fatal(err)
+	}
+
+	fo := newFakeOktaUsers(map[string]string{
+		"alice": "ACTIVE",
+		"bob":   "DEPROVISIONED",
+		"carol": "SUSPENDED",
+		"dave":  "DEPROVISIONED"})
+	defer fo.server.Close()
+	cfg.Provider = ProviderOkta
+	client.identity = fo.provider(t, fv)
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{Operation: logical.UpdateOperation, Path: "admin/reconcile", Storage: storage})
+	if err != nil || isError(resp) {
+		t.Fatalf("reconcile failed: %v %#v", err, resp)
+	}
+	if resp.Data["checked"] != 5 {
+		t.Fatalf("expected every user to be checked, got %#v", resp.Data)
+	}
+	suspended := map[string]string{}
+	for _, change := range resp.Data["suspended"].([]ReconcileChange) {
+		suspended[change.Username] = change.ProviderStatus
+	}
+	if len(suspended) != 3 || suspended["bob"] != "DEPROVISIONED" || suspended["carol"] != "SUSPENDED" || suspended["erin"] != "NOT_FOUND" {
+		t.Fatalf("expected bob, carol and erin to be suspended, got %v", suspended)
+	}
+	for username, want := range map[string]string{"alice": UserStatusActive, "bob": UserStatusSuspended, "dave": UserStatusDisabled} {
+		if account, _ := readAccount(ctx, storage, username); account.Status != want {
+			t.Errorf("expected %s to be %s, got %s", username, want, account.Status)
+		}
+	}
+	if _, ok := checkAccountActive(ctx, storage, "bob").(*AccountDisabledError); !ok {
+		t.Fatal("expected a suspended user to be refused keys")
+	}
+
+	// The periodic run restores bob once Okta has him active again
+	fo.setStatus("bob", "ACTIVE")
+	entry, _ := logical.StorageEntryJSON("config", cfg)
+	storage.Put(ctx, entry)
+	b.lastReconcile = b.lastReconcile.Add(-DefaultReconcileInterval)
+	if err := b.reconcileIfDue(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = b.HandleRequest(ctx, &logical.Request{Operation: logical.ReadOperation, Path: "admin/reconcile", Storage: storage})
+	if err != nil || resp == nil {
+		t.Fatalf("reading the report failed: %v", err)
+	}
+	reactivated := resp.Data["reactivated"].([]ReconcileChange)
+	if len(reactivated) != 1 || reactivated[0].Username != "bob" || len(resp.Data["suspended"].([]ReconcileChange)) != 0 {
+		t.Fatalf("expected only bob to be reactivated, got %#v", resp.Data)
+	}
+	if account, _ := readAccount(ctx, storage, "dave"); account.Status != UserStatusDisabled {
+		t.Fatal("expected reconciliation to leave a maintainer's disable alone")
+	}
+}
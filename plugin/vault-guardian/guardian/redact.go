@@ -0,0 +1,265 @@
+package guardian
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	// redactedValue : What a masked secret is replaced with.
+	redactedValue = "[redacted]"
+
+	// minRedactLength : Request fields shorter than this are not masked, since they are too
+	// likely to turn up inside unrelated values by chance.
+	minRedactLength = 8
+)
+
+// keyMaterialFields : Response fields which hold key material.  Only the paths in
+// keyMaterialPaths may send them, everywhere else they are masked.
+var keyMaterialFields = map[string]bool{
+	"mnemonic":     true,
+	"keystore":     true,
+	"privKeyHex":   true,
+	"priv_key_hex": true,
+	"private_key":  true,
+	"seed":         true,
+}
+
+var keyMaterialPaths = map[string]bool{
+	"export": true,
+}
+
+// secretRequestFields : Request fields whose values are masked from that request's response.
+var secretRequestFields = []string{
+	"secret_id",
+	"wrapped_secret_id",
+	"okta_token",
+	"okta_password",
+	"vault_client_key",
+	"passphrase",
+	"share",
+}
+
+//-----------------------------------------
+//  Redaction
+//-----------------------------------------
+
+// plainConfig and plainUserKey : The same fields without the formatting methods below, so
+// those methods can print them without calling themselves.
+type plainConfig Config
+type plainUserKey UserKey
+
+// redacted : A copy of cfg with every secret which is set replaced by redactedValue.
+func (cfg Config) redacted() Config {
+	for _, secret := range []*string{&cfg.GuardianToken, &cfg.OktaToken, &cfg.VaultClientKey} {
+		if *secret != "" {
+			*secret = redactedValue
+		}
+	}
+	return cfg
+}
+
+// GoString : Keeps %#v of a Config, in a log line or an error, from printing its secrets.
+func (cfg Config) GoString() string {
+	return fmt.Sprintf("%#v", plainConfig(cfg.redacted()))
+}
+
+func (cfg Config) String() string {
+	return fmt.Sprintf("%+v", plainConfig(cfg.redacted()))
+}
+
+// secrets : The secret values cfg holds, which must never appear in a response.
+func (cfg *Config) secrets() []string {
+	secrets := []string{}
+	for _, secret := range []string{cfg.GuardianToken, cfg.OktaToken, cfg.VaultClientKey} {
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// GoString : As for Config, a formatted UserKey shows only its address and path.
+func (k UserKey) GoString() string {
+	return fmt.Sprintf("%#v", plainUserKey(k.redacted()))
+}
+
+func (k UserKey) String() string {
+	return fmt.Sprintf("%+v", plainUserKey(k.redacted()))
+}
+
+func (k UserKey) redacted() UserKey {
+	for _, secret := range []*string{&k.Mnemonic, &k.PrivKeyHex} {
+		if *secret != "" {
+			*secret = redactedValue
+		}
+	}
+	return k
+}
+
+// redactor : Masks a fixed set of secret values wherever they appear in a response.
+type redactor struct {
+	secrets       []string
+	keyMaterialOK bool
+}
+
+// redactorFor : Masks the Guardian's config secrets, and the secret fields sent with req.
+func (b *backend) redactorFor(ctx context.Context, req *logical.Request) *redactor {
+	r := &redactor{keyMaterialOK: keyMaterialPaths[req.Path]}
+	b.clientLock.RLock()
+	cfg := b.cfg
+	b.clientLock.RUnlock()
+	if cfg == nil && req.Storage != nil {
+		cfg, _ = b.Config(ctx, req.Storage)
+	}
+	if cfg != nil {
+		r.add(cfg.secrets()...)
+	}
+	for _, field := range secretRequestFields {
+		if value, ok := req.Data[field].(string); ok && len(value) >= minRedactLength {
+			r.add(value)
+		}
+	}
+	return r
+}
+
+// add : Masks each secret as it is, and as it appears inside a JSON string, since error
+// bodies are sent as raw JSON.
+func (r *redactor) add(secrets ...string) {
+	for _, secret := range secrets {
+		r.secrets = append(r.secrets, secret)
+		if encoded, err := json.Marshal(secret); err == nil {
+			if escaped := strings.Trim(string(encoded), `"`); escaped != secret {
+				r.secrets = append(r.secrets, escaped)
+			}
+		}
+	}
+}
+
+func (r *redactor) contains(text string) bool {
+	for _, secret := range r.secrets {
+		if strings.Contains(text, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *redactor) text(text string) string {
+	for _, secret := range r.secrets {
+		text = strings.Replace(text, secret, redactedValue, -1)
+	}
+	return text
+}
+
+// value : Masks secrets inside strings, maps and lists.  Any other value which would
+// carry a secret once encoded is masked whole.
+func (r *redactor) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return r.text(v)
+	case []string:
+		out := make([]string, len(v))
+		for i, item := range v {
+			out[i] = r.text(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = r.value(item)
+		}
+		return out
+	case map[string]interface{}:
+		return r.data(v)
+	case bool, int, int64, float64:
+		return v
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil || r.contains(string(encoded)) {
+			return redactedValue
+		}
+		return v
+	}
+}
+
+func (r *redactor) data(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(data))
+	for field, v := range data {
+		if keyMaterialFields[field] && !r.keyMaterialOK && v != nil {
+			out[field] = redactedValue
+			continue
+		}
+		out[field] = r.value(v)
+	}
+	return out
+}
+
+func (r *redactor) response(resp *logical.Response) *logical.Response {
+	if resp == nil {
+		return nil
+	}
+	resp.Data = r.data(resp.Data)
+	for i, warning := range resp.Warnings {
+		resp.Warnings[i] = r.text(warning)
+	}
+	return resp
+}
+
+// err : Errors are only replaced when they held a secret, so Vault's own sentinel errors
+// still compare equal.
+func (r *redactor) err(err error) error {
+	if err == nil || !r.contains(err.Error()) {
+		return err
+	}
+	return errors.New(r.text(err.Error()))
+}
+
+// HandleRequest : Every response and error leaves the plugin through the redactor, so a
+// secret which reaches one by mistake is masked rather than sent.
+func (b *backend) HandleRequest(ctx context.Context, req *logical.Request) (*logical.Response, error) {
+	resp, err := b.Backend.HandleRequest(ctx, req)
+	r := b.redactorFor(ctx, req)
+	return r.response(resp), r.err(err)
+}
+
+// configData : The config as guardian/config shows it, with each secret reported only as
+// whether it is set.
+func configData(cfg *Config) map[string]interface{} {
+	return map[string]interface{}{
+		"vault_addr":              cfg.VaultAddress(),
+		"vault_ca_cert":           cfg.VaultCACert,
+		"vault_client_cert":       cfg.VaultClientCert,
+		"vault_tls_server_name":   cfg.VaultTLSServerName,
+		"vault_namespace":         cfg.VaultNamespace,
+		"key_storage":             cfg.KeyStorageMode(),
+		"provider":                cfg.ProviderName(),
+		"okta_url":                cfg.OktaURL,
+		"oidc_issuer":             cfg.OIDCIssuer,
+		"oidc_client_id":          cfg.OIDCClientID,
+		"oidc_allowed_domains":    cfg.OIDCAllowedDomains,
+		"require_mfa":             cfg.RequireMFA,
+		"sign_token_ttl":          int64(cfg.TokenTTL().Seconds()),
+		"max_token_refreshes":     cfg.TokenRefreshes(),
+		"history_retention":       cfg.HistoryRetention,
+		"login_rate_limit":        cfg.LoginRateLimitPerMinute(),
+		"sign_rate_limit":         cfg.SignRateLimitPerMinute(),
+		"global_login_rate_limit": cfg.GlobalLoginRateLimit,
+		"global_sign_rate_limit":  cfg.GlobalSignRateLimit,
+		"export_disabled":         cfg.ExportDisabled,
+		"escrow_threshold":        cfg.EscrowThreshold,
+		"reconcile_interval":      int64(cfg.ReconcilePeriod().Seconds()),
+		"guardian_token_set":      cfg.GuardianToken != "",
+		"okta_token_set":          cfg.OktaToken != "",
+		"vault_client_key_set":    cfg.VaultClientKey != ""}
+}
@@ -0,0 +1,84 @@
+package guardian
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_RedactsSecrets(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+	fv.secretIDs["guardian-secret-id"] = "rotated-guardian-token"
+	secrets := []string{"guardian-token", "guardian-secret-id", "okta-api-token-0001"}
+	assertNoSecrets := func(label string, text string) {
+		for _, secret := range secrets {
+			if strings.Contains(text, secret) {
+				t.Errorf("%s: leaked %q in %s", label, secret, text)
+			}
+		}
+	}
+
+	requests := []*logical.Request{
+		{Operation: logical.UpdateOperation, Path: "authorize", Data: map[string]interface{}{
+			"secret_id":  "guardian-secret-id",
+			"okta_token": "okta-api-token-0001"}},
+		{Operation: logical.ReadOperation, Path: "authorize"},
+		{Operation: logical.ReadOperation, Path: "config"},
+		{Operation: logical.UpdateOperation, Path: "authorize", Data: map[string]interface{}{
+			"secret_id": "okta-api-token-0001"}},
+		{Operation: logical.UpdateOperation, Path: "login", Data: map[string]interface{}{"id_token": "not-a-jwt"}},
+		signRequest(storage),
+	}
+	for _, req := range requests {
+		req.Storage = storage
+		if req.EntityID == "" {
+			req.EntityID = "entity-alice"
+		}
+		resp, err := b.HandleRequest(ctx, req)
+		encoded, _ := json.Marshal(resp)
+		assertNoSecrets(req.Path, fmt.Sprintf("%v %s", err, encoded))
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{Operation: logical.ReadOperation, Path: "config", Storage: storage})
+	if err != nil || isError(resp) {
+		t.Fatalf("config read failed: %v %#v", err, resp)
+	}
+	if resp.Data["guardian_token_set"] != true || resp.Data["okta_token_set"] != true || resp.Data["vault_client_key_set"] != false {
+		t.Fatalf("expected config to report which secrets are set, got %#v", resp.Data)
+	}
+	if _, ok := resp.Data["okta_token"]; ok || resp.Data["provider"] != ProviderOIDC {
+		t.Fatalf("expected only non-secret fields, got %#v", resp.Data)
+	}
+
+	// Formatting a Config or key, in a log line or an error, never prints the secrets
+	cfg, err := b.Config(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userKey, err := NewUserKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets = append(secrets, cfg.GuardianToken, userKey.Mnemonic)
+	assertNoSecrets("formatted", fmt.Sprintf("%v %+v %#v %v %#v", cfg, *cfg, cfg, userKey, *userKey))
+
+	// A handler which slips up is still caught on the way out
+	slip := &logical.Response{Data: map[string]interface{}{
+		"error":    fmt.Sprintf("bad config %s", cfg.GuardianToken),
+		"mnemonic": userKey.Mnemonic,
+		"nested":   []interface{}{map[string]interface{}{"token": cfg.GuardianToken}}}}
+	slip = b.redactorFor(ctx, &logical.Request{Path: "sign", Storage: storage}).response(slip)
+	encoded, _ := json.Marshal(slip)
+	assertNoSecrets("slip", string(encoded))
+	kept := b.redactorFor(ctx, &logical.Request{Path: "export", Storage: storage}).response(&logical.Response{
+		Data: map[string]interface{}{"mnemonic": userKey.Mnemonic}})
+	if kept.Data["mnemonic"] != userKey.Mnemonic {
+		t.Fatal("expected export to keep the key material it was asked for")
+	}
+}
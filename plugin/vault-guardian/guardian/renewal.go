@@ -0,0 +1,212 @@
+package guardian
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/helper/parseutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	// ReauthorizeWindow : When a token which cannot be renewed is this close to expiring, the
+	// plugin spends its wrapped SecretID (if it holds one) on a fresh token.
+	ReauthorizeWindow = 10 * time.Minute
+
+	tokenStatusPath      = "token-status"
+	wrappedSecretIDPath  = "reauth/wrapped-secret-id"
+	renewalUnknownReason = "token status has not been checked yet"
+)
+
+//-----------------------------------------
+//  Guardian Token Renewal
+//-----------------------------------------
+
+// tokenStatus : What the periodic renewal last learned about the guardian token.
+type tokenStatus struct {
+	CheckedAt       time.Time `json:"checked_at"`
+	ExpireTime      time.Time `json:"expire_time"`
+	Renewable       bool      `json:"renewable"`
+	RenewalPossible bool      `json:"renewal_possible"`
+	LastRenewal     time.Time `json:"last_renewal"`
+	LastReauthorize time.Time `json:"last_reauthorize"`
+	LastError       string    `json:"last_error"`
+}
+
+// renewGuardianToken : Run from the PeriodicFunc.  Renews the guardian token once half of
+// its TTL is spent, records how long it has left, and falls back to the wrapped SecretID
+// when the token is dead or about to expire without any renewals left.
+func (b *backend) renewGuardianToken(ctx context.Context, s logical.Storage) error {
+	stored, err := b.Config(ctx, s)
+	if err != nil {
+		return err
+	}
+	// Nothing to renew until a maintainer has run authorize
+	if stored.GuardianToken == "" {
+		return nil
+	}
+	cfg, client, err := b.configAndClient(ctx, s)
+	if err != nil {
+		return err
+	}
+	previous, err := b.readTokenStatus(ctx, s)
+	if err != nil {
+		return err
+	}
+	status := &tokenStatus{
+		CheckedAt:       time.Now(),
+		LastRenewal:     previous.LastRenewal,
+		LastReauthorize: previous.LastReauthorize}
+
+	lookup, lookupErr := client.vault.Auth().Token().LookupSelf()
+	if lookupErr != nil || lookup == nil {
+		if lookupErr == nil {
+			lookupErr = fmt.Errorf("token lookup returned no data")
+		}
+		b.Logger().Error("guardian token is no longer usable", "error", lookupErr)
+		status.LastError = lookupErr.Error()
+		return b.reauthorizeOrReport(ctx, s, cfg, status)
+	}
+
+	ttl, err := lookup.TokenTTL()
+	if err != nil {
+		return err
+	}
+	renewable, err := lookup.TokenIsRenewable()
+	if err != nil {
+		return err
+	}
+	creationTTL, err := parseutil.ParseDurationSecond(lookup.Data["creation_ttl"])
+	if err != nil {
+		return err
+	}
+	status.Renewable = renewable
+
+	// Tokens without a TTL never expire, there is nothing to renew
+	if ttl == 0 {
+		status.RenewalPossible = true
+		return b.writeTokenStatus(ctx, s, status)
+	}
+
+	status.ExpireTime = status.CheckedAt.Add(ttl)
+	status.RenewalPossible = renewable
+	if renewable && ttl <= creationTTL/2 {
+		renewed, renewErr := client.vault.Auth().Token().RenewSelf(0)
+		switch {
+		case renewErr != nil:
+			b.Logger().Error("failed to renew guardian token", "error", renewErr)
+			status.LastError = renewErr.Error()
+		case renewed == nil || renewed.Auth == nil:
+			status.LastError = "token renewal returned no auth info"
+		default:
+			newTTL := time.Duration(renewed.Auth.LeaseDuration) * time.Second
+			status.LastRenewal = status.CheckedAt
+			status.ExpireTime = status.CheckedAt.Add(newTTL)
+			// A renewal that cannot extend the TTL means the token has hit its max TTL
+			if newTTL <= ttl {
+				status.RenewalPossible = false
+			}
+		}
+	}
+
+	if !status.RenewalPossible {
+		b.Logger().Warn("guardian token can no longer be renewed, run guardian/authorize before it expires", "expire_time", status.ExpireTime)
+		if time.Until(status.ExpireTime) <= ReauthorizeWindow {
+			return b.reauthorizeOrReport(ctx, s, cfg, status)
+		}
+	}
+	return b.writeTokenStatus(ctx, s, status)
+}
+
+// reauthorizeOrReport : Trades the stored wrapped SecretID for a new guardian token if we
+// have one, otherwise records that a maintainer needs to run authorize.
+func (b *backend) reauthorizeOrReport(ctx context.Context, s logical.Storage, cfg *Config, status *tokenStatus) error {
+	entry, err := s.Get(ctx, wrappedSecretIDPath)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		b.Logger().Error("guardian token cannot be renewed and no wrapped SecretID is stored, a maintainer must run guardian/authorize")
+		return b.writeTokenStatus(ctx, s, status)
+	}
+	// The wrapping token is single-use, so it is gone whether or not this works
+	if err := s.Delete(ctx, wrappedSecretIDPath); err != nil {
+		return err
+	}
+
+	guardianToken, reauthErr := tokenFromWrappedSecretID(cfg, string(entry.Value))
+	if reauthErr != nil {
+		b.Logger().Error("failed to reauthorize from wrapped SecretID", "error", reauthErr)
+		status.LastError = fmt.Sprintf("reauthorization failed: %v", reauthErr)
+		return b.writeTokenStatus(ctx, s, status)
+	}
+
+	// cfg is shared with requests through the cached Client, so the new token goes in a copy
+	updated := *cfg
+	updated.GuardianToken = guardianToken
+	jsonCfg, err := logical.StorageEntryJSON("config", &updated)
+	if err != nil {
+		return err
+	}
+	if err := s.Put(ctx, jsonCfg); err != nil {
+		return err
+	}
+	b.invalidateClient()
+	b.Logger().Info("guardian reauthorized itself from its wrapped SecretID")
+
+	status.LastReauthorize = time.Now()
+	status.LastError = ""
+	status.RenewalPossible = true
+	status.ExpireTime = time.Time{}
+	return b.writeTokenStatus(ctx, s, status)
+}
+
+// tokenFromWrappedSecretID : Unwraps a response-wrapped SecretID and logs in with it.  The
+// unwrap must not carry the old guardian token, which is likely the reason we are here.
+func tokenFromWrappedSecretID(cfg *Config, wrappingToken string) (guardianToken string, err error) {
+	unwrapCfg := *cfg
+	unwrapCfg.GuardianToken = ""
+	vault, err := vaultClientFromConfig(&unwrapCfg)
+	if err != nil {
+		return "", err
+	}
+	vault.ClearToken()
+	unwrapped, err := vault.Logical().Unwrap(wrappingToken)
+	if err != nil {
+		return "", err
+	}
+	if unwrapped == nil || unwrapped.Data == nil {
+		return "", fmt.Errorf("wrapped response held no data")
+	}
+	secretID, ok := unwrapped.Data["secret_id"].(string)
+	if !ok || secretID == "" {
+		return "", fmt.Errorf("wrapped response did not contain a secret_id")
+	}
+	gc := &Client{vault: vault}
+	return gc.tokenFromSecretID(secretID)
+}
+
+func (b *backend) readTokenStatus(ctx context.Context, s logical.Storage) (*tokenStatus, error) {
+	entry, err := s.Get(ctx, tokenStatusPath)
+	if err != nil {
+		return nil, err
+	}
+	var status tokenStatus
+	if entry == nil {
+		status.LastError = renewalUnknownReason
+		return &status, nil
+	}
+	if err := entry.DecodeJSON(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (b *backend) writeTokenStatus(ctx context.Context, s logical.Storage, status *tokenStatus) error {
+	entry, err := logical.StorageEntryJSON(tokenStatusPath, status)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
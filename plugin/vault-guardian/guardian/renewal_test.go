@@ -0,0 +1,108 @@
+package guardian
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestRenewGuardianToken(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+
+	// More than half the TTL left: look, but do not renew
+	fv.tokenTTL, fv.creationTTL, fv.maxTTL = 3000, 3600, 7200
+	if err := b.renewGuardianToken(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	status, err := b.readTokenStatus(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.LastRenewal.IsZero() || !status.RenewalPossible {
+		t.Fatalf("expected no renewal yet, got %#v", status)
+	}
+
+	// Past half the TTL: renew
+	fv.tokenTTL = 1000
+	if err := b.renewGuardianToken(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	if status, err = b.readTokenStatus(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	if status.LastRenewal.IsZero() || fv.tokenTTL != 3600 || !status.RenewalPossible {
+		t.Fatalf("expected a renewal back to 3600s, got ttl %d and %#v", fv.tokenTTL, status)
+	}
+
+	// Up against max TTL: the renewal cannot extend it any further
+	fv.tokenTTL, fv.maxTTL = 1000, 1000
+	if err := b.renewGuardianToken(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	if status, err = b.readTokenStatus(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	if status.RenewalPossible {
+		t.Fatalf("expected renewal to be reported impossible at max TTL, got %#v", status)
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "authorize",
+		Storage:   storage,
+	})
+	if err != nil || isError(resp) {
+		t.Fatalf("authorize read failed: %v %#v", err, resp)
+	}
+	if resp.Data["renewal_possible"] != false || resp.Data["wrapped_secret_id_set"] != false {
+		t.Fatalf("unexpected status %#v", resp.Data)
+	}
+	for _, value := range resp.Data {
+		if value == "guardian-token" {
+			t.Fatal("authorize read must not return the guardian token")
+		}
+	}
+}
+
+func TestRenewGuardianToken_ReauthorizesFromWrappedSecretID(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+	fv.revoked = true
+	fv.wrapped["wrapping-token"] = "spare-secret-id"
+	fv.secretIDs["spare-secret-id"] = "replacement-token"
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "authorize",
+		Storage:   storage,
+		Data:      map[string]interface{}{"wrapped_secret_id": "wrapping-token"},
+	})
+	if err != nil || isError(resp) {
+		t.Fatalf("authorize failed: %v %#v", err, resp)
+	}
+
+	if err := b.renewGuardianToken(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := b.Config(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GuardianToken != "replacement-token" {
+		t.Fatalf("expected the plugin to reauthorize itself, token is %q", cfg.GuardianToken)
+	}
+	if entry, _ := storage.Get(ctx, wrappedSecretIDPath); entry != nil {
+		t.Fatal("expected the spent wrapping token to be deleted")
+	}
+	status, err := b.readTokenStatus(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.LastReauthorize.IsZero() || status.LastError != "" {
+		t.Fatalf("expected a clean reauthorization, got %#v", status)
+	}
+}
@@ -0,0 +1,237 @@
+package guardian
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+const (
+	// RotatedByUser : The user rotated their own key through guardian/rotate.
+	RotatedByUser = "user"
+	// RotatedByMaintainer : A maintainer forced the rotation through guardian/admin/rotate.
+	RotatedByMaintainer = "maintainer"
+)
+
+//-----------------------------------------
+//  Key Rotation
+//-----------------------------------------
+
+// KeyVersion : One key a user has held.  Retired keys stay in the keyStore under
+// retiredKeyName, so signatures they made can still be checked against their addresses.
+type KeyVersion struct {
+	Version   int        `json:"version"`
+	Address   string     `json:"address"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+	RetiredBy string     `json:"retired_by,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+}
+
+func keyHistoryPath(username string) string {
+	return "key-history/" + username
+}
+
+// retiredKeyName : Where a retired key lives in the keyStore, alongside the user's current key.
+func retiredKeyName(username string, version int) string {
+	return fmt.Sprintf("%s/retired/%d", username, version)
+}
+
+// readKeyHistory : username's key versions, oldest first.  Users who have never rotated have
+// no stored history, and current becomes their version 1.
+func readKeyHistory(ctx context.Context, s logical.Storage, username string, current *UserKey) ([]KeyVersion, error) {
+	entry, err := s.Get(ctx, keyHistoryPath(username))
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		var history []KeyVersion
+		if err := entry.DecodeJSON(&history); err != nil {
+			return nil, err
+		}
+		return history, nil
+	}
+	if current == nil {
+		return nil, nil
+	}
+	address, err := current.Address(0)
+	if err != nil {
+		return nil, err
+	}
+	return []KeyVersion{{Version: 1, Address: address}}, nil
+}
+
+func writeKeyHistory(ctx context.Context, s logical.Storage, username string, history []KeyVersion) error {
+	entry, err := logical.StorageEntryJSON(keyHistoryPath(username), history)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// rotateKey : Retires username's current key and generates a new one.  The retired copy and
+// the history are written before the new key replaces the old, so a failure part way leaves
+// the user signing with the key their history says is current, and escrowed as it was.
+func (b *backend) rotateKey(ctx context.Context, s logical.Storage, cfg *Config, client *Client, username, rotatedBy, reason string) (current KeyVersion, previous KeyVersion, err error) {
+	b.rotateLock.Lock()
+	defer b.rotateLock.Unlock()
+	oldKey, err := client.readKeyByUsername(ctx, username)
+	if err != nil {
+		return current, previous, err
+	}
+	history, err := readKeyHistory(ctx, s, username, oldKey)
+	if err != nil {
+		return current, previous, err
+	}
+	newKey, err := NewUserKey()
+	if err != nil {
+		return current, previous, err
+	}
+	oldEscrow, err := b.readEscrowRecord(ctx, s, username)
+	if err != nil {
+		return current, previous, err
+	}
+	if err := b.escrowKey(ctx, s, cfg, username, newKey); err != nil {
+		return current, previous, fmt.Errorf("escrowing new key: %v", err)
+	}
+
+	last := len(history) - 1
+	if err := client.keys.writeKey(ctx, retiredKeyName(username, history[last].Version), oldKey); err != nil {
+		b.restoreEscrowRecord(ctx, s, username, oldEscrow)
+		return current, previous, fmt.Errorf("saving retired key: %v", err)
+	}
+	now := time.Now().UTC()
+	rotated := append([]KeyVersion{}, history...)
+	rotated[last].RetiredAt = &now
+	rotated[last].RetiredBy = rotatedBy
+	rotated[last].Reason = reason
+	rotated = append(rotated, KeyVersion{Version: history[last].Version + 1, Address: newKey.PublicAddressHex, CreatedAt: &now})
+	if err := writeKeyHistory(ctx, s, username, rotated); err != nil {
+		b.restoreEscrowRecord(ctx, s, username, oldEscrow)
+		return current, previous, err
+	}
+	if err := client.keys.writeKey(ctx, username, newKey); err != nil {
+		if restoreErr := writeKeyHistory(ctx, s, username, history); restoreErr != nil {
+			b.Logger().Error("unable to restore key history after a failed rotation", "username", username, "error", restoreErr)
+		}
+		b.restoreEscrowRecord(ctx, s, username, oldEscrow)
+		return current, previous, err
+	}
+	b.identities.invalidateUser(username)
+	return rotated[last+1], rotated[last], nil
+}
+
+// addressHistory : Every key version username has held, with its address at addressIndex.
+// Index 0 comes from the history itself; other indexes are derived from the retired keys.
+func (b *backend) addressHistory(ctx context.Context, s logical.Storage, client *Client, username string, addressIndex int) ([]map[string]interface{}, error) {
+	currentKey, err := client.readKeyByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	history, err := readKeyHistory(ctx, s, username, currentKey)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]map[string]interface{}, 0, len(history))
+	for i, version := range history {
+		isCurrent := i == len(history)-1
+		address := version.Address
+		if addressIndex != 0 {
+			key := currentKey
+			if !isCurrent {
+				if key, err = client.keys.readKey(ctx, retiredKeyName(username, version.Version)); err != nil {
+					return nil, err
+				}
+				if key == nil {
+					return nil, fmt.Errorf("retired key version %d is missing", version.Version)
+				}
+			}
+			if address, err = key.Address(addressIndex); err != nil {
+				return nil, err
+			}
+		}
+		entry := map[string]interface{}{
+			"version": version.Version,
+			"address": address,
+			"current": isCurrent}
+		if version.CreatedAt != nil {
+			entry["created_at"] = version.CreatedAt
+		}
+		if version.RetiredAt != nil {
+			entry["retired_at"] = version.RetiredAt
+			entry["retired_by"] = version.RetiredBy
+			entry["reason"] = version.Reason
+		}
+		addresses = append(addresses, entry)
+	}
+	return addresses, nil
+}
+
+// rotateFields : guardian/rotate takes fresh credentials and an optional reason.
+func rotateFields() map[string]*framework.FieldSchema {
+	fields := reauthFields()
+	fields["reason"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Why the key is being rotated, kept in the address history."}
+	return fields
+}
+
+//-----------------------------------------
+//  Fresh Authentication
+//-----------------------------------------
+
+// reauthFields : Credential fields for operations which make the caller prove who they are
+// again, on top of presenting their token.
+func reauthFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"okta_username": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Username of the caller's Okta account, checked again for this operation."},
+		"okta_password": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Password for the caller's Okta account."},
+		"id_token": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "A fresh ID token from the OIDC issuer, used instead of Okta credentials when provider=oidc."},
+		"passcode": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "One-time passcode from the caller's Okta MFA factor."},
+	}
+}
+
+// reauthenticate : Checks the credentials sent with a sensitive request log in as username.
+// Returns the response to refuse the request with, or nil once they do.  Only passcodes are
+// accepted for MFA, since a push cannot be polled for here.
+func (b *backend) reauthenticate(ctx context.Context, req *logical.Request, cfg *Config, client *Client, data *framework.FieldData, username string) *logical.Response {
+	creds := Credentials{
+		Username: data.Get("okta_username").(string),
+		Password: data.Get("okta_password").(string),
+		IDToken:  data.Get("id_token").(string),
+		Passcode: data.Get("passcode").(string)}
+	if creds.Username == "" && creds.IDToken == "" {
+		return errorResp(req, ErrCodeReauthRequired, "This operation requires fresh authentication, provide okta_username and okta_password, or an id_token", nil)
+	}
+	if limitErr := b.checkLoginRate(req, cfg, creds.Username); limitErr != nil {
+		return rateLimitedResp(req, limitErr)
+	}
+	if cfg.ProviderName() == ProviderOkta {
+		mfaErr := validateMFA(cfg, creds)
+		if mfaErr == ErrMFARequired {
+			return mfaErrResp(req, mfaStatusRequired, "This operation requires a passcode from your MFA factor.", "")
+		}
+		if mfaErr != nil {
+			return invalidRequestResp(req, mfaErr.Error())
+		}
+	}
+	authenticated, loginErr := client.authenticate(ctx, creds)
+	if loginErr != nil {
+		return b.loginErrResp(req, cfg, loginErr)
+	}
+	if authenticated != username {
+		return errorResp(req, ErrCodeReauthRequired, "Fresh authentication must be for the account making the request", nil)
+	}
+	return nil
+}
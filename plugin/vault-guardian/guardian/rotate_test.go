@@ -0,0 +1,94 @@
+package guardian
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func rotateRequest(storage logical.Storage, data map[string]interface{}) *logical.Request {
+	return &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "rotate",
+		Storage:   storage,
+		EntityID:  "entity-alice",
+		Data:      data,
+	}
+}
+
+func TestBackend_RotateKey(t *testing.T) {
+	b, storage, _, closeServer := newPushBackend(t, false)
+	defer closeServer()
+	ctx := context.Background()
+	_, client, _ := b.configAndClient(ctx, storage)
+	original, err := client.readKeyByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fresh authentication is required, and has to be as the caller
+	resp, _ := b.HandleRequest(ctx, rotateRequest(storage, map[string]interface{}{}))
+	if resp == nil || !isError(resp) {
+		t.Fatalf("expected rotation without credentials to be refused, got %#v", resp)
+	}
+	resp, _ = b.HandleRequest(ctx, rotateRequest(storage, map[string]interface{}{"okta_username": "mallory", "okta_password": "hunter2"}))
+	if resp == nil || !isError(resp) {
+		t.Fatalf("expected rotation with someone else's credentials to be refused, got %#v", resp)
+	}
+
+	resp, err = b.HandleRequest(ctx, rotateRequest(storage, map[string]interface{}{
+		"okta_username": "alice",
+		"okta_password": "hunter2",
+		"reason":        "lost laptop"}))
+	if err != nil || isError(resp) {
+		t.Fatalf("rotate failed: %v %#v", err, resp)
+	}
+	if resp.Data["previous_address"] != original.PublicAddressHex || resp.Data["address"] == original.PublicAddressHex || resp.Data["key_version"] != 2 {
+		t.Fatalf("unexpected rotation %#v", resp.Data)
+	}
+	rotatedAddress := resp.Data["address"]
+
+	read, err := b.HandleRequest(ctx, &logical.Request{Operation: logical.ReadOperation, Path: "sign", Storage: storage, EntityID: "entity-alice"})
+	if err != nil || read.Data["public_address"] != rotatedAddress {
+		t.Fatalf("expected sign to use the new key, got %v %#v", err, read)
+	}
+
+	// The retired key stays readable
+	retired, err := client.keys.readKey(ctx, retiredKeyName("alice", 1))
+	if err != nil || retired == nil || retired.Mnemonic != original.Mnemonic {
+		t.Fatalf("expected the original key to be kept as retired, got %v %#v", err, retired)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "admin/rotate/alice",
+		Storage:   storage,
+		Data:      map[string]interface{}{"reason": "suspected compromise"}})
+	if err != nil || isError(resp) || resp.Data["key_version"] != 3 {
+		t.Fatalf("admin rotate failed: %v %#v", err, resp)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "admin/addresses/alice",
+		Storage:   storage,
+		Data:      map[string]interface{}{"address_index": 1}})
+	if err != nil || isError(resp) {
+		t.Fatalf("address history read failed: %v %#v", err, resp)
+	}
+	addresses := resp.Data["addresses"].([]map[string]interface{})
+	if len(addresses) != 3 {
+		t.Fatalf("expected three key versions, got %#v", addresses)
+	}
+	originalSecond, _ := original.Address(1)
+	if addresses[0]["address"] != originalSecond || addresses[0]["reason"] != "lost laptop" || addresses[0]["retired_by"] != RotatedByUser {
+		t.Errorf("unexpected first version %#v", addresses[0])
+	}
+	if addresses[1]["retired_by"] != RotatedByMaintainer || addresses[1]["reason"] != "suspected compromise" {
+		t.Errorf("unexpected second version %#v", addresses[1])
+	}
+	if addresses[2]["current"] != true || addresses[2]["retired_at"] != nil {
+		t.Errorf("unexpected current version %#v", addresses[2])
+	}
+}
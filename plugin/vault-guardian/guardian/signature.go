@@ -0,0 +1,91 @@
+package guardian
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/eximchain/go-ethereum/common/hexutil"
+	"github.com/eximchain/go-ethereum/crypto"
+)
+
+const (
+	// SignatureFormatRaw : 65 bytes of r ‖ s ‖ v, with v of 0 or 1, as go-ethereum produces them.
+	SignatureFormatRaw = "raw"
+	// SignatureFormatV27 : The same 65 bytes with v of 27 or 28, as ecrecover and personal_sign expect.
+	SignatureFormatV27 = "v27"
+	// SignatureFormatSplit : r, s and v as separate fields, v being 27 or 28.
+	SignatureFormatSplit = "split"
+	// SignatureFormatCompact : EIP-2098's 64 bytes of r ‖ yParityAndS, v folded into s's top bit.
+	SignatureFormatCompact = "compact"
+)
+
+var signatureFormats = []string{SignatureFormatRaw, SignatureFormatV27, SignatureFormatSplit, SignatureFormatCompact}
+
+var (
+	secp256k1N     = crypto.S256().Params().N
+	secp256k1HalfN = new(big.Int).Rsh(secp256k1N, 1)
+)
+
+//-----------------------------------------
+//  Signature Encoding
+//-----------------------------------------
+
+// normalizeLowS : Rewrites a 65 byte signature with v of 0 or 1 so s is in the lower half of
+// the curve order, flipping v to match, as EIP-2 requires and EIP-2098 depends on.  Both
+// signers go-ethereum builds with already produce low-S signatures; this makes sure of it.
+func normalizeLowS(sig []byte) {
+	s := new(big.Int).SetBytes(sig[32:64])
+	if s.Cmp(secp256k1HalfN) <= 0 {
+		return
+	}
+	s.Sub(secp256k1N, s)
+	copy(sig[32:64], make([]byte, 32))
+	sBytes := s.Bytes()
+	copy(sig[64-len(sBytes):64], sBytes)
+	sig[64] ^= 1
+}
+
+// parseSignatureFormat : format, lowercased, or fallback when it is empty.
+func parseSignatureFormat(format, fallback string) (string, error) {
+	if format == "" {
+		return fallback, nil
+	}
+	format = strings.ToLower(format)
+	if !containsString(signatureFormats, format) {
+		return "", fmt.Errorf("signature_format must be one of %s", strings.Join(signatureFormats, ", "))
+	}
+	return format, nil
+}
+
+// formatSignature : The response fields for sig, a 65 byte signature with v of 0 or 1, in
+// format.  Every format carries a signature field; split adds r, s and v alongside it.
+func formatSignature(sig []byte, format string) map[string]interface{} {
+	withV27 := append([]byte{}, sig...)
+	withV27[64] += 27
+	switch format {
+	case SignatureFormatV27:
+		return map[string]interface{}{"signature": hexutil.Encode(withV27)}
+	case SignatureFormatSplit:
+		return map[string]interface{}{
+			"signature": hexutil.Encode(withV27),
+			"r":         hexutil.Encode(sig[:32]),
+			"s":         hexutil.Encode(sig[32:64]),
+			"v":         int(withV27[64])}
+	case SignatureFormatCompact:
+		compact := append([]byte{}, sig[:64]...)
+		compact[32] |= sig[64] << 7
+		return map[string]interface{}{"signature": hexutil.Encode(compact)}
+	default:
+		return map[string]interface{}{"signature": hexutil.Encode(sig)}
+	}
+}
+
+// expandCompactSignature : The 65 byte signature, with v of 0 or 1, an EIP-2098 signature stands for.
+func expandCompactSignature(compact []byte) []byte {
+	sig := make([]byte, 65)
+	copy(sig, compact[:64])
+	sig[64] = compact[32] >> 7
+	sig[32] &= 0x7f
+	return sig
+}
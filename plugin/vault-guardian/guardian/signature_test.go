@@ -0,0 +1,100 @@
+package guardian
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/eximchain/go-ethereum/common/hexutil"
+)
+
+func TestNormalizeLowS(t *testing.T) {
+	privKeyHex, _, err := CreateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := hex.DecodeString(testHash)
+	sig, err := SignWithHexKey(hash, privKeyHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if new(big.Int).SetBytes(sig[32:64]).Cmp(secp256k1HalfN) > 0 {
+		t.Fatal("expected SignWithHexKey to return a low s")
+	}
+
+	// The high-S twin of a signature recovers to the same key, and normalizes back to it
+	high := append([]byte{}, sig...)
+	s := new(big.Int).Sub(secp256k1N, new(big.Int).SetBytes(sig[32:64]))
+	copy(high[32:64], make([]byte, 32))
+	copy(high[64-len(s.Bytes()):64], s.Bytes())
+	high[64] ^= 1
+	normalizeLowS(high)
+	if !bytes.Equal(high, sig) {
+		t.Fatalf("expected %x, got %x", sig, high)
+	}
+}
+
+func TestFormatSignature(t *testing.T) {
+	privKeyHex, address, err := CreateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := hex.DecodeString(testHash)
+	sig, err := SignWithHexKey(hash, privKeyHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lengths := map[string]int{
+		SignatureFormatRaw:     65,
+		SignatureFormatV27:     65,
+		SignatureFormatSplit:   65,
+		SignatureFormatCompact: 64}
+	for format, length := range lengths {
+		respData := formatSignature(sig, format)
+		encoded, err := hexutil.Decode(respData["signature"].(string))
+		if err != nil || len(encoded) != length {
+			t.Fatalf("%s: expected %d bytes, got %v %v", format, length, respData["signature"], err)
+		}
+		if _, signer, err := RecoverSigner(hash, encoded); err != nil || signer != address {
+			t.Fatalf("%s: expected %s to be recovered, got %s %v", format, address, signer, err)
+		}
+	}
+	if v := formatSignature(sig, SignatureFormatV27)["signature"].(string); v[len(v)-2:] != "1b" && v[len(v)-2:] != "1c" {
+		t.Fatalf("expected a v of 27 or 28, got %s", v)
+	}
+	split := formatSignature(sig, SignatureFormatSplit)
+	if split["r"] != hexutil.Encode(sig[:32]) || split["s"] != hexutil.Encode(sig[32:64]) || split["v"] != int(sig[64])+27 {
+		t.Fatalf("expected r, s and v to match %x, got %#v", sig, split)
+	}
+	compact, _ := hexutil.Decode(formatSignature(sig, SignatureFormatCompact)["signature"].(string))
+	if !bytes.Equal(expandCompactSignature(compact), sig) {
+		t.Fatalf("expected the compact signature to expand back to %x", sig)
+	}
+}
+
+func TestBackend_SignatureFormat(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+
+	req := signRequest(storage)
+	req.Data["signature_format"] = "COMPACT"
+	resp, err := b.HandleRequest(ctx, req)
+	if err != nil || isError(resp) {
+		t.Fatalf("signing failed: %v %#v", err, resp)
+	}
+	compact, _ := hexutil.Decode(resp.Data["signature"].(string))
+	hash, _ := hex.DecodeString(testHash)
+	if _, signer, err := RecoverSigner(hash, compact); err != nil || len(compact) != 64 || signer != fv.kv["alice"]["publicAddressHex"] {
+		t.Fatalf("expected a compact signature by alice, got %x %s %v", compact, signer, err)
+	}
+
+	req = signRequest(storage)
+	req.Data["signature_format"] = "der"
+	if resp, _ = b.HandleRequest(ctx, req); errorCode(resp) != ErrCodeInvalidRequest {
+		t.Fatalf("expected an unknown format to be refused, got %#v", resp)
+	}
+}
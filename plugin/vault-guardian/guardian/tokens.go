@@ -0,0 +1,108 @@
+package guardian
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+//-----------------------------------------
+//  Single-Use Sign Tokens
+//-----------------------------------------
+
+// signToken : Record of a single-use token minted by login or sign, stored under its accessor.
+// Vault spends the token on its one use; the record tells us whose it was and how many
+// more fresh_client_tokens that login is allowed to chain.
+type signToken struct {
+	Username           string    `json:"username"`
+	RefreshesRemaining int       `json:"refreshes_remaining"`
+	ExpiresAt          time.Time `json:"expires_at"`
+}
+
+func signTokenPath(accessor string) string {
+	return "sign-tokens/" + accessor
+}
+
+// issueSignToken : Mints a num_uses=1 token for username and records it for the next sign call.
+func (b *backend) issueSignToken(ctx context.Context, s logical.Storage, client *Client, cfg *Config, username string, refreshesRemaining int) (clientToken string, err error) {
+	ttl := cfg.TokenTTL()
+	clientToken, accessor, err := client.makeSingleSignToken(username, ttl)
+	if err != nil {
+		return "", err
+	}
+	record := &signToken{
+		Username:           username,
+		RefreshesRemaining: refreshesRemaining,
+		ExpiresAt:          time.Now().Add(ttl)}
+	entry, err := logical.StorageEntryJSON(signTokenPath(accessor), record)
+	if err != nil {
+		return "", err
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return "", err
+	}
+	return clientToken, nil
+}
+
+// consumeSignToken : Returns and deletes the record for the calling token, or nil if the
+// caller is not using a token minted by the plugin.
+func (b *backend) consumeSignToken(ctx context.Context, s logical.Storage, accessor string) (*signToken, error) {
+	if accessor == "" {
+		return nil, nil
+	}
+	entry, err := s.Get(ctx, signTokenPath(accessor))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	var record signToken
+	if err := entry.DecodeJSON(&record); err != nil {
+		return nil, err
+	}
+	if err := s.Delete(ctx, signTokenPath(accessor)); err != nil {
+		return nil, err
+	}
+	if time.Now().After(record.ExpiresAt) {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// refreshSignToken : Mints the fresh_client_token which follows a sign call, if the login
+// which started the chain still has refreshes left.
+func (b *backend) refreshSignToken(ctx context.Context, s logical.Storage, client *Client, cfg *Config, record *signToken) (clientToken string, err error) {
+	if record == nil || record.RefreshesRemaining <= 0 {
+		return "", nil
+	}
+	return b.issueSignToken(ctx, s, client, cfg, record.Username, record.RefreshesRemaining-1)
+}
+
+// tidySignTokens : Removes records for tokens which expired without being used.
+func (b *backend) tidySignTokens(ctx context.Context, s logical.Storage) error {
+	accessors, err := s.List(ctx, "sign-tokens/")
+	if err != nil {
+		return err
+	}
+	for _, accessor := range accessors {
+		entry, err := s.Get(ctx, signTokenPath(accessor))
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			continue
+		}
+		var record signToken
+		if err := entry.DecodeJSON(&record); err != nil {
+			return err
+		}
+		if time.Now().After(record.ExpiresAt) {
+			if err := s.Delete(ctx, signTokenPath(accessor)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
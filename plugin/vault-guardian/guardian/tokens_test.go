@@ -0,0 +1,146 @@
+package guardian
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// signTokenRecords : Every sign token record in storage, by accessor.
+func signTokenRecords(t *testing.T, storage logical.Storage) map[string]signToken {
+	ctx := context.Background()
+	accessors, err := storage.List(ctx, "sign-tokens/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := map[string]signToken{}
+	for _, accessor := range accessors {
+		entry, err := storage.Get(ctx, signTokenPath(accessor))
+		if err != nil || entry == nil {
+			t.Fatalf("unable to read sign token %s: %v", accessor, err)
+		}
+		var record signToken
+		if err := entry.DecodeJSON(&record); err != nil {
+			t.Fatal(err)
+		}
+		records[accessor] = record
+	}
+	return records
+}
+
+// onlySignToken : The accessor and record of the one sign token in storage.
+func onlySignToken(t *testing.T, storage logical.Storage) (string, signToken) {
+	records := signTokenRecords(t, storage)
+	if len(records) != 1 {
+		t.Fatalf("expected one sign token record, got %#v", records)
+	}
+	for accessor, record := range records {
+		return accessor, record
+	}
+	return "", signToken{}
+}
+
+func signWithAccessor(storage logical.Storage, accessor string) *logical.Request {
+	req := signRequest(storage)
+	req.ClientTokenAccessor = accessor
+	return req
+}
+
+func TestBackend_SignTokenChain(t *testing.T) {
+	b, storage, _, cleanup := newPushBackend(t, false)
+	defer cleanup()
+	ctx := context.Background()
+	cfg, _, _ := b.configAndClient(ctx, storage)
+	refreshes := 2
+	cfg.MaxTokenRefreshes = &refreshes
+
+	resp, err := b.HandleRequest(ctx, loginRequest(storage, map[string]interface{}{}))
+	if err != nil || isError(resp) || resp.Data["client_token"] == "" {
+		t.Fatalf("login failed: %v %#v", err, resp)
+	}
+	first, record := onlySignToken(t, storage)
+	if record.Username != "alice" || record.RefreshesRemaining != 2 || !record.ExpiresAt.After(time.Now()) {
+		t.Fatalf("expected login to record a token for alice with 2 refreshes, got %#v", record)
+	}
+
+	// Each sign consumes the record it was called with and hands back the next token
+	accessor := first
+	for remaining := 1; remaining >= 0; remaining-- {
+		resp, err = b.HandleRequest(ctx, signWithAccessor(storage, accessor))
+		if err != nil || isError(resp) || resp.Data["fresh_client_token"] == nil {
+			t.Fatalf("expected a fresh_client_token, got %v %#v", err, resp)
+		}
+		next, record := onlySignToken(t, storage)
+		if next == accessor || record.Username != "alice" || record.RefreshesRemaining != remaining {
+			t.Fatalf("expected a new record with %d refreshes, got %s %#v", remaining, next, record)
+		}
+		accessor = next
+	}
+
+	// The chain stops once token_refreshes are spent
+	resp, err = b.HandleRequest(ctx, signWithAccessor(storage, accessor))
+	if err != nil || isError(resp) || resp.Data["signature"] == nil {
+		t.Fatalf("expected the last token to sign, got %v %#v", err, resp)
+	}
+	if _, ok := resp.Data["fresh_client_token"]; ok {
+		t.Fatalf("expected no fresh_client_token after the last refresh, got %#v", resp)
+	}
+	if records := signTokenRecords(t, storage); len(records) != 0 {
+		t.Fatalf("expected every record to be consumed, got %#v", records)
+	}
+
+	// A used accessor has no record left, so it cannot start another chain
+	resp, err = b.HandleRequest(ctx, signWithAccessor(storage, first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resp.Data["fresh_client_token"]; ok {
+		t.Fatalf("expected a reused accessor not to be refreshed, got %#v", resp)
+	}
+	if records := signTokenRecords(t, storage); len(records) != 0 {
+		t.Fatalf("expected a reused accessor not to record a token, got %#v", records)
+	}
+}
+
+func TestBackend_ExpiredSignTokens(t *testing.T) {
+	b, storage, _, cleanup := newPushBackend(t, false)
+	defer cleanup()
+	ctx := context.Background()
+
+	for accessor, expiresAt := range map[string]time.Time{
+		"expired-used":   time.Now().Add(-time.Minute),
+		"expired-unused": time.Now().Add(-time.Minute),
+		"live":           time.Now().Add(time.Minute)} {
+		entry, err := logical.StorageEntryJSON(signTokenPath(accessor), &signToken{
+			Username:           "alice",
+			RefreshesRemaining: 1,
+			ExpiresAt:          expiresAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := b.HandleRequest(ctx, signWithAccessor(storage, "expired-used"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resp.Data["fresh_client_token"]; ok {
+		t.Fatalf("expected an expired record not to be refreshed, got %#v", resp)
+	}
+	records := signTokenRecords(t, storage)
+	if _, ok := records["expired-used"]; ok || len(records) != 2 {
+		t.Fatalf("expected the expired record to be consumed without a new one, got %#v", records)
+	}
+
+	if err := b.tidySignTokens(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	if accessor, _ := onlySignToken(t, storage); accessor != "live" {
+		t.Fatalf("expected tidy to keep only the live record, kept %s", accessor)
+	}
+}
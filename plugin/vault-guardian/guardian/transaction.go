@@ -0,0 +1,154 @@
+package guardian
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/common/hexutil"
+	"github.com/eximchain/go-ethereum/common/math"
+	"github.com/eximchain/go-ethereum/core/types"
+	"github.com/eximchain/go-ethereum/crypto"
+	"github.com/eximchain/go-ethereum/rlp"
+)
+
+//-----------------------------------------
+//  Transaction Signing
+//-----------------------------------------
+
+// TxFields : Unsigned transaction fields as they arrive on sign/transaction.  Numbers may
+// be decimal or 0x-prefixed hex, an empty To creates a contract.
+type TxFields struct {
+	Nonce    string
+	GasPrice string
+	GasLimit string
+	To       string
+	Value    string
+	Data     string
+}
+
+// unsignedTxRLP : The fields of an unsigned legacy transaction.  Rest holds the EIP-155
+// chainId, 0, 0 suffix when the client already encoded it.
+type unsignedTxRLP struct {
+	Nonce    uint64
+	GasPrice *big.Int
+	Gas      uint64
+	To       *common.Address `rlp:"nil"`
+	Value    *big.Int
+	Data     []byte
+	Rest     []rlp.RawValue `rlp:"tail"`
+}
+
+// NewTxFromFields : Builds the unsigned transaction described by fields.
+func NewTxFromFields(fields TxFields) (*types.Transaction, error) {
+	nonce, ok := math.ParseUint64(defaultZero(fields.Nonce))
+	if !ok {
+		return nil, fmt.Errorf("nonce %q is not a valid number", fields.Nonce)
+	}
+	gasLimit, ok := math.ParseUint64(fields.GasLimit)
+	if !ok || gasLimit == 0 {
+		return nil, fmt.Errorf("gas_limit %q is not a valid non-zero number", fields.GasLimit)
+	}
+	gasPrice, ok := math.ParseBig256(defaultZero(fields.GasPrice))
+	if !ok {
+		return nil, fmt.Errorf("gas_price %q is not a valid number", fields.GasPrice)
+	}
+	value, ok := math.ParseBig256(defaultZero(fields.Value))
+	if !ok {
+		return nil, fmt.Errorf("value %q is not a valid number", fields.Value)
+	}
+	var data []byte
+	if fields.Data != "" {
+		var err error
+		if data, err = hexutil.Decode(withHexPrefix(fields.Data)); err != nil {
+			return nil, fmt.Errorf("data is not valid hex: %v", err)
+		}
+	}
+	if fields.To == "" {
+		return types.NewContractCreation(nonce, value, gasLimit, gasPrice, data), nil
+	}
+	if !common.IsHexAddress(fields.To) {
+		return nil, fmt.Errorf("to %q is not a valid address", fields.To)
+	}
+	return types.NewTransaction(nonce, common.HexToAddress(fields.To), value, gasLimit, gasPrice, data), nil
+}
+
+// NewTxFromRLP : Decodes an unsigned transaction, either the plain six fields or the nine
+// field EIP-155 signing form, whose chainId must then match chainID.
+func NewTxFromRLP(raw []byte, chainID *big.Int) (*types.Transaction, error) {
+	var decoded unsignedTxRLP
+	if err := rlp.DecodeBytes(raw, &decoded); err != nil {
+		return nil, fmt.Errorf("unable to decode unsigned transaction: %v", err)
+	}
+	switch len(decoded.Rest) {
+	case 0:
+	case 3:
+		var encodedChainID, r, s big.Int
+		for i, into := range []*big.Int{&encodedChainID, &r, &s} {
+			if err := rlp.DecodeBytes(decoded.Rest[i], into); err != nil {
+				return nil, fmt.Errorf("unable to decode unsigned transaction: %v", err)
+			}
+		}
+		if encodedChainID.Cmp(chainID) != 0 {
+			return nil, fmt.Errorf("transaction was encoded for chain %s, not chain_id %s", encodedChainID.String(), chainID.String())
+		}
+		if r.Sign() != 0 || s.Sign() != 0 {
+			return nil, fmt.Errorf("transaction is already signed")
+		}
+	default:
+		return nil, fmt.Errorf("unsigned transaction has %d fields, expected 6 or 9", 6+len(decoded.Rest))
+	}
+	if decoded.To == nil {
+		return types.NewContractCreation(decoded.Nonce, decoded.Value, decoded.Gas, decoded.GasPrice, decoded.Data), nil
+	}
+	return types.NewTransaction(decoded.Nonce, *decoded.To, decoded.Value, decoded.Gas, decoded.GasPrice, decoded.Data), nil
+}
+
+// SignTxWithHexKey : Signs tx for chainID with the EIP-155 signer, the same way the ethereum
+// plugin's NewTransactor does.
+func SignTxWithHexKey(tx *types.Transaction, chainID *big.Int, privKeyHex string) (signedTx *types.Transaction, err error) {
+	if chainID == nil || chainID.Sign() <= 0 {
+		return nil, fmt.Errorf("chain_id must be a positive number")
+	}
+	privKey, err := crypto.HexToECDSA(privKeyHex)
+	if err != nil {
+		return nil, err
+	}
+	signer := types.NewEIP155Signer(chainID)
+	sig, err := crypto.Sign(signer.Hash(tx).Bytes(), privKey)
+	if err != nil {
+		return nil, err
+	}
+	return tx.WithSignature(signer, sig)
+}
+
+// signedTxData : Response data for a signed transaction, ready to hand to eth_sendRawTransaction.
+func signedTxData(signedTx *types.Transaction, chainID *big.Int) (map[string]interface{}, error) {
+	rawTx, err := rlp.EncodeToBytes(signedTx)
+	if err != nil {
+		return nil, err
+	}
+	v, r, s := signedTx.RawSignatureValues()
+	return map[string]interface{}{
+		"signed_tx":    hexutil.Encode(rawTx),
+		"tx_hash":      signedTx.Hash().Hex(),
+		"signing_hash": types.NewEIP155Signer(chainID).Hash(signedTx).Hex(),
+		"v":            hexutil.EncodeBig(v),
+		"r":            hexutil.EncodeBig(r),
+		"s":            hexutil.EncodeBig(s)}, nil
+}
+
+func defaultZero(number string) string {
+	if number == "" {
+		return "0"
+	}
+	return number
+}
+
+func withHexPrefix(hexStr string) string {
+	if strings.HasPrefix(hexStr, "0x") || strings.HasPrefix(hexStr, "0X") {
+		return hexStr
+	}
+	return "0x" + hexStr
+}
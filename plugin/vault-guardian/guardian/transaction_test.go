@@ -0,0 +1,130 @@
+package guardian
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/eximchain/go-ethereum/common/hexutil"
+	"github.com/eximchain/go-ethereum/core/types"
+	"github.com/hashicorp/vault/logical"
+)
+
+// The worked example from EIP-155.
+const (
+	eip155PrivKeyHex   = "4646464646464646464646464646464646464646464646464646464646464646"
+	eip155UnsignedRLP  = "0xec098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a764000080018080"
+	eip155SigningHash  = "0xdaf5a779ae972f972197303d7b574746c7ef83eadac0f2791ad23db92e4c8e53"
+	eip155SignedTx     = "0xf86c098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a76400008025a028ef61340bd939bc2195fe537567866003e1a15d3c71ff63e1590620aa636276a067cbe9d8997f761aecb703304b3800ccf555c9f3dc64214b297fb1966a3b6d83"
+	eip155TxRecipient  = "0x3535353535353535353535353535353535353535"
+	eip155ExpectedSigV = "0x25"
+)
+
+var eip155Fields = TxFields{
+	Nonce:    "9",
+	GasPrice: "20000000000",
+	GasLimit: "21000",
+	To:       eip155TxRecipient,
+	Value:    "1000000000000000000"}
+
+func TestSignTxWithHexKey_EIP155(t *testing.T) {
+	chainID := big.NewInt(1)
+	fromFields, err := NewTxFromFields(eip155Fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := hexutil.Decode(eip155UnsignedRLP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromRLP, err := NewTxFromRLP(unsigned, chainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tx := range map[string]*types.Transaction{"fields": fromFields, "rlp": fromRLP} {
+		signed, err := SignTxWithHexKey(tx, chainID, eip155PrivKeyHex)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		respData, err := signedTxData(signed, chainID)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if respData["signed_tx"] != eip155SignedTx {
+			t.Errorf("%s: expected signed_tx %s, got %s", name, eip155SignedTx, respData["signed_tx"])
+		}
+		if respData["signing_hash"] != eip155SigningHash {
+			t.Errorf("%s: expected signing_hash %s, got %s", name, eip155SigningHash, respData["signing_hash"])
+		}
+		if respData["v"] != eip155ExpectedSigV {
+			t.Errorf("%s: expected v %s, got %s", name, eip155ExpectedSigV, respData["v"])
+		}
+	}
+
+	if _, err := NewTxFromRLP(unsigned, big.NewInt(3)); err == nil {
+		t.Error("expected an RLP encoded for chain 1 to be refused for chain_id 3")
+	}
+	if _, err := SignTxWithHexKey(fromFields, big.NewInt(0), eip155PrivKeyHex); err == nil {
+		t.Error("expected chain_id 0 to be refused")
+	}
+}
+
+func TestNewTxFromFields_Invalid(t *testing.T) {
+	cases := map[string]TxFields{
+		"missing gas_limit": {To: eip155TxRecipient},
+		"bad to":            {To: "0x1234", GasLimit: "21000"},
+		"bad value":         {To: eip155TxRecipient, GasLimit: "21000", Value: "lots"},
+		"bad data":          {To: eip155TxRecipient, GasLimit: "21000", Data: "0xzz"},
+	}
+	for name, fields := range cases {
+		if _, err := NewTxFromFields(fields); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	creation, err := NewTxFromFields(TxFields{GasLimit: "100000", Data: "6000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creation.To() != nil {
+		t.Error("expected an empty to to create a contract")
+	}
+}
+
+func TestBackend_SignTransaction(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "sign/transaction",
+		Storage:   storage,
+		EntityID:  "entity-alice",
+		Data: map[string]interface{}{
+			"chain_id":  "1",
+			"nonce":     "0x9",
+			"gas_price": "20000000000",
+			"gas_limit": "21000",
+			"to":        eip155TxRecipient,
+			"value":     "1000000000000000000"},
+	})
+	if err != nil || isError(resp) {
+		t.Fatalf("sign/transaction failed: %v %#v", err, resp)
+	}
+	for _, field := range []string{"signed_tx", "tx_hash", "v", "r", "s"} {
+		if resp.Data[field] == nil {
+			t.Errorf("expected %s in the response", field)
+		}
+	}
+
+	resp, _ = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "sign/transaction",
+		Storage:   storage,
+		EntityID:  "entity-alice",
+		Data:      map[string]interface{}{"raw_tx": eip155UnsignedRLP},
+	})
+	if resp == nil || !isError(resp) {
+		t.Fatalf("expected a missing chain_id to be refused, got %#v", resp)
+	}
+}
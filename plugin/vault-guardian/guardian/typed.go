@@ -0,0 +1,400 @@
+package guardian
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/eximchain/go-ethereum/common"
+	"github.com/eximchain/go-ethereum/common/hexutil"
+	"github.com/eximchain/go-ethereum/common/math"
+	"github.com/eximchain/go-ethereum/crypto"
+)
+
+//-----------------------------------------
+//  EIP-712 Typed Data
+//-----------------------------------------
+
+// EIP712DomainType : Name of the type describing the domain, every document must declare it.
+const EIP712DomainType = "EIP712Domain"
+
+// eip712DomainFields : The domain fields EIP-712 defines, along with their required types.
+var eip712DomainFields = map[string]string{
+	"name":              "string",
+	"version":           "string",
+	"chainId":           "uint256",
+	"verifyingContract": "address",
+	"salt":              "bytes32"}
+
+var (
+	typedArrayPattern = regexp.MustCompile(`^(.+)\[(\d*)\]$`)
+	typedIntPattern   = regexp.MustCompile(`^(u?)int(\d*)$`)
+	typedBytesPattern = regexp.MustCompile(`^bytes(\d+)$`)
+)
+
+// TypedDataField : One member of a struct type.
+type TypedDataField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// TypedData : An eth_signTypedData_v4 document.
+type TypedData struct {
+	Types       map[string][]TypedDataField `json:"types"`
+	PrimaryType string                      `json:"primaryType"`
+	Domain      map[string]interface{}      `json:"domain"`
+	Message     map[string]interface{}      `json:"message"`
+}
+
+// ParseTypedData : Decodes a typed data JSON document, keeping numbers exact.
+func ParseTypedData(doc []byte) (*TypedData, error) {
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.UseNumber()
+	var typed TypedData
+	if err := decoder.Decode(&typed); err != nil {
+		return nil, fmt.Errorf("typed_data is not valid JSON: %v", err)
+	}
+	return &typed, nil
+}
+
+// ChainID : The domain's chainId, Validate ensures it is present.
+func (td *TypedData) ChainID() (*big.Int, error) {
+	return typedBigInt(td.Domain["chainId"], 256, false)
+}
+
+// Validate : Checks the domain only uses EIP-712's fields with their proper types, and names
+// a positive chainId; if expectedChainID is given the two must agree.  Also makes sure every
+// struct referenced from the primary type is declared.
+func (td *TypedData) Validate(expectedChainID *big.Int) error {
+	domainType, ok := td.Types[EIP712DomainType]
+	if !ok {
+		return fmt.Errorf("types must declare %s", EIP712DomainType)
+	}
+	declared := map[string]bool{}
+	for _, field := range domainType {
+		wantType, known := eip712DomainFields[field.Name]
+		if !known {
+			return fmt.Errorf("%s has unknown field %q", EIP712DomainType, field.Name)
+		}
+		if field.Type != wantType {
+			return fmt.Errorf("%s.%s must be %s, not %s", EIP712DomainType, field.Name, wantType, field.Type)
+		}
+		declared[field.Name] = true
+	}
+	for name := range td.Domain {
+		if !declared[name] {
+			return fmt.Errorf("domain.%s is not declared in %s", name, EIP712DomainType)
+		}
+	}
+	if !declared["chainId"] || td.Domain["chainId"] == nil {
+		return fmt.Errorf("domain must include a chainId")
+	}
+	chainID, err := td.ChainID()
+	if err != nil {
+		return fmt.Errorf("domain.chainId: %v", err)
+	}
+	if chainID.Sign() <= 0 {
+		return fmt.Errorf("domain.chainId must be positive")
+	}
+	if expectedChainID != nil && chainID.Cmp(expectedChainID) != 0 {
+		return fmt.Errorf("domain.chainId %s does not match chain_id %s", chainID.String(), expectedChainID.String())
+	}
+
+	if td.PrimaryType == "" {
+		return fmt.Errorf("primaryType is required")
+	}
+	if td.PrimaryType == EIP712DomainType {
+		return fmt.Errorf("primaryType cannot be %s", EIP712DomainType)
+	}
+	for _, typeName := range []string{EIP712DomainType, td.PrimaryType} {
+		if _, ok := td.Types[typeName]; !ok {
+			return fmt.Errorf("type %s is not declared", typeName)
+		}
+		for dep := range td.dependencies(typeName, map[string]bool{}) {
+			for _, field := range td.Types[dep] {
+				if err := td.checkFieldType(field.Type); err != nil {
+					return fmt.Errorf("%s.%s: %v", dep, field.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Digest : keccak256("\x19\x01" ‖ domainSeparator ‖ hashStruct(message)), along with both
+// of its halves so clients can show what they are signing.
+func (td *TypedData) Digest() (digest, domainSeparator, messageHash []byte, err error) {
+	domainSeparator, err = td.HashStruct(EIP712DomainType, td.Domain)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("domain: %v", err)
+	}
+	messageHash, err = td.HashStruct(td.PrimaryType, td.Message)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("message: %v", err)
+	}
+	digest = crypto.Keccak256([]byte{0x19, 0x01}, domainSeparator, messageHash)
+	return digest, domainSeparator, messageHash, nil
+}
+
+// HashStruct : keccak256(typeHash ‖ encodeData(data)).
+func (td *TypedData) HashStruct(typeName string, data map[string]interface{}) ([]byte, error) {
+	encoded, err := td.encodeData(typeName, data)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256(encoded), nil
+}
+
+// EncodeType : The type followed by every struct it references, sorted by name.
+func (td *TypedData) EncodeType(typeName string) string {
+	deps := td.dependencies(typeName, map[string]bool{})
+	delete(deps, typeName)
+	sorted := []string{}
+	for dep := range deps {
+		sorted = append(sorted, dep)
+	}
+	sort.Strings(sorted)
+	encoded := ""
+	for _, name := range append([]string{typeName}, sorted...) {
+		members := []string{}
+		for _, field := range td.Types[name] {
+			members = append(members, field.Type+" "+field.Name)
+		}
+		encoded += name + "(" + strings.Join(members, ",") + ")"
+	}
+	return encoded
+}
+
+// dependencies : typeName and every struct type reachable from it.
+func (td *TypedData) dependencies(typeName string, found map[string]bool) map[string]bool {
+	typeName = baseType(typeName)
+	if found[typeName] {
+		return found
+	}
+	if _, ok := td.Types[typeName]; !ok {
+		return found
+	}
+	found[typeName] = true
+	for _, field := range td.Types[typeName] {
+		td.dependencies(field.Type, found)
+	}
+	return found
+}
+
+// checkFieldType : Whether fieldType is an atomic, dynamic or declared struct type.
+func (td *TypedData) checkFieldType(fieldType string) error {
+	base := baseType(fieldType)
+	if _, ok := td.Types[base]; ok {
+		return nil
+	}
+	switch base {
+	case "address", "bool", "string", "bytes":
+		return nil
+	}
+	if match := typedIntPattern.FindStringSubmatch(base); match != nil {
+		if _, err := intBits(match[2]); err != nil {
+			return err
+		}
+		return nil
+	}
+	if match := typedBytesPattern.FindStringSubmatch(base); match != nil {
+		if size, _ := strconv.Atoi(match[1]); size < 1 || size > 32 {
+			return fmt.Errorf("%s is not a valid fixed bytes type", base)
+		}
+		return nil
+	}
+	return fmt.Errorf("type %s is not declared", base)
+}
+
+func (td *TypedData) encodeData(typeName string, data map[string]interface{}) ([]byte, error) {
+	fields, ok := td.Types[typeName]
+	if !ok {
+		return nil, fmt.Errorf("type %s is not declared", typeName)
+	}
+	for name := range data {
+		found := false
+		for _, field := range fields {
+			found = found || field.Name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("%s has no field %q", typeName, name)
+		}
+	}
+	encoded := crypto.Keccak256([]byte(td.EncodeType(typeName)))
+	for _, field := range fields {
+		value, err := td.encodeValue(field.Type, data[field.Name])
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", typeName, field.Name, err)
+		}
+		encoded = append(encoded, value...)
+	}
+	return encoded, nil
+}
+
+// encodeValue : The 32 byte encoding of one member, hashing anything dynamic or nested.
+func (td *TypedData) encodeValue(fieldType string, value interface{}) ([]byte, error) {
+	if match := typedArrayPattern.FindStringSubmatch(fieldType); match != nil {
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected an array")
+		}
+		if match[2] != "" {
+			if length, _ := strconv.Atoi(match[2]); length != len(items) {
+				return nil, fmt.Errorf("expected %d items, got %d", length, len(items))
+			}
+		}
+		var encoded []byte
+		for i, item := range items {
+			itemEncoding, err := td.encodeValue(match[1], item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %v", i, err)
+			}
+			encoded = append(encoded, itemEncoding...)
+		}
+		return crypto.Keccak256(encoded), nil
+	}
+
+	if _, isStruct := td.Types[fieldType]; isStruct {
+		if value == nil {
+			return make([]byte, 32), nil
+		}
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected an object of type %s", fieldType)
+		}
+		return td.HashStruct(fieldType, nested)
+	}
+
+	if value == nil {
+		return nil, fmt.Errorf("missing value")
+	}
+	switch fieldType {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string")
+		}
+		return crypto.Keccak256([]byte(str)), nil
+	case "bytes":
+		raw, err := typedBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		return crypto.Keccak256(raw), nil
+	case "bool":
+		flag, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected true or false")
+		}
+		if flag {
+			return common.LeftPadBytes([]byte{1}, 32), nil
+		}
+		return make([]byte, 32), nil
+	case "address":
+		str, ok := value.(string)
+		if !ok || !common.IsHexAddress(str) {
+			return nil, fmt.Errorf("expected a hex address")
+		}
+		return common.LeftPadBytes(common.HexToAddress(str).Bytes(), 32), nil
+	}
+	if match := typedBytesPattern.FindStringSubmatch(fieldType); match != nil {
+		size, _ := strconv.Atoi(match[1])
+		raw, err := typedBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) != size {
+			return nil, fmt.Errorf("expected %d bytes, got %d", size, len(raw))
+		}
+		return common.RightPadBytes(raw, 32), nil
+	}
+	if match := typedIntPattern.FindStringSubmatch(fieldType); match != nil {
+		bits, err := intBits(match[2])
+		if err != nil {
+			return nil, err
+		}
+		number, err := typedBigInt(value, bits, match[1] == "")
+		if err != nil {
+			return nil, err
+		}
+		// Negative numbers are encoded as their 256 bit two's complement
+		return math.PaddedBigBytes(math.U256(new(big.Int).Set(number)), 32), nil
+	}
+	return nil, fmt.Errorf("type %s is not declared", fieldType)
+}
+
+// baseType : The element type of an array type, or the type itself.
+func baseType(fieldType string) string {
+	for {
+		match := typedArrayPattern.FindStringSubmatch(fieldType)
+		if match == nil {
+			return fieldType
+		}
+		fieldType = match[1]
+	}
+}
+
+func intBits(size string) (int, error) {
+	if size == "" {
+		return 256, nil
+	}
+	bits, err := strconv.Atoi(size)
+	if err != nil || bits < 8 || bits > 256 || bits%8 != 0 {
+		return 0, fmt.Errorf("int%s is not a valid integer type", size)
+	}
+	return bits, nil
+}
+
+// typedBigInt : A JSON number, or a decimal or 0x hex string, checked against the type's range.
+func typedBigInt(value interface{}, bits int, signed bool) (*big.Int, error) {
+	var number *big.Int
+	switch v := value.(type) {
+	case json.Number:
+		parsed, ok := new(big.Int).SetString(v.String(), 10)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an integer", v.String())
+		}
+		number = parsed
+	case string:
+		negative := strings.HasPrefix(v, "-")
+		parsed, ok := math.ParseBig256(strings.TrimPrefix(v, "-"))
+		if !ok || v == "" || v == "-" {
+			return nil, fmt.Errorf("%q is not an integer", v)
+		}
+		if negative {
+			parsed.Neg(parsed)
+		}
+		number = parsed
+	default:
+		return nil, fmt.Errorf("expected an integer")
+	}
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(bits))
+	if signed {
+		limit.Rsh(limit, 1)
+		if number.Cmp(limit) >= 0 || number.Cmp(new(big.Int).Neg(limit)) < 0 {
+			return nil, fmt.Errorf("%s does not fit in int%d", number.String(), bits)
+		}
+		return number, nil
+	}
+	if number.Sign() < 0 || number.Cmp(limit) >= 0 {
+		return nil, fmt.Errorf("%s does not fit in uint%d", number.String(), bits)
+	}
+	return number, nil
+}
+
+func typedBytes(value interface{}) ([]byte, error) {
+	str, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected 0x-prefixed hex")
+	}
+	raw, err := hexutil.Decode(str)
+	if err != nil {
+		return nil, fmt.Errorf("expected 0x-prefixed hex: %v", err)
+	}
+	return raw, nil
+}
@@ -0,0 +1,114 @@
+package guardian
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/eximchain/go-ethereum/common/hexutil"
+	"github.com/eximchain/go-ethereum/crypto"
+	"github.com/hashicorp/vault/logical"
+)
+
+// The Mail example from EIP-712, with its published hashes.
+const (
+	mailTypedData       = `{"types":{"EIP712Domain":[{"name":"name","type":"string"},{"name":"version","type":"string"},{"name":"chainId","type":"uint256"},{"name":"verifyingContract","type":"address"}],"Person":[{"name":"name","type":"string"},{"name":"wallet","type":"address"}],"Mail":[{"name":"from","type":"Person"},{"name":"to","type":"Person"},{"name":"contents","type":"string"}]},"primaryType":"Mail","domain":{"name":"Ether Mail","version":"1","chainId":1,"verifyingContract":"0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"},"message":{"from":{"name":"Cow","wallet":"0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"},"to":{"name":"Bob","wallet":"0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},"contents":"Hello, Bob!"}}`
+	mailEncodedType     = "Mail(Person from,Person to,string contents)Person(string name,address wallet)"
+	mailDomainSeparator = "0xf2cee375fa42b42143804025fc449deafd50cc031ca257e0b194a650a912090f"
+	mailMessageHash     = "0xc52c0ee5d84264471806290a3f2c4cecfc5490626bf912d01f240d7a274b371e"
+	mailDigest          = "0xbe609aee343fb3c4b28e1df9e632fca64fcfaede20f02e86244efddf30957bd2"
+)
+
+func TestTypedData_Mail(t *testing.T) {
+	typed, err := ParseTypedData([]byte(mailTypedData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := typed.Validate(nil); err != nil {
+		t.Fatal(err)
+	}
+	if encoded := typed.EncodeType("Mail"); encoded != mailEncodedType {
+		t.Errorf("expected %s, got %s", mailEncodedType, encoded)
+	}
+	digest, domainSeparator, messageHash, err := typed.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, pair := range map[string][2]string{
+		"domain_separator": {mailDomainSeparator, hexutil.Encode(domainSeparator)},
+		"message_hash":     {mailMessageHash, hexutil.Encode(messageHash)},
+		"digest":           {mailDigest, hexutil.Encode(digest)},
+	} {
+		if pair[0] != pair[1] {
+			t.Errorf("%s: expected %s, got %s", name, pair[0], pair[1])
+		}
+	}
+}
+
+func TestTypedData_Validate(t *testing.T) {
+	// Each case swaps one fragment of the Mail document for a broken one
+	cases := map[string][2]string{
+		"missing chainId":     {`"chainId":1,`, ``},
+		"wrong chainId type":  {`{"name":"chainId","type":"uint256"}`, `{"name":"chainId","type":"string"}`},
+		"undeclared domain":   {`"version":"1"`, `"version":"1","salt":"0x00"`},
+		"undeclared struct":   {`{"name":"wallet","type":"address"}`, `{"name":"wallet","type":"Wallet"}`},
+		"unknown primaryType": {`"primaryType":"Mail"`, `"primaryType":"Letter"`},
+	}
+	for name, swap := range cases {
+		typed, err := ParseTypedData([]byte(strings.Replace(mailTypedData, swap[0], swap[1], 1)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := typed.Validate(nil); err == nil {
+			t.Errorf("%s: expected Validate to fail", name)
+		}
+	}
+
+	typed, err := ParseTypedData([]byte(mailTypedData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := typed.Validate(big.NewInt(1)); err != nil {
+		t.Errorf("expected chain_id 1 to match, got %v", err)
+	}
+	if err := typed.Validate(big.NewInt(2)); err == nil {
+		t.Error("expected chain_id 2 not to match the domain")
+	}
+}
+
+func TestBackend_SignTyped(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "sign/typed",
+		Storage:   storage,
+		EntityID:  "entity-alice",
+		Data:      map[string]interface{}{"typed_data": mailTypedData, "chain_id": "1"},
+	})
+	if err != nil || isError(resp) {
+		t.Fatalf("sign/typed failed: %v %#v", err, resp)
+	}
+	if resp.Data["digest"] != mailDigest {
+		t.Fatalf("expected digest %s, got %v", mailDigest, resp.Data["digest"])
+	}
+	sig, err := hexutil.Decode(resp.Data["signature"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig[64] != 27 && sig[64] != 28 {
+		t.Fatalf("expected v of 27 or 28, got %d", sig[64])
+	}
+	sig[64] -= 27
+	digest, _ := hexutil.Decode(mailDigest)
+	pub, err := crypto.SigToPub(digest, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer := crypto.PubkeyToAddress(*pub).Hex(); signer != fv.kv["alice"]["publicAddressHex"] {
+		t.Fatalf("expected alice's address, recovered %s", signer)
+	}
+}
@@ -0,0 +1,398 @@
+package guardian
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/helper/locksutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	// UserStatusActive : The user may sign.
+	UserStatusActive = "active"
+	// UserStatusDisabled : A maintainer has blocked the user from signing.  Their key is kept.
+	UserStatusDisabled = "disabled"
+)
+
+// usernameSegment : A username as it may sit in a storage or KV path: no '/', whitespace or
+// control characters, and not '.' or '..' on its own, so it can never step out of its folder.
+const usernameSegment = `[^/\s\x00-\x1f\x7f.][^/\s\x00-\x1f\x7f]*|\.[^/\s\x00-\x1f\x7f.][^/\s\x00-\x1f\x7f]*|\.\.[^/\s\x00-\x1f\x7f]+`
+
+var usernamePattern = regexp.MustCompile(`^(?:` + usernameSegment + `)$`)
+
+//-----------------------------------------
+//  User Administration
+//-----------------------------------------
+
+// UserAccount : What the Guardian keeps about an enduser besides their key.  Users created
+// before accounts were recorded have none, and are treated as active.
+type UserAccount struct {
+	CreatedAt       *time.Time `json:"created_at,omitempty"`
+	Status          string     `json:"status"`
+	StatusReason    string     `json:"status_reason,omitempty"`
+	StatusChangedAt *time.Time `json:"status_changed_at,omitempty"`
+}
+
+// AccountDisabledError : Returned in place of a key for users who may not sign.
+type AccountDisabledError struct {
+	Username string
+	Status   string
+	Reason   string
+}
+
+func (e *AccountDisabledError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("%s's account is %s", e.Username, e.Status)
+	}
+	return fmt.Sprintf("%s's account is %s: %s", e.Username, e.Status, e.Reason)
+}
+
+// validateUsername : Identity providers hand back whatever username they hold, and it becomes
+// part of every path the user's key and records are stored under.
+func validateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("username %q cannot be stored, it is empty or holds a '/', whitespace or control characters", username)
+	}
+	return nil
+}
+
+// usernameRegex : A path field matching the usernames validateUsername allows.
+func usernameRegex(name string) string {
+	return fmt.Sprintf("(?P<%s>%s)", name, usernameSegment)
+}
+
+// escrowNameRegex : A path field matching the names keys are escrowed under, a username or
+// one of their named keys.
+func escrowNameRegex(name string) string {
+	return fmt.Sprintf("(?P<%s>(?:%s)(?:/named/%s)?)", name, usernameSegment, keyNameSegment)
+}
+
+func accountPath(username string) string {
+	return "accounts/" + username
+}
+
+// readAccount : username's account, or an active one without a creation time if none is stored.
+func readAccount(ctx context.Context, s logical.Storage, username string) (*UserAccount, error) {
+	entry, err := s.Get(ctx, accountPath(username))
+	if err != nil {
+		return nil, err
+	}
+	account := &UserAccount{Status: UserStatusActive}
+	if entry != nil {
+		if err := entry.DecodeJSON(account); err != nil {
+			return nil, err
+		}
+	}
+	return account, nil
+}
+
+func writeAccount(ctx context.Context, s logical.Storage, username string, account *UserAccount) error {
+	entry, err := logical.StorageEntryJSON(accountPath(username), account)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// createAccount : Records a brand new user as active.
+func createAccount(ctx context.Context, s logical.Storage, username string) error {
+	now := time.Now().UTC()
+	return writeAccount(ctx, s, username, &UserAccount{CreatedAt: &now, Status: UserStatusActive})
+}
+
+// setAccountStatus : Moves username to status, noting why and when.
+func setAccountStatus(ctx context.Context, s logical.Storage, username, status, reason string) (*UserAccount, error) {
+	account, err := readAccount(ctx, s, username)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	account.Status = status
+	account.StatusReason = reason
+	account.StatusChangedAt = &now
+	return account, writeAccount(ctx, s, username, account)
+}
+
+// checkAccountActive : An *AccountDisabledError unless username may sign.
+func checkAccountActive(ctx context.Context, s logical.Storage, username string) error {
+	account, err := readAccount(ctx, s, username)
+	if err != nil {
+		return err
+	}
+	if account.Status != UserStatusActive {
+		return &AccountDisabledError{Username: username, Status: account.Status, Reason: account.StatusReason}
+	}
+	return nil
+}
+
+// lastSignAt : When username last signed, from their history, or nil if they never have.
+// Exports are not signatures and are passed over.
+func (b *backend) lastSignAt(ctx context.Context, s logical.Storage, username string) (*time.Time, error) {
+	keys, err := s.List(ctx, historyPrefix(username))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	for _, key := range keys {
+		entry, err := s.Get(ctx, historyPrefix(username)+key)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		var event SignEvent
+		if err := entry.DecodeJSON(&event); err != nil {
+			return nil, err
+		}
+		if event.Mode != EventModeExport {
+			return &event.Timestamp, nil
+		}
+	}
+	return nil, nil
+}
+
+// userDetails : What guardian/admin/users/<name> shows, or nil if username has no key.
+func (b *backend) userDetails(ctx context.Context, s logical.Storage, client *Client, username string) (map[string]interface{}, error) {
+	userKey, err := client.keys.readKey(ctx, username)
+	if err != nil || userKey == nil {
+		return nil, err
+	}
+	account, err := readAccount(ctx, s, username)
+	if err != nil {
+		return nil, err
+	}
+	history, err := readKeyHistory(ctx, s, username, userKey)
+	if err != nil {
+		return nil, err
+	}
+	lastSign, err := b.lastSignAt(ctx, s, username)
+	if err != nil {
+		return nil, err
+	}
+	createdAt := account.CreatedAt
+	if createdAt == nil && len(history) > 0 {
+		createdAt = history[0].CreatedAt
+	}
+	details := map[string]interface{}{
+		"username":      username,
+		"address":       userKey.PublicAddressHex,
+		"legacy":        userKey.IsLegacy(),
+		"key_version":   history[len(history)-1].Version,
+		"status":        account.Status,
+		"status_reason": account.StatusReason,
+		"created_at":    "",
+		"last_sign_at":  ""}
+	if createdAt != nil {
+		details["created_at"] = createdAt.Format(time.RFC3339)
+	}
+	if lastSign != nil {
+		details["last_sign_at"] = lastSign.Format(time.RFC3339)
+	}
+	if account.StatusChangedAt != nil {
+		details["status_changed_at"] = account.StatusChangedAt.Format(time.RFC3339)
+	}
+	return details, nil
+}
+
+// deleteUser : Removes username's current, retired and named keys, along with their key history,
+// escrow and account, and unregisters them from the identity provider.  Their sign history
+// is kept for auditing.  Should they log in again they start over with a new key.
+func (b *backend) deleteUser(ctx context.Context, s logical.Storage, client *Client, username string) error {
+	b.rotateLock.Lock()
+	defer b.rotateLock.Unlock()
+	lock := locksutil.LockForKey(b.userLocks, username)
+	lock.Lock()
+	defer lock.Unlock()
+	userKey, err := client.keys.readKey(ctx, username)
+	if err != nil {
+		return err
+	}
+	history, err := readKeyHistory(ctx, s, username, userKey)
+	if err != nil {
+		return err
+	}
+	for _, version := range history {
+		if version.RetiredAt == nil {
+			continue
+		}
+		if err := client.keys.deleteKey(ctx, retiredKeyName(username, version.Version)); err != nil {
+			return fmt.Errorf("deleting retired key %d: %v", version.Version, err)
+		}
+	}
+	if err := deleteNamedKeys(ctx, s, client, username); err != nil {
+		return err
+	}
+	if err := client.keys.deleteKey(ctx, username); err != nil {
+		return fmt.Errorf("deleting key: %v", err)
+	}
+	for _, path := range []string{keyHistoryPath(username), escrowRecordPath(username), recoveryRecordPath(username), accountPath(username)} {
+		if err := s.Delete(ctx, path); err != nil {
+			return err
+		}
+	}
+	b.identities.invalidateUser(username)
+	if err := client.identity.Unregister(ctx, username); err != nil {
+		return fmt.Errorf("key deleted, but unable to unregister from %s: %v", client.identity.Name(), err)
+	}
+	return nil
+}
+
+//-----------------------------------------
+//  Account Creation
+//-----------------------------------------
+
+// Repair actions : What repairUser reports doing to a user.
+const (
+	RepairRegistered   = "registered"
+	RepairEscrowed     = "escrowed"
+	RepairUnregistered = "unregistered"
+	RepairAccountReset = "removed_account"
+)
+
+// createUser : Makes username's key on their first login.  Logins for the same user queue on
+// its lock, and the key is only written if none exists, so racing logins end up with one
+// key.  A failure part way undoes the earlier steps, and anything which cannot be undone is
+// left for repairUser.  created is false when another login already made the key.  Users
+// whose key is gone but still escrowed get ErrKeyInEscrow, and their escrow is left alone.
+func (b *backend) createUser(ctx context.Context, s logical.Storage, cfg *Config, client *Client, username string) (address string, created bool, err error) {
+	lock := locksutil.LockForKey(b.userLocks, username)
+	lock.Lock()
+	defer lock.Unlock()
+
+	existing, err := client.keys.readKey(ctx, username)
+	if err != nil {
+		return "", false, err
+	}
+	if existing != nil {
+		return existing.PublicAddressHex, false, nil
+	}
+	// A user with escrow but no key has lost it, and only the escrow can bring it back
+	escrowed, err := b.readEscrowRecord(ctx, s, username)
+	if err != nil {
+		return "", false, err
+	}
+	if escrowed != nil {
+		return "", false, ErrKeyInEscrow
+	}
+	userKey, err := NewUserKey()
+	if err != nil {
+		return "", false, err
+	}
+	if err := b.escrowKey(ctx, s, cfg, username, userKey); err != nil {
+		return "", false, fmt.Errorf("escrowing new key: %v", err)
+	}
+	if err := client.identity.Register(ctx, username); err != nil {
+		b.undoCreateUser(ctx, s, client, username, escrowed, false)
+		return "", false, fmt.Errorf("registering with %s: %v", client.identity.Name(), err)
+	}
+	stored, err := createKey(ctx, client.keys, username, userKey)
+	if err != nil {
+		b.undoCreateUser(ctx, s, client, username, escrowed, false)
+		return "", false, fmt.Errorf("storing key: %v", err)
+	}
+	if stored != userKey {
+		// Written from outside this lock, so escrow the key which won instead
+		if err := b.escrowKey(ctx, s, cfg, username, stored); err != nil {
+			return "", false, fmt.Errorf("escrowing existing key: %v", err)
+		}
+		return stored.PublicAddressHex, false, nil
+	}
+	if err := createAccount(ctx, s, username); err != nil {
+		b.undoCreateUser(ctx, s, client, username, escrowed, true)
+		return "", false, fmt.Errorf("recording account: %v", err)
+	}
+	return userKey.PublicAddressHex, true, nil
+}
+
+// undoCreateUser : Removes what a failed createUser wrote and puts back the escrow record it
+// replaced.  The identity provider is always asked to forget the user, since a failed
+// Register may still have gone through.
+func (b *backend) undoCreateUser(ctx context.Context, s logical.Storage, client *Client, username string, previousEscrow *escrowRecord, keyWritten bool) {
+	failures := []string{}
+	if keyWritten {
+		if err := client.keys.deleteKey(ctx, username); err != nil {
+			failures = append(failures, "key: "+err.Error())
+		}
+	}
+	b.restoreEscrowRecord(ctx, s, username, previousEscrow)
+	if err := s.Delete(ctx, accountPath(username)); err != nil {
+		failures = append(failures, accountPath(username)+": "+err.Error())
+	}
+	if err := client.identity.Unregister(ctx, username); err != nil {
+		failures = append(failures, client.identity.Name()+": "+err.Error())
+	}
+	if len(failures) > 0 {
+		b.Logger().Error("unable to undo a failed user creation, repair it at guardian/admin/repair",
+			"username", username, "failures", strings.Join(failures, "; "))
+	}
+}
+
+// repairUser : Settles a user left half-created, whether by a failed login or by an older
+// version without rollback.  A user with a key is registered with the identity provider
+// again, and escrowed if escrow is on and their escrow is missing or for another key.  A
+// user without one is unregistered and loses any account record, so their next login starts
+// clean; their escrow is kept, since it may be how a lost key gets recovered.
+func (b *backend) repairUser(ctx context.Context, s logical.Storage, cfg *Config, client *Client, username string) (userKey *UserKey, repaired []string, err error) {
+	lock := locksutil.LockForKey(b.userLocks, username)
+	lock.Lock()
+	defer lock.Unlock()
+
+	repaired = []string{}
+	userKey, err = client.keys.readKey(ctx, username)
+	if err != nil {
+		return nil, nil, err
+	}
+	if userKey == nil {
+		if err := client.identity.Unregister(ctx, username); err != nil {
+			return nil, repaired, err
+		}
+		repaired = append(repaired, RepairUnregistered)
+		entry, err := s.Get(ctx, accountPath(username))
+		if err != nil {
+			return nil, repaired, err
+		}
+		if entry != nil {
+			if err := s.Delete(ctx, accountPath(username)); err != nil {
+				return nil, repaired, err
+			}
+			repaired = append(repaired, RepairAccountReset)
+		}
+		return nil, repaired, nil
+	}
+
+	if err := client.identity.Register(ctx, username); err != nil {
+		return userKey, repaired, err
+	}
+	repaired = append(repaired, RepairRegistered)
+	if cfg.EscrowThreshold > 0 {
+		record, err := b.readEscrowRecord(ctx, s, username)
+		if err != nil {
+			return userKey, repaired, err
+		}
+		if record == nil || record.Address != userKey.PublicAddressHex {
+			if err := b.escrowKey(ctx, s, cfg, username, userKey); err != nil {
+				return userKey, repaired, err
+			}
+			repaired = append(repaired, RepairEscrowed)
+		}
+	}
+	return userKey, repaired, nil
+}
+
+// parseUserStatus : The status a maintainer may set through guardian/admin/users/<name>.
+func parseUserStatus(status string) (string, error) {
+	switch strings.ToLower(status) {
+	case UserStatusActive:
+		return UserStatusActive, nil
+	case UserStatusDisabled:
+		return UserStatusDisabled, nil
+	default:
+		return "", fmt.Errorf("status must be %s or %s", UserStatusActive, UserStatusDisabled)
+	}
+}
@@ -0,0 +1,258 @@
+package guardian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func userRequest(storage logical.Storage, op logical.Operation, data map[string]interface{}) *logical.Request {
+	return &logical.Request{
+		Operation: op,
+		Path:      "admin/users/alice",
+		Storage:   storage,
+		Data:      data,
+	}
+}
+
+// registeringProvider : Logs everyone in and tracks who is registered, failing to register
+// anyone while failRegister is set.
+type registeringProvider struct {
+	pushProvider
+	mu           sync.Mutex
+	registered   map[string]int
+	failRegister error
+}
+
+func (p *registeringProvider) Register(ctx context.Context, username string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failRegister != nil {
+		return p.failRegister
+	}
+	p.registered[username]++
+	return nil
+}
+
+func (p *registeringProvider) Unregister(ctx context.Context, username string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.registered, username)
+	return nil
+}
+
+func (p *registeringProvider) registrations(username string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.registered[username]
+}
+
+// newRegisteringBackend : A signing backend whose cached Client logs in with a registeringProvider.
+func newRegisteringBackend(t *testing.T) (*backend, logical.Storage, *Client, *registeringProvider, func()) {
+	b, storage, fv := newSigningBackend(t)
+	cfg, client, err := b.configAndClient(context.Background(), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &registeringProvider{registered: map[string]int{}}
+	cfg.Provider = ProviderOkta
+	cfg.LoginRateLimit = 1000
+	client.identity = provider
+	return b, storage, client, provider, fv.server.Close
+}
+
+func firstLoginRequest(storage logical.Storage, username string) *logical.Request {
+	req := loginRequest(storage, map[string]interface{}{})
+	req.Data["okta_username"] = username
+	return req
+}
+
+// failingStorage : Storage which refuses writes under prefix.
+type failingStorage struct {
+	logical.Storage
+	prefix string
+}
+
+func (s *failingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, s.prefix) {
+		return errors.New("storage unavailable")
+	}
+	return s.Storage.Put(ctx, entry)
+}
+
+func TestBackend_UserAdmin(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+	cfg, client, _ := b.configAndClient(ctx, storage)
+	if _, _, err := b.rotateKey(ctx, storage, cfg, client, "alice", RotatedByMaintainer, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{Operation: logical.ListOperation, Path: "admin/users/", Storage: storage})
+	if err != nil || isError(resp) {
+		t.Fatalf("list failed: %v %#v", err, resp)
+	}
+	if keys := resp.Data["keys"].([]string); len(keys) != 1 || keys[0] != "alice" {
+		t.Fatalf("expected only alice, and not her retired key, got %v", keys)
+	}
+
+	resp, err = b.HandleRequest(ctx, userRequest(storage, logical.ReadOperation, nil))
+	if err != nil || isError(resp) || resp.Data["status"] != UserStatusActive || resp.Data["last_sign_at"] != "" || resp.Data["key_version"] != 2 {
+		t.Fatalf("unexpected user %v %#v", err, resp)
+	}
+	if resp, err := b.HandleRequest(ctx, signRequest(storage)); err != nil || isError(resp) {
+		t.Fatalf("sign failed: %v %#v", err, resp)
+	}
+	resp, _ = b.HandleRequest(ctx, userRequest(storage, logical.ReadOperation, nil))
+	if resp.Data["last_sign_at"] == "" {
+		t.Fatal("expected the signature to show as last_sign_at")
+	}
+
+	resp, err = b.HandleRequest(ctx, userRequest(storage, logical.UpdateOperation, map[string]interface{}{"status": UserStatusDisabled, "reason": "on leave"}))
+	if err != nil || isError(resp) || resp.Data["status"] != UserStatusDisabled || resp.Data["status_reason"] != "on leave" {
+		t.Fatalf("disable failed: %v %#v", err, resp)
+	}
+	if resp, _ := b.HandleRequest(ctx, signRequest(storage)); resp == nil || !isError(resp) {
+		t.Fatalf("expected a disabled user's sign to be refused, got %#v", resp)
+	}
+	if _, err := client.readKeyByUsername(ctx, "alice"); err != nil {
+		t.Fatalf("expected disabling to keep the key: %v", err)
+	}
+	b.HandleRequest(ctx, userRequest(storage, logical.UpdateOperation, map[string]interface{}{"status": UserStatusActive}))
+	if resp, err := b.HandleRequest(ctx, signRequest(storage)); err != nil || isError(resp) {
+		t.Fatalf("expected sign to work once re-enabled: %v %#v", err, resp)
+	}
+
+	resp, _ = b.HandleRequest(ctx, userRequest(storage, logical.DeleteOperation, map[string]interface{}{"confirm": "bob"}))
+	if resp == nil || !isError(resp) {
+		t.Fatalf("expected delete without confirmation to be refused, got %#v", resp)
+	}
+	if _, err := b.HandleRequest(ctx, userRequest(storage, logical.DeleteOperation, map[string]interface{}{"confirm": "alice"})); err != nil {
+		t.Fatal(err)
+	}
+	if len(fv.kv) != 0 {
+		t.Fatalf("expected the current and retired keys to be gone, got %v", fv.kv)
+	}
+	if resp, _ := b.HandleRequest(ctx, userRequest(storage, logical.ReadOperation, nil)); resp != nil {
+		t.Fatalf("expected a deleted user to read as missing, got %#v", resp)
+	}
+}
+
+func TestBackend_ConcurrentFirstLogins(t *testing.T) {
+	b, storage, client, provider, cleanup := newRegisteringBackend(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	usernames := []string{"bob", "carol", "dave"}
+	const loginsEach = 15
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	addresses := map[string][]string{}
+	failures := []string{}
+	for _, username := range usernames {
+		for i := 0; i < loginsEach; i++ {
+			wg.Add(1)
+			go func(username string) {
+				defer wg.Done()
+				resp, err := b.HandleRequest(ctx, firstLoginRequest(storage, username))
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil || isError(resp) || resp.Data["client_token"] == nil {
+					failures = append(failures, fmt.Sprintf("%s: %v %#v", username, err, resp))
+					return
+				}
+				if address, ok := resp.Data["address"].(string); ok {
+					addresses[username] = append(addresses[username], address)
+				}
+			}(username)
+		}
+	}
+	wg.Wait()
+	if len(failures) > 0 {
+		t.Fatalf("%d logins failed, first: %s", len(failures), failures[0])
+	}
+	for _, username := range usernames {
+		stored, err := client.keys.readKey(ctx, username)
+		if err != nil || stored == nil {
+			t.Fatalf("expected %s to have a key: %v", username, err)
+		}
+		if len(addresses[username]) != 1 || addresses[username][0] != stored.PublicAddressHex {
+			t.Errorf("expected exactly one login to create %s's key %s, got %v", username, stored.PublicAddressHex, addresses[username])
+		}
+		if n := provider.registrations(username); n != 1 {
+			t.Errorf("expected %s to be registered once, got %d", username, n)
+		}
+	}
+}
+
+func TestBackend_FirstLoginRollback(t *testing.T) {
+	b, storage, client, provider, cleanup := newRegisteringBackend(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	provider.failRegister = errors.New("okta unavailable")
+	resp, _ := b.HandleRequest(ctx, firstLoginRequest(storage, "bob"))
+	if errorCode(resp) != ErrCodeKeyCreationFailed {
+		t.Fatalf("expected the failed registration to fail the login, got %#v", resp)
+	}
+	if key, _ := client.keys.readKey(ctx, "bob"); key != nil {
+		t.Fatal("expected no key to be stored after a failed registration")
+	}
+
+	// Failing after the key is written takes the key and registration back out
+	provider.failRegister = nil
+	resp, _ = b.HandleRequest(ctx, firstLoginRequest(&failingStorage{Storage: storage, prefix: "accounts/"}, "bob"))
+	if errorCode(resp) != ErrCodeKeyCreationFailed {
+		t.Fatalf("expected the failed account write to fail the login, got %#v", resp)
+	}
+	if key, _ := client.keys.readKey(ctx, "bob"); key != nil || provider.registrations("bob") != 0 {
+		t.Fatalf("expected the key and registration to be undone, registrations: %d", provider.registrations("bob"))
+	}
+
+	resp, err := b.HandleRequest(ctx, firstLoginRequest(storage, "bob"))
+	if err != nil || isError(resp) || resp.Data["address"] == nil {
+		t.Fatalf("expected the next login to create bob cleanly, got %v %#v", err, resp)
+	}
+	if provider.registrations("bob") != 1 {
+		t.Fatalf("expected bob to be registered once, got %d", provider.registrations("bob"))
+	}
+}
+
+func TestBackend_RepairUser(t *testing.T) {
+	b, storage, _, provider, cleanup := newRegisteringBackend(t)
+	defer cleanup()
+	ctx := context.Background()
+	repair := func(username string) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{Operation: logical.UpdateOperation, Path: "admin/repair/" + username, Storage: storage})
+		if err != nil || isError(resp) {
+			t.Fatalf("repairing %s failed: %v %#v", username, err, resp)
+		}
+		return resp
+	}
+
+	// Registered, with an account, but the key was never written
+	provider.Register(ctx, "ghost")
+	if err := createAccount(ctx, storage, "ghost"); err != nil {
+		t.Fatal(err)
+	}
+	resp := repair("ghost")
+	if resp.Data["has_key"] != false || provider.registrations("ghost") != 0 {
+		t.Fatalf("expected ghost to be unregistered, got %#v", resp.Data)
+	}
+	if entry, _ := storage.Get(ctx, accountPath("ghost")); entry != nil {
+		t.Fatal("expected ghost's account record to be removed")
+	}
+
+	// alice holds a key, but was never registered
+	resp = repair("alice")
+	repaired := resp.Data["repaired"].([]string)
+	if resp.Data["address"] == nil || len(repaired) != 1 || repaired[0] != RepairRegistered || provider.registrations("alice") != 1 {
+		t.Fatalf("expected alice to be registered, got %#v", resp.Data)
+	}
+}
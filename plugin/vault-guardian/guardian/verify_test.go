@@ -0,0 +1,112 @@
+package guardian
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/eximchain/go-ethereum/common/hexutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func verifyRequest(storage logical.Storage, data map[string]interface{}) *logical.Request {
+	return &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "verify",
+		Storage:   storage,
+		EntityID:  "entity-alice",
+		Data:      data,
+	}
+}
+
+func TestBackend_Verify(t *testing.T) {
+	b, storage, fv := newSigningBackend(t)
+	defer fv.server.Close()
+	ctx := context.Background()
+	alice := fv.kv["alice"]["publicAddressHex"].(string)
+	other := "0x3535353535353535353535353535353535353535"
+
+	// Reads carry the public key which signatures recover to
+	resp, err := b.HandleRequest(ctx, &logical.Request{Operation: logical.ReadOperation, Path: "sign", Storage: storage, EntityID: "entity-alice"})
+	if err != nil || isError(resp) {
+		t.Fatalf("reading the address failed: %v %#v", err, resp)
+	}
+	publicKey := resp.Data["public_key"].(string)
+	if compressed, _ := CompressPublicKey(publicKey); compressed == "" || resp.Data["compressed_public_key"] != compressed {
+		t.Fatalf("expected the compressed form of %s, got %v", publicKey, resp.Data["compressed_public_key"])
+	}
+
+	signed := map[string]map[string]interface{}{
+		"raw_data": {"raw_data": testHash},
+		"message":  {"message": "Sign in to Example"}}
+	for label, data := range signed {
+		resp, err = b.HandleRequest(ctx, &logical.Request{Operation: logical.UpdateOperation, Path: "sign", Storage: storage, EntityID: "entity-alice", Data: data})
+		if err != nil || isError(resp) {
+			t.Fatalf("%s: signing failed: %v %#v", label, err, resp)
+		}
+		signature := resp.Data["signature"].(string)
+
+		cases := []struct {
+			addresses interface{}
+			valid     bool
+		}{
+			{nil, true},
+			{other, true},
+			{other + "," + alice, true},
+		}
+		for _, c := range cases {
+			verifyData := map[string]interface{}{"signature": signature}
+			for field, value := range data {
+				verifyData[field] = value
+			}
+			if c.addresses != nil {
+				verifyData["addresses"] = c.addresses
+			}
+			resp, err = b.HandleRequest(ctx, verifyRequest(storage, verifyData))
+			if err != nil || isError(resp) {
+				t.Fatalf("%s: verifying failed: %v %#v", label, err, resp)
+			}
+			if resp.Data["signer"] != alice || resp.Data["public_key"] != publicKey {
+				t.Fatalf("%s: expected alice to be recovered, got %#v", label, resp.Data)
+			}
+			if resp.Data["valid"] != c.valid || resp.Data["matches_caller"] != true || resp.Data["matched_address"] != alice {
+				t.Errorf("%s against %v: expected valid to be %v and alice to match, got %#v", label, c.addresses, c.valid, resp.Data)
+			}
+		}
+	}
+
+	// Someone else's signature is only valid against their address
+	otherKey, otherAddress, err := CreateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := hex.DecodeString(testHash)
+	sig, err := SignWithHexKey(hash, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addresses, valid := range map[string]bool{"": false, other: false, other + "," + otherAddress: true} {
+		data := map[string]interface{}{"raw_data": testHash, "signature": hexutil.Encode(sig)}
+		if addresses != "" {
+			data["addresses"] = addresses
+		}
+		resp, err = b.HandleRequest(ctx, verifyRequest(storage, data))
+		if err != nil || isError(resp) {
+			t.Fatalf("verifying against %q failed: %v %#v", addresses, err, resp)
+		}
+		if resp.Data["valid"] != valid || resp.Data["matches_caller"] != false {
+			t.Errorf("against %q: expected valid to be %v without matching the caller, got %#v", addresses, valid, resp.Data)
+		}
+	}
+
+	refused := []map[string]interface{}{
+		{"raw_data": testHash, "signature": "0x1234"},
+		{"raw_data": testHash, "signature": "not hex"},
+		{"raw_data": testHash, "signature": "0x" + testHash + testHash + "1b", "addresses": "not an address"},
+	}
+	for _, data := range refused {
+		if resp, _ = b.HandleRequest(ctx, verifyRequest(storage, data)); errorCode(resp) != ErrCodeInvalidRequest {
+			t.Errorf("expected %v to be refused, got %#v", data, resp)
+		}
+	}
+}
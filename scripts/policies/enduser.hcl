@@ -1,3 +1,35 @@
 path "guardian/sign" {
     capabilities = ["create", "update", "read"]
-}
\ No newline at end of file
+}
+
+path "guardian/sign/*" {
+    capabilities = ["create", "update", "read"]
+}
+
+path "guardian/verify" {
+    capabilities = ["create", "update"]
+}
+
+path "guardian/history" {
+    capabilities = ["read"]
+}
+
+path "guardian/rotate" {
+    capabilities = ["create", "update"]
+}
+
+path "guardian/addresses" {
+    capabilities = ["read"]
+}
+
+path "guardian/export" {
+    capabilities = ["create", "update"]
+}
+
+path "guardian/keys" {
+    capabilities = ["list"]
+}
+
+path "guardian/keys/*" {
+    capabilities = ["create", "update", "read"]
+}
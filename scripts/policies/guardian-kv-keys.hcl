@@ -0,0 +1,9 @@
+# Only needed while key_storage is kv.  Rotation overwrites a user's existing key, and
+# retires the old one beside it, so update is needed alongside create.
+path "keys/*" {
+    capabilities = ["read", "create", "update", "delete"]
+}
+
+path "keys/" {
+    capabilities = ["list"]
+}
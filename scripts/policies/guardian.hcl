@@ -1,5 +1,5 @@
 path "auth/okta/users/*" {
-    capabilities = ["read", "create", "update"]
+    capabilities = ["read", "create", "update", "delete"]
 }
 
 path "auth/token/lookup" {
@@ -10,6 +10,10 @@ path "identity/lookup/entity" {
     capabilities = ["create","update"]
 }
 
-path "keys/*" {
-    capabilities = ["read", "create"]
-}
\ No newline at end of file
+path "auth/token/create/guardian-enduser" {
+    capabilities = ["create", "update"]
+}
+
+path "auth/token/revoke-accessor" {
+    capabilities = ["update"]
+}
@@ -3,5 +3,13 @@ path "auth/approle/role/guardian/secret-id" {
 }
 
 path "guardian/authorize" {
-    capabilities = ["create"]
+    capabilities = ["create", "read"]
+}
+
+path "guardian/config" {
+    capabilities = ["read"]
+}
+
+path "guardian/admin/*" {
+    capabilities = ["create", "read", "update", "delete", "list"]
 }
\ No newline at end of file
@@ -9,14 +9,17 @@ PLUGIN_PATH="../plugin/vault-guardian/"
 # Enable & configure auth plugins
 vault auth enable approle
 vault auth enable okta
+# The Guardian challenges MFA factors itself, so auth/okta only checks passwords
 vault write auth/okta/config \
-    organization="$OKTA_URL"
-    token="$OKTA_TOKEN"
-    base_url="okta.com"
+    organization="$OKTA_URL" \
+    token="$OKTA_TOKEN" \
+    base_url="okta.com" \
+    bypass_okta_mfa=true
 
 # Write the **Guardian**, **Enduser**, and **Maintainer** policies
 vault policy write enduser ./policies/enduser.hcl
 vault policy write guardian ./policies/guardian.hcl
+vault policy write guardian-kv-keys ./policies/guardian-kv-keys.hcl
 vault policy write maintainer ./policies/maintainer.hcl
 
 # Register the Guardian plugin
@@ -38,10 +41,16 @@ vault secrets enable -path=keys kv
 vault write auth/okta/groups/vault-guardian-endusers policies=enduser
 vault write auth/okta/groups/vault-guardian-maintainers policies=maintainer
 
+# Create the token role for single-use enduser sign tokens
+vault write auth/token/roles/guardian-enduser \
+    allowed_policies="enduser" \
+    orphan=true \
+    renewable=false
+
 # Create the Guardian AppRole
 vault write auth/approle/role/guardian \
     secret_id_num_uses=1 \
-    policies="guardian" \
+    policies="guardian,guardian-kv-keys" \
     secret_id_ttl="10m" \
     secret_id_bound_cidrs="127.0.0.1/32"
     token_bound_cidrs="127.0.0.1/32"